@@ -0,0 +1,341 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apis
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// logMaxColumn is the maximum column the cursor is moved to by an escape sequence. The lines are only
+// longer if their text is longer.
+const logMaxColumn = 1024
+
+// ansiColors are the names of the 8 basic ANSI colors. Bright colors are prefixed with "bright-".
+var ansiColors = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// LogStyle type.
+// Style of a fragment of a log line. Colors are either the name of an ANSI color (e.g. "red" or "bright-red")
+// or an RGB color (e.g. "#ff8700") for the 256-color and true color codes. Empty colors are the defaults.
+type LogStyle struct {
+	Foreground string `json:"fg,omitempty"`
+	Background string `json:"bg,omitempty"`
+	Bold       bool   `json:"bold,omitempty"`
+	Italic     bool   `json:"italic,omitempty"`
+	Underline  bool   `json:"underline,omitempty"`
+}
+
+// LogSpan type.
+// Fragment of a log line with the same style.
+type LogSpan struct {
+	LogStyle
+	Text string `json:"text"`
+}
+
+// LogRenderedLine type.
+// Line of a log rendered as a list of styled fragments.
+type LogRenderedLine struct {
+	Spans []LogSpan `json:"spans"`
+}
+
+type logCell struct {
+	r     rune
+	style LogStyle
+}
+
+// logRenderer interprets the ANSI escape sequences of a log as a terminal would do, line by line.
+// A carriage return moves the cursor to the beginning of the line, so that the following text overwrites
+// the line (e.g. progress bars). Escape sequences other than colors and line erasing are discarded.
+type logRenderer struct {
+	lines  []LogRenderedLine
+	cells  []logCell
+	cursor int
+	style  LogStyle
+}
+
+// RenderANSI renders a log with ANSI escape sequences as styled lines.
+func RenderANSI(data []byte) []LogRenderedLine {
+	renderer := &logRenderer{}
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		switch {
+		case r == '\x1b':
+			size = renderer.escape(data)
+		case r == '\n':
+			renderer.newLine()
+		case r == '\r':
+			renderer.cursor = 0
+		case r == '\b':
+			if renderer.cursor > 0 {
+				renderer.cursor--
+			}
+		case r == '\t' || r >= ' ' && r != '\x7f':
+			renderer.put(r)
+		}
+		data = data[size:]
+	}
+	if len(renderer.cells) > 0 {
+		renderer.newLine()
+	}
+	return renderer.lines
+}
+
+// put writes a character at the cursor position, overwriting the previous one (if any).
+func (renderer *logRenderer) put(r rune) {
+	cell := logCell{r, renderer.style}
+	renderer.moveTo(renderer.cursor)
+	if renderer.cursor < len(renderer.cells) {
+		renderer.cells[renderer.cursor] = cell
+	} else {
+		renderer.cells = append(renderer.cells, cell)
+	}
+	renderer.cursor++
+}
+
+// newLine ends the current line, grouping its characters in spans.
+func (renderer *logRenderer) newLine() {
+	line := LogRenderedLine{Spans: []LogSpan{}}
+	var text []rune
+	for i, cell := range renderer.cells {
+		text = append(text, cell.r)
+		if i == len(renderer.cells)-1 || renderer.cells[i+1].style != cell.style {
+			line.Spans = append(line.Spans, LogSpan{cell.style, string(text)})
+			text = nil
+		}
+	}
+	renderer.lines = append(renderer.lines, line)
+	renderer.cells = nil
+	renderer.cursor = 0
+}
+
+// escape interprets the escape sequence at the beginning of data, and returns its length.
+func (renderer *logRenderer) escape(data []byte) int {
+	if len(data) < 2 {
+		return len(data)
+	}
+	switch data[1] {
+	case '[':
+		// Control sequence: parameters and intermediate bytes ended by a final byte (0x40-0x7e)
+		for i := 2; i < len(data); i++ {
+			if data[i] >= 0x40 && data[i] <= 0x7e {
+				renderer.control(string(data[2:i]), data[i])
+				return i + 1
+			}
+		}
+		return len(data)
+	case ']':
+		// Operating system command: ended by BEL or ST (ESC \)
+		for i := 2; i < len(data); i++ {
+			if data[i] == '\a' {
+				return i + 1
+			}
+			if data[i] == '\x1b' && i+1 < len(data) && data[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return len(data)
+	default:
+		return 2
+	}
+}
+
+// control interprets a control sequence. Only SGR (colors and text attributes), and erasing the line
+// or moving the cursor within the line, are supported.
+func (renderer *logRenderer) control(params string, final byte) {
+	switch final {
+	case 'm':
+		renderer.sgr(params)
+	case 'K':
+		switch params {
+		case "", "0":
+			if renderer.cursor < len(renderer.cells) {
+				renderer.cells = renderer.cells[:renderer.cursor]
+			}
+		case "1":
+			for i := 0; i < renderer.cursor && i < len(renderer.cells); i++ {
+				renderer.cells[i] = logCell{' ', LogStyle{}}
+			}
+		case "2":
+			renderer.cells = nil
+		}
+	case 'G':
+		renderer.moveTo(controlCount(params) - 1)
+	case 'C':
+		renderer.moveTo(renderer.cursor + controlCount(params))
+	case 'D':
+		renderer.moveTo(renderer.cursor - controlCount(params))
+	}
+}
+
+// controlCount gets the count (or column) of a cursor movement, 1 by default, and logMaxColumn at most.
+func controlCount(params string) int {
+	n, err := strconv.Atoi(params)
+	if err != nil || n < 1 {
+		return 1
+	}
+	if n > logMaxColumn {
+		return logMaxColumn
+	}
+	return n
+}
+
+// moveTo moves the cursor within the line, filling the line with spaces if required.
+// The line is not filled beyond logMaxColumn.
+func (renderer *logRenderer) moveTo(column int) {
+	if column < 0 {
+		column = 0
+	}
+	if column > len(renderer.cells) && column > logMaxColumn {
+		column = logMaxColumn
+		if len(renderer.cells) > column {
+			column = len(renderer.cells)
+		}
+	}
+	for len(renderer.cells) < column {
+		renderer.cells = append(renderer.cells, logCell{' ', LogStyle{}})
+	}
+	renderer.cursor = column
+}
+
+// sgr applies a "select graphic rendition" sequence to the current style.
+func (renderer *logRenderer) sgr(params string) {
+	codes := []int{0}
+	if params != "" {
+		codes = codes[:0]
+		for _, param := range strings.Split(params, ";") {
+			code, _ := strconv.Atoi(param)
+			codes = append(codes, code)
+		}
+	}
+	style := &renderer.style
+	for i := 0; i < len(codes); i++ {
+		code := codes[i]
+		switch {
+		case code == 0:
+			*style = LogStyle{}
+		case code == 1:
+			style.Bold = true
+		case code == 3:
+			style.Italic = true
+		case code == 4:
+			style.Underline = true
+		case code == 22:
+			style.Bold = false
+		case code == 23:
+			style.Italic = false
+		case code == 24:
+			style.Underline = false
+		case code >= 30 && code <= 37:
+			style.Foreground = ansiColors[code-30]
+		case code == 39:
+			style.Foreground = ""
+		case code >= 40 && code <= 47:
+			style.Background = ansiColors[code-40]
+		case code == 49:
+			style.Background = ""
+		case code >= 90 && code <= 97:
+			style.Foreground = "bright-" + ansiColors[code-90]
+		case code >= 100 && code <= 107:
+			style.Background = "bright-" + ansiColors[code-100]
+		case code == 38 || code == 48:
+			color, n := extendedColor(codes[i+1:])
+			i += n
+			if code == 38 {
+				style.Foreground = color
+			} else {
+				style.Background = color
+			}
+		}
+	}
+}
+
+// extendedColor gets the color of a 256-color (5;n) or true color (2;r;g;b) code,
+// and the number of parameters it takes.
+func extendedColor(params []int) (string, int) {
+	if len(params) >= 2 && params[0] == 5 {
+		n := params[1]
+		switch {
+		case n < 0:
+			return "", 2
+		case n < 8:
+			return ansiColors[n], 2
+		case n < 16:
+			return "bright-" + ansiColors[n-8], 2
+		case n < 232:
+			levels := []int{0, 95, 135, 175, 215, 255}
+			n -= 16
+			return fmt.Sprintf("#%02x%02x%02x", levels[n/36%6], levels[n/6%6], levels[n%6]), 2
+		case n < 256:
+			gray := 8 + (n-232)*10
+			return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray), 2
+		}
+		return "", 2
+	}
+	if len(params) >= 4 && params[0] == 2 {
+		return fmt.Sprintf("#%02x%02x%02x", params[1]&0xff, params[2]&0xff, params[3]&0xff), 4
+	}
+	return "", len(params)
+}
+
+// RenderHTML renders the styled lines of a log as HTML. Named colors are rendered as CSS classes
+// (e.g. "ansi-red" or "ansi-bg-bright-red") and RGB colors as inline styles.
+func RenderHTML(lines []LogRenderedLine) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("<pre class=\"logs\">")
+	for _, line := range lines {
+		for _, span := range line.Spans {
+			text := html.EscapeString(span.Text)
+			if span.LogStyle == (LogStyle{}) {
+				buf.WriteString(text)
+				continue
+			}
+			var classes, styles []string
+			if span.Bold {
+				classes = append(classes, "ansi-bold")
+			}
+			if span.Italic {
+				classes = append(classes, "ansi-italic")
+			}
+			if span.Underline {
+				classes = append(classes, "ansi-underline")
+			}
+			if strings.HasPrefix(span.Foreground, "#") {
+				styles = append(styles, "color:"+span.Foreground)
+			} else if span.Foreground != "" {
+				classes = append(classes, "ansi-"+span.Foreground)
+			}
+			if strings.HasPrefix(span.Background, "#") {
+				styles = append(styles, "background-color:"+span.Background)
+			} else if span.Background != "" {
+				classes = append(classes, "ansi-bg-"+span.Background)
+			}
+			buf.WriteString("<span")
+			if len(classes) > 0 {
+				fmt.Fprintf(&buf, " class=\"%s\"", strings.Join(classes, " "))
+			}
+			if len(styles) > 0 {
+				fmt.Fprintf(&buf, " style=\"%s\"", strings.Join(styles, ";"))
+			}
+			fmt.Fprintf(&buf, ">%s</span>", text)
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("</pre>")
+	return buf.Bytes()
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apis
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderANSI(t *testing.T) {
+	red := LogStyle{Foreground: "red"}
+	tests := []struct {
+		name string
+		data string
+		want []LogRenderedLine
+	}{
+		{"plain", "hello\nworld", []LogRenderedLine{
+			{Spans: []LogSpan{{Text: "hello"}}},
+			{Spans: []LogSpan{{Text: "world"}}},
+		}},
+		{"empty line", "a\n\nb\n", []LogRenderedLine{
+			{Spans: []LogSpan{{Text: "a"}}},
+			{Spans: []LogSpan{}},
+			{Spans: []LogSpan{{Text: "b"}}},
+		}},
+		{"colors", "\x1b[1;31mred\x1b[0m plain", []LogRenderedLine{
+			{Spans: []LogSpan{{LogStyle{Foreground: "red", Bold: true}, "red"}, {Text: " plain"}}},
+		}},
+		{"default sgr", "\x1b[31mred\x1b[mplain", []LogRenderedLine{
+			{Spans: []LogSpan{{red, "red"}, {Text: "plain"}}},
+		}},
+		{"bright colors", "\x1b[91;104mx", []LogRenderedLine{
+			{Spans: []LogSpan{{LogStyle{Foreground: "bright-red", Background: "bright-blue"}, "x"}}},
+		}},
+		{"256 colors", "\x1b[38;5;1ma\x1b[38;5;9mb\x1b[38;5;208mc\x1b[48;5;232md", []LogRenderedLine{
+			{Spans: []LogSpan{
+				{red, "a"},
+				{LogStyle{Foreground: "bright-red"}, "b"},
+				{LogStyle{Foreground: "#ff8700"}, "c"},
+				{LogStyle{Foreground: "#ff8700", Background: "#080808"}, "d"},
+			}},
+		}},
+		{"true color", "\x1b[38;2;255;0;128mx", []LogRenderedLine{
+			{Spans: []LogSpan{{LogStyle{Foreground: "#ff0080"}, "x"}}},
+		}},
+		{"invalid 256 colors", "\x1b[38;5;-1ma\x1b[38;5;256mb\x1b[38;5mc", []LogRenderedLine{
+			{Spans: []LogSpan{{Text: "abc"}}},
+		}},
+		{"carriage return", "10%\r50%\r100%\n", []LogRenderedLine{
+			{Spans: []LogSpan{{Text: "100%"}}},
+		}},
+		{"carriage return line feed", "a\r\nb", []LogRenderedLine{
+			{Spans: []LogSpan{{Text: "a"}}},
+			{Spans: []LogSpan{{Text: "b"}}},
+		}},
+		{"backspace", "ab\bc", []LogRenderedLine{
+			{Spans: []LogSpan{{Text: "ac"}}},
+		}},
+		{"erase line", "abc\x1b[2Kd", []LogRenderedLine{
+			{Spans: []LogSpan{{Text: "   d"}}},
+		}},
+		{"erase to end", "abcd\r\x1b[2C\x1b[K", []LogRenderedLine{
+			{Spans: []LogSpan{{Text: "ab"}}},
+		}},
+		{"erase to start", "abcd\x1b[2D\x1b[1K", []LogRenderedLine{
+			{Spans: []LogSpan{{Text: "  cd"}}},
+		}},
+		{"cursor column", "abcd\x1b[2GX", []LogRenderedLine{
+			{Spans: []LogSpan{{Text: "aXcd"}}},
+		}},
+		{"cursor forward", "a\x1b[3Cb", []LogRenderedLine{
+			{Spans: []LogSpan{{Text: "a   b"}}},
+		}},
+		{"operating system command", "\x1b]0;title\x07a\x1b]0;title\x1b\\b", []LogRenderedLine{
+			{Spans: []LogSpan{{Text: "ab"}}},
+		}},
+		{"unterminated escape", "a\x1b[31", []LogRenderedLine{
+			{Spans: []LogSpan{{Text: "a"}}},
+		}},
+		{"utf-8", "\x1b[31mñ\x1b[0m€", []LogRenderedLine{
+			{Spans: []LogSpan{{red, "ñ"}, {Text: "€"}}},
+		}},
+	}
+	for _, test := range tests {
+		if got := RenderANSI([]byte(test.data)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: RenderANSI(%q) = %v, want %v", test.name, test.data, got, test.want)
+		}
+	}
+}
+
+func TestRenderANSIMaxColumn(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want int
+	}{
+		{"column", "\x1b[999999999999G", logMaxColumn - 1},
+		{"forward", "\x1b[9223372036854775807C", logMaxColumn},
+		{"forward twice", "\x1b[1000C\x1b[1000C", logMaxColumn},
+		{"long text", strings.Repeat("x", 2*logMaxColumn) + "\x1b[1000C", 2 * logMaxColumn},
+	}
+	for _, test := range tests {
+		lines := RenderANSI([]byte(test.data + "y"))
+		if len(lines) != 1 || len(lines[0].Spans) == 0 {
+			t.Errorf("%s: RenderANSI = %v", test.name, lines)
+			continue
+		}
+		text := ""
+		for _, span := range lines[0].Spans {
+			text += span.Text
+		}
+		if len(text) != test.want+1 || !strings.HasSuffix(text, "y") {
+			t.Errorf("%s: RenderANSI line length = %d, want %d", test.name, len(text), test.want+1)
+		}
+	}
+}
@@ -15,30 +15,218 @@
 package apis
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"path"
+	"strconv"
+	"time"
+	"unicode/utf8"
 
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/gocilla/gocilla/managers/build"
+	"github.com/gocilla/gocilla/managers/github"
 	"github.com/gocilla/gocilla/managers/mongodb"
+	"github.com/gocilla/gocilla/managers/oauth2"
+	"github.com/gocilla/gocilla/managers/queue"
 	"github.com/gorilla/mux"
 )
 
+// ManualBuild type.
+// Request to build a pipeline for the head of a branch, or for a SHA.
+type ManualBuild struct {
+	Branch   string            `json:"branch"`
+	SHA      string            `json:"sha"`
+	Pipeline string            `json:"pipeline"`
+	EnvVars  map[string]string `json:"envVars"`
+}
+
+// LogMessage type.
+// Fragment of a build log sent as a server-sent event.
+type LogMessage struct {
+	Offset int64  `json:"offset"`
+	Text   string `json:"text"`
+}
+
+// LogLineRendered type.
+// Line of the log of a build with its text rendered as styled fragments.
+type LogLineRendered struct {
+	mongodb.LogLine
+	Spans []LogSpan `json:"spans"`
+}
+
 // BuildAPI type.
 // API to manage a build launched in the platform.
+// Manual builds and restarts are enqueued as the GitHub events.
 type BuildAPI struct {
-	Database *mongodb.Database
+	Database      *mongodb.Database
+	OAuth2Manager *oauth2.Manager
+	GitHubManager *github.Manager
+	BuildManager  *build.Manager
+	QueueManager  *queue.Manager
 }
 
 // NewBuildAPI is the constructor for BuildAPI type.
-func NewBuildAPI(database *mongodb.Database) *BuildAPI {
-	return &BuildAPI{database}
+func NewBuildAPI(database *mongodb.Database, oauth2Manager *oauth2.Manager, githubManager *github.Manager,
+	buildManager *build.Manager, queueManager *queue.Manager) *BuildAPI {
+	return &BuildAPI{database, oauth2Manager, githubManager, buildManager, queueManager}
+}
+
+// CreateBuild is an API resource to launch a build of a pipeline, as a "manual" event, for the head
+// of a branch or for a SHA (that must be in the branch, if any). The build is launched on behalf of
+// the session user, who must be able to push to the repository.
+func (buildAPI BuildAPI) CreateBuild(w http.ResponseWriter, r *http.Request) {
+	oauth2Client := buildAPI.OAuth2Manager.GetClient(r)
+	githubClient := buildAPI.GitHubManager.NewClient(oauth2Client)
+	vars := mux.Vars(r)
+	orgID := vars["orgId"]
+	repoID := vars["repoId"]
+
+	var manualBuild ManualBuild
+	if err := json.NewDecoder(r.Body).Decode(&manualBuild); err != nil {
+		log.Println(err)
+		w.WriteHeader(400)
+		w.Write([]byte("Error decoding JSON build"))
+		return
+	}
+	if manualBuild.Pipeline == "" || (manualBuild.Branch == "" && manualBuild.SHA == "") {
+		w.WriteHeader(400)
+		w.Write([]byte("Pipeline and branch or SHA are required"))
+		return
+	}
+	log.Printf("Launching manual build of pipeline '%s' for repository: %s/%s", manualBuild.Pipeline, orgID, repoID)
+
+	user, err := githubClient.GetUser()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("Error getting the user from github"))
+		return
+	}
+	repository, err := githubClient.GetPushRepository(orgID, repoID)
+	if err != nil {
+		writeRepositoryError(w, err)
+		return
+	}
+	sha := manualBuild.SHA
+	if sha != "" && manualBuild.Branch != "" {
+		// The variables restricted to the branch must not be set in the build of other commits
+		inBranch, err := githubClient.IsBranchCommit(orgID, repoID, manualBuild.Branch, sha)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			w.Write([]byte("Error checking the SHA in branch: " + manualBuild.Branch))
+			return
+		}
+		if !inBranch {
+			w.WriteHeader(400)
+			w.Write([]byte("SHA not in branch: " + manualBuild.Branch))
+			return
+		}
+	}
+	if sha == "" {
+		if sha, err = githubClient.GetBranchSHA(orgID, repoID, manualBuild.Branch); err != nil {
+			log.Println(err)
+			w.WriteHeader(404)
+			w.Write([]byte("Not found branch: " + manualBuild.Branch))
+			return
+		}
+	}
+
+	event := &github.Event{
+		Type:         github.EventTypeManual,
+		Branch:       manualBuild.Branch,
+		Organization: orgID,
+		Repository:   repoID,
+		SHA:          sha,
+		User:         *user.Login,
+		Pipeline:     manualBuild.Pipeline,
+		EnvVars:      manualBuild.EnvVars,
+	}
+	if repository.CloneURL != nil {
+		event.CloneURL = *repository.CloneURL
+	}
+	if repository.SSHURL != nil {
+		event.SSHURL = *repository.SSHURL
+	}
+	if err := buildAPI.BuildManager.ValidateManualEvent(githubClient, event); err != nil {
+		log.Println(err)
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := buildAPI.QueueManager.Enqueue(event); err != nil {
+		log.Println("Error enqueuing the build.", err)
+		w.WriteHeader(500)
+		w.Write([]byte("Error enqueuing the build"))
+		return
+	}
+	w.WriteHeader(202)
+}
+
+// RestartBuild is an API resource to build again the pipeline of a build, for the same SHA.
+// The build is identified either by its ID or by its number.
+// The build is launched on behalf of the session user, who must be able to push to the repository.
+func (buildAPI BuildAPI) RestartBuild(w http.ResponseWriter, r *http.Request) {
+	oauth2Client := buildAPI.OAuth2Manager.GetClient(r)
+	githubClient := buildAPI.GitHubManager.NewClient(oauth2Client)
+	vars := mux.Vars(r)
+	log.Printf("Restarting build: %s/%s/%s", vars["orgId"], vars["repoId"], vars["buildId"])
+
+	if _, err := githubClient.GetPushRepository(vars["orgId"], vars["repoId"]); err != nil {
+		writeRepositoryError(w, err)
+		return
+	}
+	storedBuild, err := buildAPI.Database.GetBuildByRef(vars["orgId"], vars["repoId"], vars["buildId"])
+	if err != nil {
+		log.Printf("Error getting build: %s. %s", vars["buildId"], err)
+		w.WriteHeader(404)
+		w.Write([]byte("Not found build: " + vars["buildId"]))
+		return
+	}
+	if storedBuild.SHA == "" || storedBuild.CloneURL == "" {
+		w.WriteHeader(409)
+		w.Write([]byte("Build without SHA or clone URL cannot be restarted: " + vars["buildId"]))
+		return
+	}
+	user, err := githubClient.GetUser()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("Error getting the user from github"))
+		return
+	}
+	if err := buildAPI.QueueManager.Enqueue(build.RestartEvent(&storedBuild, *user.Login)); err != nil {
+		log.Println("Error enqueuing the build.", err)
+		w.WriteHeader(500)
+		w.Write([]byte("Error enqueuing the build"))
+		return
+	}
+	w.WriteHeader(202)
 }
 
 // GetLog is an API resource to get the logs corresponding to a build.
+// The build is identified either by its ID or by its number.
+// The query parameter "format" selects the representation of the log:
+//   - raw (default): the log as written by the build.
+//   - html: the log rendered as HTML, with the ANSI colors converted and the carriage return updates collapsed.
+//   - json: the log rendered as a list of lines of styled fragments (see LogRenderedLine).
+//
+// With the query parameter "download", the raw log is downloaded as a gzip file.
 func (buildAPI BuildAPI) GetLog(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	buildLogFile := fmt.Sprintf("/%s/%s/%s", vars["orgId"], vars["repoId"], vars["buildId"])
+	storedBuild, err := buildAPI.Database.GetBuildByRef(vars["orgId"], vars["repoId"], vars["buildId"])
+	if err != nil {
+		log.Printf("Error getting build: %s. %s", vars["buildId"], err)
+		w.WriteHeader(404)
+		w.Write([]byte("Not found build: " + vars["buildId"]))
+		return
+	}
+	buildLogFile := storedBuild.LogFileName()
 	log.Printf("Getting log for build: %s", buildLogFile)
 
 	buildLog, err := buildAPI.Database.OpenFile(buildLogFile)
@@ -54,5 +242,303 @@ func (buildAPI BuildAPI) GetLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer buildLog.Close()
-	io.Copy(w, buildLog)
+
+	if r.URL.Query().Get("download") != "" {
+		fileName := fmt.Sprintf("%s-%s-%s.log.gz", storedBuild.Organization, storedBuild.Repository, vars["buildId"])
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
+		gzipWriter := gzip.NewWriter(w)
+		defer gzipWriter.Close()
+		io.Copy(gzipWriter, buildLog)
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "raw":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.Copy(w, buildLog)
+	case "html", "json":
+		data, err := ioutil.ReadAll(buildLog)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte("Error reading log: " + buildLogFile))
+			return
+		}
+		lines := RenderANSI(data)
+		if format == "html" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(RenderHTML(lines))
+			return
+		}
+		jsonLines, err := json.Marshal(lines)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte("Error marshalling the log"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonLines)
+	default:
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid format: " + format))
+	}
+}
+
+// GetLogLines is an API resource to get the lines of the log of a build, as JSON, segmented by task.
+// The lines are filtered with the query parameters:
+//   - task: lines of a task (e.g. "image", "clone" or a job name).
+//   - stream: lines of a stream ("stdout", "stderr" or "system").
+//   - from, to: range of line numbers (both included).
+//   - since: lines written after a time (RFC3339).
+//   - limit: maximum number of lines (mongodb.DefaultLogLinesLimit by default, and mongodb.MaxLogLinesLimit at most).
+//     The following lines are got with from set to the number of the last line plus one.
+//   - render: if set, every line includes its text rendered as styled fragments (see LogRenderedLine).
+func (buildAPI BuildAPI) GetLogLines(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	storedBuild, err := buildAPI.Database.GetBuildByRef(vars["orgId"], vars["repoId"], vars["buildId"])
+	if err != nil {
+		log.Printf("Error getting build: %s. %s", vars["buildId"], err)
+		w.WriteHeader(404)
+		w.Write([]byte("Not found build: " + vars["buildId"]))
+		return
+	}
+	params := r.URL.Query()
+	query := mongodb.LogLineQuery{
+		Task:   params.Get("task"),
+		Stream: params.Get("stream"),
+	}
+	for name, value := range map[string]*int{"from": &query.From, "to": &query.To, "limit": &query.Limit} {
+		if params.Get(name) == "" {
+			continue
+		}
+		if *value, err = strconv.Atoi(params.Get(name)); err != nil || *value < 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid " + name + ": " + params.Get(name)))
+			return
+		}
+	}
+	if since := params.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339Nano, since); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid since: " + since))
+			return
+		}
+	}
+	lines, err := buildAPI.Database.FindLogLines(storedBuild.ID, query)
+	if err != nil {
+		log.Printf("Error getting the log lines of build: %s. %s", vars["buildId"], err)
+		w.WriteHeader(500)
+		w.Write([]byte("Error getting the log lines of build: " + vars["buildId"]))
+		return
+	}
+	var result interface{} = lines
+	if params.Get("render") != "" {
+		renderedLines := make([]LogLineRendered, len(lines))
+		for i, line := range lines {
+			renderedLines[i].LogLine = line
+			renderedLines[i].Spans = []LogSpan{}
+			if rendered := RenderANSI([]byte(line.Text)); len(rendered) > 0 {
+				renderedLines[i].Spans = rendered[0].Spans
+			}
+		}
+		result = renderedLines
+	}
+	jsonLines, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("Error marshalling the log lines"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonLines)
+}
+
+// StreamLog is an API resource to stream the log of a build with server-sent events, until the build ends.
+// Every "log" event is a LogMessage, with the offset of the following message as event ID. The stream is
+// resumed from the offset in the query parameter "offset" or in the "Last-Event-ID" header.
+// The stream ends with an "end" event with the final status of the build.
+func (buildAPI BuildAPI) StreamLog(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		w.Write([]byte("Streaming not supported"))
+		return
+	}
+	storedBuild, err := buildAPI.Database.GetBuildByRef(vars["orgId"], vars["repoId"], vars["buildId"])
+	if err != nil {
+		log.Printf("Error getting build: %s. %s", vars["buildId"], err)
+		w.WriteHeader(404)
+		w.Write([]byte("Not found build: " + vars["buildId"]))
+		return
+	}
+	offsetParam := r.URL.Query().Get("offset")
+	if offsetParam == "" {
+		offsetParam = r.Header.Get("Last-Event-ID")
+	}
+	var offset int64
+	if offsetParam != "" {
+		if offset, err = strconv.ParseInt(offsetParam, 10, 64); err != nil || offset < 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid offset: " + offsetParam))
+			return
+		}
+	}
+	log.Printf("Streaming log for build: %s/%s/%s from offset %d", vars["orgId"], vars["repoId"], vars["buildId"], offset)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	// The characters split between two fragments are sent with the second one
+	var pending []byte
+	err = buildAPI.BuildManager.StreamLog(r.Context(), &storedBuild, offset, func(data []byte, offset int64) error {
+		if len(data) == 0 {
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			flusher.Flush()
+			return err
+		}
+		offset -= int64(len(pending))
+		data, pending = completeUTF8(append(pending, data...))
+		if len(data) == 0 {
+			return nil
+		}
+		message, err := json.Marshal(LogMessage{Offset: offset, Text: string(data)})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", offset+int64(len(data)), message)
+		flusher.Flush()
+		return err
+	})
+	if err != nil {
+		log.Printf("Streaming of log for build '%s' interrupted. %s", vars["buildId"], err)
+		return
+	}
+	if endedBuild, err := buildAPI.Database.GetBuild(storedBuild.Organization, storedBuild.Repository, storedBuild.ID); err == nil {
+		storedBuild = endedBuild
+	}
+	end, _ := json.Marshal(map[string]string{"status": storedBuild.Status})
+	fmt.Fprintf(w, "event: end\ndata: %s\n\n", end)
+	flusher.Flush()
+}
+
+// completeUTF8 splits the data after its last complete UTF-8 character.
+func completeUTF8(data []byte) (complete, rest []byte) {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return data[:i], data[i:]
+			}
+			break
+		}
+	}
+	return data, nil
+}
+
+// GetArtifacts is an API resource to list the artifacts stored by the jobs of a build.
+// The build is identified either by its ID or by its number.
+func (buildAPI BuildAPI) GetArtifacts(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	storedBuild, err := buildAPI.Database.GetBuildByRef(vars["orgId"], vars["repoId"], vars["buildId"])
+	if err != nil {
+		log.Printf("Error getting build: %s. %s", vars["buildId"], err)
+		w.WriteHeader(404)
+		w.Write([]byte("Not found build: " + vars["buildId"]))
+		return
+	}
+	artifacts, err := buildAPI.Database.FindArtifacts(storedBuild.ID)
+	if err != nil {
+		log.Printf("Error getting the artifacts of build: %s. %s", vars["buildId"], err)
+		w.WriteHeader(500)
+		w.Write([]byte("Error getting the artifacts of build: " + vars["buildId"]))
+		return
+	}
+	jsonArtifacts, err := json.Marshal(artifacts)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("Error marshalling the artifacts"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonArtifacts)
+}
+
+// DownloadArtifact is an API resource to download an artifact of a build as an attachment.
+func (buildAPI BuildAPI) DownloadArtifact(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	storedBuild, err := buildAPI.Database.GetBuildByRef(vars["orgId"], vars["repoId"], vars["buildId"])
+	if err != nil {
+		log.Printf("Error getting build: %s. %s", vars["buildId"], err)
+		w.WriteHeader(404)
+		w.Write([]byte("Not found build: " + vars["buildId"]))
+		return
+	}
+	if !bson.IsObjectIdHex(vars["artifactId"]) {
+		w.WriteHeader(404)
+		w.Write([]byte("Not found artifact: " + vars["artifactId"]))
+		return
+	}
+	artifact, file, err := buildAPI.Database.OpenArtifact(storedBuild.ID, bson.ObjectIdHex(vars["artifactId"]))
+	if err == mgo.ErrNotFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not found artifact: " + vars["artifactId"]))
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting artifact: %s. %s", vars["artifactId"], err)
+		w.WriteHeader(500)
+		w.Write([]byte("Error getting artifact: " + vars["artifactId"]))
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(artifact.Length, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(artifact.Path)))
+	io.Copy(w, file)
+}
+
+// CancelBuild is an API resource to cancel a running build.
+// The build is identified either by its ID or by its number.
+// The cancellation is asynchronous: the build ends with "cancelled" status once the container is killed.
+// The session user must be able to push to the repository.
+func (buildAPI BuildAPI) CancelBuild(w http.ResponseWriter, r *http.Request) {
+	oauth2Client := buildAPI.OAuth2Manager.GetClient(r)
+	githubClient := buildAPI.GitHubManager.NewClient(oauth2Client)
+	vars := mux.Vars(r)
+	log.Printf("Cancelling build: %s/%s/%s", vars["orgId"], vars["repoId"], vars["buildId"])
+
+	if _, err := githubClient.GetPushRepository(vars["orgId"], vars["repoId"]); err != nil {
+		writeRepositoryError(w, err)
+		return
+	}
+
+	err := buildAPI.BuildManager.Cancel(vars["orgId"], vars["repoId"], vars["buildId"])
+	if err == build.ErrBuildNotRunning {
+		w.WriteHeader(409)
+		w.Write([]byte("Build is not running: " + vars["buildId"]))
+		return
+	}
+	if err != nil {
+		log.Printf("Error cancelling build: %s. %s", vars["buildId"], err)
+		w.WriteHeader(500)
+		w.Write([]byte("Error cancelling build: " + vars["buildId"]))
+		return
+	}
+	w.WriteHeader(202)
+}
+
+// writeRepositoryError writes the response of an error getting the repository of a request
+// that requires push permission.
+func writeRepositoryError(w http.ResponseWriter, err error) {
+	if err == github.ErrNoPushPermission {
+		w.WriteHeader(403)
+		w.Write([]byte("Forbidden. The user cannot push to the repository"))
+		return
+	}
+	log.Println(err)
+	w.WriteHeader(404)
+	w.Write([]byte("Not found repository"))
 }
@@ -15,27 +15,56 @@
 package apis
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
 	"log"
 	"net/http"
 
-	"github.com/gocilla/gocilla/managers/build"
 	"github.com/gocilla/gocilla/managers/github"
+	"github.com/gocilla/gocilla/managers/mongodb"
+	"github.com/gocilla/gocilla/managers/queue"
 )
 
 // EventsAPI type.
 // API to receive GitHub events (e.g. a PullRequest or a Push).
 // Note that these events may launch a build if configured in gocilla.
+// Events must be signed with the secret of the repository hook.
+// The builds are not launched immediately but enqueued to be executed by the queue workers.
 type EventsAPI struct {
-	BuildManager *build.Manager
+	Database     *mongodb.Database
+	QueueManager *queue.Manager
 }
 
+// maxPayloadSize is the maximum size of an event payload (GitHub caps the payloads at 25 MB).
+const maxPayloadSize = 25 * 1024 * 1024
+
 // NewEventsAPI is the constructor for EventsAPI type.
-func NewEventsAPI(buildManager *build.Manager) *EventsAPI {
-	return &EventsAPI{buildManager}
+func NewEventsAPI(database *mongodb.Database, queueManager *queue.Manager) *EventsAPI {
+	return &EventsAPI{database, queueManager}
 }
 
 // LaunchBuild is the API resource that processes the GitHub event.
+// The payload is read up to maxPayloadSize, as it is not trusted until its signature is verified.
 func (eventsAPI EventsAPI) LaunchBuild(w http.ResponseWriter, r *http.Request) {
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadSize))
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		log.Println("Rejecting event with a payload too large.", err)
+		w.WriteHeader(413)
+		return
+	}
+	if err != nil {
+		log.Println("Error reading build payload.", err)
+		w.WriteHeader(500)
+		return
+	}
+	if !eventsAPI.verifySignature(r, payload) {
+		w.WriteHeader(401)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(payload))
+
 	event, err := github.ParseEvent(r)
 	if err != nil {
 		log.Println("Error decoding build payload.", err)
@@ -47,11 +76,30 @@ func (eventsAPI EventsAPI) LaunchBuild(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
 		return
 	}
-	go func() {
-		err := eventsAPI.BuildManager.Build(event)
-		if err != nil {
-			log.Println("Error in build", err)
-		}
-	}()
+	if err := eventsAPI.QueueManager.Enqueue(event); err != nil {
+		log.Println("Error enqueuing the build.", err)
+		w.WriteHeader(500)
+		return
+	}
 	w.WriteHeader(200)
 }
+
+// verifySignature checks that the event payload is signed with the secret of the hook
+// registered for the repository.
+func (eventsAPI EventsAPI) verifySignature(r *http.Request, payload []byte) bool {
+	organization, repository, err := github.GetEventRepository(payload)
+	if err != nil {
+		log.Println("Error decoding the repository of the event.", err)
+		return false
+	}
+	hook, err := eventsAPI.Database.GetHook(organization, repository)
+	if err != nil {
+		log.Printf("Rejecting event for '%s/%s' without hook. %s", organization, repository, err)
+		return false
+	}
+	if !github.ValidSignature(payload, r.Header.Get(github.SignatureHeader), hook.Secret) {
+		log.Printf("Rejecting event for '%s/%s' with invalid signature", organization, repository)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apis
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+// Queue type.
+type Queue struct {
+	Queued  int                `json:"queued"`
+	Running int                `json:"running"`
+	Jobs    []mongodb.QueueJob `json:"jobs"`
+}
+
+// QueueAPI type.
+// API to inspect the builds waiting in the queue or being executed by the workers.
+type QueueAPI struct {
+	Database *mongodb.Database
+}
+
+// NewQueueAPI is the constructor for QueueAPI.
+func NewQueueAPI(database *mongodb.Database) *QueueAPI {
+	return &QueueAPI{database}
+}
+
+// GetQueue is the API resource that returns the queue depth and its jobs.
+func (queueAPI QueueAPI) GetQueue(w http.ResponseWriter, r *http.Request) {
+	jobs, err := queueAPI.Database.FindQueueJobs()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		w.Write([]byte("Error getting the queue from database"))
+		return
+	}
+	queue := Queue{Jobs: jobs}
+	for _, job := range jobs {
+		if job.Status == "running" {
+			queue.Running++
+		} else {
+			queue.Queued++
+		}
+	}
+	jsonQueue, err := json.Marshal(queue)
+	if err != nil {
+		w.Write([]byte("Error marshalling the queue"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonQueue)
+}
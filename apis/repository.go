@@ -21,9 +21,11 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"github.com/gocilla/gocilla/managers/docker"
 	"github.com/gocilla/gocilla/managers/github"
 	"github.com/gocilla/gocilla/managers/mongodb"
 	"github.com/gocilla/gocilla/managers/oauth2"
+	"github.com/gocilla/gocilla/managers/secrets"
 )
 
 // Repository type.
@@ -38,17 +40,20 @@ type Repository struct {
 // RepositoryAPI type.
 // API to manage a repository (including the hooks to receive GitHub events).
 type RepositoryAPI struct {
-	Database      *mongodb.Database
-	OAuth2Manager *oauth2.Manager
-	GitHubManager *github.Manager
+	Database       *mongodb.Database
+	OAuth2Manager  *oauth2.Manager
+	GitHubManager  *github.Manager
+	SecretsManager *secrets.Manager
 }
 
 // NewRepositoryAPI is the constructor for RepositoryAPI.
-func NewRepositoryAPI(database *mongodb.Database, oauth2Manager *oauth2.Manager, githubManager *github.Manager) *RepositoryAPI {
-	return &RepositoryAPI{database, oauth2Manager, githubManager}
+func NewRepositoryAPI(database *mongodb.Database, oauth2Manager *oauth2.Manager, githubManager *github.Manager,
+	secretsManager *secrets.Manager) *RepositoryAPI {
+	return &RepositoryAPI{database, oauth2Manager, githubManager, secretsManager}
 }
 
 // GetRepository is the API resource that returns the settings of the repository.
+// The values of the secret variables are replaced by a placeholder.
 func (repositoryAPI RepositoryAPI) GetRepository(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orgID := vars["orgId"]
@@ -61,6 +66,7 @@ func (repositoryAPI RepositoryAPI) GetRepository(w http.ResponseWriter, r *http.
 		w.Write([]byte("Error getting repository from database"))
 		return
 	}
+	secrets.Hide(repository)
 
 	jsonRepository, err := json.Marshal(repository)
 	if err != nil {
@@ -71,6 +77,8 @@ func (repositoryAPI RepositoryAPI) GetRepository(w http.ResponseWriter, r *http.
 }
 
 // UpdateRepository is the API resource that updates the settings of the repository.
+// The values of the secret variables are encrypted. A secret variable with the placeholder as value keeps its stored value.
+// The docker access is only validated here; whether it is allowed is checked by every build.
 func (repositoryAPI RepositoryAPI) UpdateRepository(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orgID := vars["orgId"]
@@ -84,6 +92,28 @@ func (repositoryAPI RepositoryAPI) UpdateRepository(w http.ResponseWriter, r *ht
 		w.Write([]byte("Error decoding JSON repository"))
 		return
 	}
+	repository.OrgID = orgID
+	repository.RepoID = repoID
+	switch repository.Docker {
+	case docker.DockerAccessNone, docker.DockerAccessSocket, docker.DockerAccessDinD:
+	default:
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid docker access: " + repository.Docker))
+		return
+	}
+	current, err := repositoryAPI.Database.GetRepository(orgID, repoID)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		w.Write([]byte("Error getting repository from database"))
+		return
+	}
+	if err := repositoryAPI.SecretsManager.Seal(&repository, current); err != nil {
+		log.Println(err)
+		w.WriteHeader(400)
+		w.Write([]byte("Error storing the secret variables. " + err.Error()))
+		return
+	}
 	if err := repositoryAPI.Database.UpdateRepository(&repository); err != nil {
 		log.Println(err)
 		w.WriteHeader(500)
@@ -94,13 +124,21 @@ func (repositoryAPI RepositoryAPI) UpdateRepository(w http.ResponseWriter, r *ht
 }
 
 // GetBuilds is the API resource that returns the builds of the repository.
+// The builds of a commit are selected with the query parameter "sha" (that may be abbreviated).
 func (repositoryAPI RepositoryAPI) GetBuilds(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orgID := vars["orgId"]
 	repoID := vars["repoId"]
+	sha := r.URL.Query().Get("sha")
 	log.Printf("Getting builds for repository: %s/%s", orgID, repoID)
 
-	builds, err := repositoryAPI.Database.FindRepositoryBuilds(orgID, repoID)
+	var builds []mongodb.Build
+	var err error
+	if sha != "" {
+		builds, err = repositoryAPI.Database.FindRepositoryBuildsBySHA(orgID, repoID, sha)
+	} else {
+		builds, err = repositoryAPI.Database.FindRepositoryBuilds(orgID, repoID)
+	}
 	if err != nil {
 		log.Println(err)
 		w.Write([]byte("Error getting repository builds from database"))
@@ -124,11 +162,55 @@ func (repositoryAPI RepositoryAPI) CreateHook(w http.ResponseWriter, r *http.Req
 	orgID := vars["orgId"]
 	repoID := vars["repoId"]
 	log.Println("Creating hook for organization", orgID, "and repository", repoID)
-	hookID, err := githubClient.CreateHook(orgID, repoID)
+	secret, err := github.GenerateSecret()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		w.Write([]byte("Error generating the hook secret"))
+		return
+	}
+	hookID, err := githubClient.CreateHook(orgID, repoID, secret)
 	if err == nil {
 		accessToken := repositoryAPI.OAuth2Manager.GetSessionAccessToken(r)
-		repositoryAPI.Database.CreateHook(*hookID, orgID, repoID, accessToken)
+		repositoryAPI.Database.CreateHook(*hookID, orgID, repoID, accessToken, secret)
+	}
+}
+
+// RotateHookSecret is a resource API to replace the secret of the GitHub hook on a repository.
+// Hooks created without secret must be rotated, otherwise their events are rejected.
+func (repositoryAPI RepositoryAPI) RotateHookSecret(w http.ResponseWriter, r *http.Request) {
+	oauth2Client := repositoryAPI.OAuth2Manager.GetClient(r)
+	githubClient := repositoryAPI.GitHubManager.NewClient(oauth2Client)
+	vars := mux.Vars(r)
+	orgID := vars["orgId"]
+	repoID := vars["repoId"]
+	log.Println("Rotating hook secret for organization", orgID, "and repository", repoID)
+	hook, err := repositoryAPI.Database.GetHook(orgID, repoID)
+	if err != nil {
+		log.Printf("Error getting hook for organization '%s' and repository '%s'. %s", orgID, repoID, err)
+		w.WriteHeader(404)
+		w.Write([]byte("Not found hook"))
+		return
 	}
+	secret, err := github.GenerateSecret()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		w.Write([]byte("Error generating the hook secret"))
+		return
+	}
+	if err := githubClient.UpdateHookSecret(orgID, repoID, hook.ID, secret); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("Error updating the hook secret in GitHub"))
+		return
+	}
+	if err := repositoryAPI.Database.UpdateHookSecret(hook.ID, secret); err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		w.Write([]byte("Error updating the hook secret"))
+		return
+	}
+	w.WriteHeader(200)
 }
 
 // DeleteHook is a resource API to delete  a GitHub hook on a repository.
@@ -18,21 +18,29 @@ import (
 	"encoding/json"
 	"io/ioutil"
 
+	"github.com/gocilla/gocilla/managers/build"
 	"github.com/gocilla/gocilla/managers/docker"
 	"github.com/gocilla/gocilla/managers/github"
 	"github.com/gocilla/gocilla/managers/mongodb"
 	"github.com/gocilla/gocilla/managers/oauth2"
+	"github.com/gocilla/gocilla/managers/queue"
+	"github.com/gocilla/gocilla/managers/scheduler"
+	"github.com/gocilla/gocilla/managers/secrets"
 	"github.com/gocilla/gocilla/managers/session"
 )
 
 // Config type.
 type Config struct {
-	Port    uint16
-	OAuth2  *oauth2.Config
-	GitHub  *github.Config
-	Session *session.Config
-	Mongodb *mongodb.Config
-	Docker  *docker.ClusterConfig
+	Port      uint16
+	OAuth2    *oauth2.Config
+	GitHub    *github.Config
+	Session   *session.Config
+	Mongodb   *mongodb.Config
+	Docker    *docker.ClusterConfig
+	Build     *build.Config
+	Queue     *queue.Config
+	Scheduler *scheduler.Config
+	Secrets   *secrets.Config
 }
 
 // Decode the JSON configuration stored in a file path.
@@ -29,6 +29,9 @@ import (
 	"github.com/gocilla/gocilla/managers/github"
 	"github.com/gocilla/gocilla/managers/mongodb"
 	"github.com/gocilla/gocilla/managers/oauth2"
+	"github.com/gocilla/gocilla/managers/queue"
+	"github.com/gocilla/gocilla/managers/scheduler"
+	"github.com/gocilla/gocilla/managers/secrets"
 	"github.com/gocilla/gocilla/managers/session"
 	"github.com/gocilla/gocilla/middlewares"
 )
@@ -55,17 +58,31 @@ func main() {
 	oauth2Manager := oauth2.NewManager(config.OAuth2, sessionManager)
 	githubManager := github.NewManager(config.GitHub)
 	dockerManagers := docker.NewManagers(config.Docker)
-	buildManager := build.NewManager(database, oauth2Manager, githubManager, dockerManagers)
+	secretsManager, err := secrets.NewManager(config.Secrets, database)
+	if err != nil {
+		log.Printf("Configuration error: %s", err)
+		return
+	}
+	if err := secretsManager.Rotate(); err != nil {
+		log.Printf("Error rotating the key of the secrets. %s", err)
+	}
+	buildManager := build.NewManager(config.Build, database, oauth2Manager, githubManager, dockerManagers, secretsManager)
+	go buildManager.ExpireArtifacts()
+	queueManager := queue.NewManager(config.Queue, database, buildManager)
+	queueManager.Start()
+	schedulerManager := scheduler.NewManager(config.Scheduler, database, oauth2Manager, githubManager, buildManager, queueManager)
+	schedulerManager.Start()
 
 	// Middlewares
 	authenticate := middlewares.Authenticate(sessionManager)
 	logging := middlewares.LoggingHandler
 
 	// Apis
-	eventsAPI := apis.NewEventsAPI(buildManager)
+	eventsAPI := apis.NewEventsAPI(database, queueManager)
 	organizationsAPI := apis.NewOrganizationsAPI(database, oauth2Manager, githubManager)
-	repositoryAPI := apis.NewRepositoryAPI(database, oauth2Manager, githubManager)
-	buildAPI := apis.NewBuildAPI(database)
+	repositoryAPI := apis.NewRepositoryAPI(database, oauth2Manager, githubManager, secretsManager)
+	buildAPI := apis.NewBuildAPI(database, oauth2Manager, githubManager, buildManager, queueManager)
+	queueAPI := apis.NewQueueAPI(database)
 	triggersAPI := apis.NewTriggersAPI(database)
 	usersAPI := apis.NewUsersAPI(oauth2Manager, githubManager)
 
@@ -82,12 +99,29 @@ func main() {
 		logging(authenticate(repositoryAPI.UpdateRepository))).Methods("POST")
 	r.HandleFunc("/api/organizations/{orgId}/repositories/{repoId}/builds",
 		logging(authenticate(repositoryAPI.GetBuilds))).Methods("GET")
+	r.HandleFunc("/api/organizations/{orgId}/repositories/{repoId}/builds",
+		logging(authenticate(buildAPI.CreateBuild))).Methods("POST")
 	r.HandleFunc("/api/organizations/{orgId}/repositories/{repoId}/builds/{buildId}/logs",
 		logging(authenticate(buildAPI.GetLog))).Methods("GET")
+	r.HandleFunc("/api/organizations/{orgId}/repositories/{repoId}/builds/{buildId}/logs/stream",
+		logging(authenticate(buildAPI.StreamLog))).Methods("GET")
+	r.HandleFunc("/api/organizations/{orgId}/repositories/{repoId}/builds/{buildId}/logs/lines",
+		logging(authenticate(buildAPI.GetLogLines))).Methods("GET")
+	r.HandleFunc("/api/organizations/{orgId}/repositories/{repoId}/builds/{buildId}/artifacts",
+		logging(authenticate(buildAPI.GetArtifacts))).Methods("GET")
+	r.HandleFunc("/api/organizations/{orgId}/repositories/{repoId}/builds/{buildId}/artifacts/{artifactId}",
+		logging(authenticate(buildAPI.DownloadArtifact))).Methods("GET")
+	r.HandleFunc("/api/organizations/{orgId}/repositories/{repoId}/builds/{buildId}/cancel",
+		logging(authenticate(buildAPI.CancelBuild))).Methods("POST")
+	r.HandleFunc("/api/organizations/{orgId}/repositories/{repoId}/builds/{buildId}/restart",
+		logging(authenticate(buildAPI.RestartBuild))).Methods("POST")
 	r.HandleFunc("/api/organizations/{orgId}/repositories/{repoId}/hook",
 		logging(authenticate(repositoryAPI.CreateHook))).Methods("POST")
 	r.HandleFunc("/api/organizations/{orgId}/repositories/{repoId}/hook",
 		logging(authenticate(repositoryAPI.DeleteHook))).Methods("DELETE")
+	r.HandleFunc("/api/organizations/{orgId}/repositories/{repoId}/hook/secret",
+		logging(authenticate(repositoryAPI.RotateHookSecret))).Methods("POST")
+	r.HandleFunc("/api/queue", logging(authenticate(queueAPI.GetQueue))).Methods("GET")
 	r.HandleFunc("/api/profile", logging(authenticate(usersAPI.GetProfile))).Methods("GET")
 	r.HandleFunc("/api/triggers", logging(triggersAPI.GetTriggers)).Methods("GET")
 	r.HandleFunc("/api/triggers", logging(triggersAPI.CreateTrigger)).Methods("POST")
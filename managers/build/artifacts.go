@@ -0,0 +1,227 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocilla/gocilla/managers/docker"
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+// defaultArtifactsRetention is the time the artifacts are kept if the build spec does not set it.
+const defaultArtifactsRetention = 30 * 24 * time.Hour
+
+// artifactsExpiryInterval is the time between removals of the expired artifacts.
+const artifactsExpiryInterval = time.Hour
+
+// defaultArtifactsMaxFileSize is the default maximum size (in MB) of an artifact.
+const defaultArtifactsMaxFileSize = 100
+
+// defaultArtifactsMaxBuildSize is the default maximum size (in MB) of the artifacts of a build.
+const defaultArtifactsMaxBuildSize = 1024
+
+// ArtifactsConfig type.
+// Maximum sizes (in MB) of an artifact and of all the artifacts of a build (including its matrix combinations).
+// The larger artifacts are not stored, and no more artifacts are stored once a build reaches its maximum.
+type ArtifactsConfig struct {
+	MaxFileSize  int64 `json:"maxFileSize"`
+	MaxBuildSize int64 `json:"maxBuildSize"`
+}
+
+// errArtifactsLimit is returned when the artifacts of a build reach their maximum size.
+var errArtifactsLimit = errors.New("The artifacts of the build reached their maximum size")
+
+// artifactsLimit type.
+// Sizes (in bytes) of the artifacts of a build, shared by its jobs and matrix combinations.
+type artifactsLimit struct {
+	maxFileSize  int64
+	maxBuildSize int64
+	size         int64
+	mutex        sync.Mutex
+}
+
+// newArtifactsLimit is the constructor of artifactsLimit.
+func newArtifactsLimit(config *ArtifactsConfig) *artifactsLimit {
+	artifacts := &artifactsLimit{
+		maxFileSize:  defaultArtifactsMaxFileSize * 1024 * 1024,
+		maxBuildSize: defaultArtifactsMaxBuildSize * 1024 * 1024,
+	}
+	if config != nil && config.MaxFileSize > 0 {
+		artifacts.maxFileSize = config.MaxFileSize * 1024 * 1024
+	}
+	if config != nil && config.MaxBuildSize > 0 {
+		artifacts.maxBuildSize = config.MaxBuildSize * 1024 * 1024
+	}
+	return artifacts
+}
+
+// reserve adds the size of an artifact to the size of the artifacts of the build, if it is within the maximums.
+func (artifacts *artifactsLimit) reserve(size int64) error {
+	if size > artifacts.maxFileSize {
+		return fmt.Errorf("The artifact exceeds the maximum size (%d MB)", artifacts.maxFileSize/1024/1024)
+	}
+	artifacts.mutex.Lock()
+	defer artifacts.mutex.Unlock()
+	if artifacts.size+size > artifacts.maxBuildSize {
+		return errArtifactsLimit
+	}
+	artifacts.size += size
+	return nil
+}
+
+// CollectArtifacts stores the artifacts of a job, copied out of its container, in mongodb.
+// Every pattern is resolved by downloading (as a tar archive) the longest directory without wildcards
+// of the pattern, and storing its files matching the pattern. The errors are logged in the build log,
+// but they do not fail the job. The artifacts larger than the maximum size are skipped, and the collection
+// stops when the artifacts of the build reach their maximum size.
+func (containerBuildManager *ContainerManager) CollectArtifacts(containerManager *docker.ContainerManager, job string) {
+	patterns := containerBuildManager.buildSpec.Jobs[job].Artifacts
+	if len(patterns) == 0 {
+		return
+	}
+	buildRegister := containerBuildManager.buildRegister
+	retention := containerBuildManager.buildSpec.ArtifactsRetention
+	if retention <= 0 {
+		retention = defaultArtifactsRetention
+	}
+	expires := time.Now().Add(retention)
+
+	stored := make(map[string]bool)
+	for _, pattern := range patterns {
+		if err := validateArtifactPattern(pattern); err != nil {
+			buildRegister.logTask(job, fmt.Sprintf("Invalid artifacts pattern '%s'. %s\n", pattern, err))
+			continue
+		}
+		count := 0
+		err := containerBuildManager.downloadArtifacts(containerManager, artifactsBase(pattern), func(name string, size int64, r io.Reader) error {
+			if stored[name] || !matchArtifact(pattern, name) {
+				return nil
+			}
+			if err := containerBuildManager.artifacts.reserve(size); err == errArtifactsLimit {
+				return err
+			} else if err != nil {
+				buildRegister.logTask(job, fmt.Sprintf("Skipped the artifact '%s'. %s\n", name, err))
+				return nil
+			}
+			artifact := &mongodb.Artifact{
+				Build:   buildRegister.BuildWriter.Build.ID,
+				Job:     job,
+				Path:    name,
+				Expires: expires,
+			}
+			file, err := containerBuildManager.database.CreateArtifact(artifact)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(file, r); err != nil {
+				file.Close()
+				return err
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+			stored[name] = true
+			count++
+			return nil
+		})
+		if err == errArtifactsLimit {
+			buildRegister.logTask(job, fmt.Sprintf("Stored %d artifacts matching '%s'. %s (%d MB)\n",
+				count, pattern, err, containerBuildManager.artifacts.maxBuildSize/1024/1024))
+			return
+		}
+		if err != nil {
+			log.Printf("Error collecting the artifacts '%s' of job '%s'. %s", pattern, job, err)
+			buildRegister.logTask(job, fmt.Sprintf("Error collecting the artifacts '%s'. %s\n", pattern, err))
+			continue
+		}
+		buildRegister.logTask(job, fmt.Sprintf("Stored %d artifacts matching '%s'\n", count, pattern))
+	}
+}
+
+// downloadArtifacts downloads a path of the container, and calls store for every regular file with its path
+// relative to the working directory and its size.
+func (containerBuildManager *ContainerManager) downloadArtifacts(containerManager *docker.ContainerManager, base string,
+	store func(name string, size int64, r io.Reader) error) error {
+	// The entries of the archive are relative to the parent directory of the downloaded path
+	dir := path.Dir(base)
+	return containerBuildManager.copyArchive(containerManager, base, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			return nil
+		}
+		return store(path.Join(dir, header.Name), header.Size, r)
+	})
+}
+
+// validateArtifactPattern checks that a pattern of artifacts is a valid glob pattern relative to the working directory.
+func validateArtifactPattern(pattern string) error {
+	if strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("The pattern must be relative to the working directory")
+	}
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == ".." {
+			return fmt.Errorf("The pattern must be within the working directory")
+		}
+	}
+	return PatternsSpec{pattern}.Validate()
+}
+
+// artifactsBase gets the longest directory of a pattern without wildcards (or the pattern itself if it has
+// no wildcards at all).
+func artifactsBase(pattern string) string {
+	segments := strings.Split(path.Clean(pattern), "/")
+	for i, segment := range segments {
+		if strings.ContainsAny(segment, "*?") {
+			if i == 0 {
+				return "."
+			}
+			return strings.Join(segments[:i], "/")
+		}
+	}
+	return path.Clean(pattern)
+}
+
+// matchArtifact checks if the path of a file matches a pattern of artifacts, or if any of its directories does.
+func matchArtifact(pattern, name string) bool {
+	patterns := PatternsSpec{path.Clean(pattern)}
+	for name != "." && name != "/" {
+		if patterns.Match(name) {
+			return true
+		}
+		name = path.Dir(name)
+	}
+	return false
+}
+
+// ExpireArtifacts removes periodically the expired artifacts.
+func (buildManager *Manager) ExpireArtifacts() {
+	for {
+		removed, err := buildManager.Database.RemoveExpiredArtifacts(time.Now())
+		if err != nil {
+			log.Printf("Error removing the expired artifacts. %s", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d expired artifacts", removed)
+		}
+		time.Sleep(artifactsExpiryInterval)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import "testing"
+
+func TestArtifactsLimitReserve(t *testing.T) {
+	const mb = 1024 * 1024
+	artifacts := newArtifactsLimit(&ArtifactsConfig{MaxFileSize: 2, MaxBuildSize: 5})
+	tests := []struct {
+		size    int64
+		wantErr bool
+		want    int64
+	}{
+		{1 * mb, false, 1 * mb},
+		{3 * mb, true, 1 * mb},
+		{2 * mb, false, 3 * mb},
+		{2 * mb, false, 5 * mb},
+		{1, true, 5 * mb},
+		{0, false, 5 * mb},
+	}
+	for i, test := range tests {
+		err := artifacts.reserve(test.size)
+		if (err != nil) != test.wantErr || artifacts.size != test.want {
+			t.Errorf("%d: reserve(%d) = %v with size %d, want size %d", i, test.size, err, artifacts.size, test.want)
+		}
+	}
+	if err := artifacts.reserve(1); err != errArtifactsLimit {
+		t.Errorf("reserve beyond the build maximum = %v, want %v", err, errArtifactsLimit)
+	}
+}
+
+func TestNewArtifactsLimitDefaults(t *testing.T) {
+	artifacts := newArtifactsLimit(nil)
+	if artifacts.maxFileSize != defaultArtifactsMaxFileSize*1024*1024 || artifacts.maxBuildSize != defaultArtifactsMaxBuildSize*1024*1024 {
+		t.Errorf("newArtifactsLimit(nil) = %d, %d", artifacts.maxFileSize, artifacts.maxBuildSize)
+	}
+}
@@ -15,69 +15,71 @@
 package build
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 
+	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/yaml.v2"
 
 	"github.com/gocilla/gocilla/managers/docker"
 	"github.com/gocilla/gocilla/managers/github"
 	"github.com/gocilla/gocilla/managers/mongodb"
 	"github.com/gocilla/gocilla/managers/oauth2"
+	"github.com/gocilla/gocilla/managers/secrets"
 )
 
+// Config type.
+type Config struct {
+	Caches    *CacheConfig
+	Artifacts *ArtifactsConfig
+}
+
 // Manager type.
 // Manager to perform a build (after a trigger). It requires other managers:
 //   - GitHubManager to access to GitHub to download or clone the repository via API.
 //   - OAuth2Manager to help GitHubManager with OAuth2 access.
 //   - DockerManagers to launch a container to perform the build on a docker cluster.
+//   - SecretsManager to decrypt the secret variables of the repository settings.
+//
+// The logs of the builds running in this server instance are streamed through the LogBroker.
 type Manager struct {
+	Config         *Config
 	Database       *mongodb.Database
 	OAuth2Manager  *oauth2.Manager
 	GitHubManager  *github.Manager
 	DockerManagers docker.Managers
-}
-
-// Spec type.
-type Spec struct {
-	Docker    DockerSpec
-	Jobs      map[string]string
-	Pipelines []PipelineSpec
-	Triggers  []TriggerSpec
-}
-
-// DockerSpec type.
-type DockerSpec struct {
-	File       string
-	User       string
-	WorkingDir string `json:"workingDir" yaml:"workingDir"`
-}
-
-// PipelineSpec type.
-type PipelineSpec struct {
-	Name string
-	Jobs []string
-}
-
-// TriggerSpec type.
-type TriggerSpec struct {
-	Name     string
-	Event    string
-	Branch   string
-	Pipeline string
-	EnvVars  map[string]string `json:"envVars" yaml:"envVars"`
+	SecretsManager *secrets.Manager
+	LogBroker      *LogBroker
+	running        map[bson.ObjectId]*Register
+	mutex          sync.Mutex
 }
 
 // NewManager is the constructor of Manager.
-func NewManager(database *mongodb.Database, oauth2Manager *oauth2.Manager, githubManager *github.Manager, dockerManagers docker.Managers) *Manager {
-	return &Manager{database, oauth2Manager, githubManager, dockerManagers}
+func NewManager(config *Config, database *mongodb.Database, oauth2Manager *oauth2.Manager, githubManager *github.Manager, dockerManagers docker.Managers,
+	secretsManager *secrets.Manager) *Manager {
+	if config == nil {
+		config = &Config{}
+	}
+	return &Manager{
+		Config:         config,
+		Database:       database,
+		OAuth2Manager:  oauth2Manager,
+		GitHubManager:  githubManager,
+		DockerManagers: dockerManagers,
+		SecretsManager: secretsManager,
+		LogBroker:      NewLogBroker(),
+		running:        make(map[bson.ObjectId]*Register),
+	}
 }
 
 // Build the project.
 // It uses the GitHub event to know which repository and git SHA to be build.
-func (buildManager *Manager) Build(event *github.Event) error {
+// It is the body of the queue workers: the queue job is the one claimed by the worker.
+func (buildManager *Manager) Build(event *github.Event, queueJob *mongodb.QueueJob) error {
 	log.Printf("Starting build process for event: %+v", event)
 
 	hook, err := buildManager.Database.GetHook(event.Organization, event.Repository)
@@ -85,7 +87,19 @@ func (buildManager *Manager) Build(event *github.Event) error {
 		log.Printf("Error getting hook. %s", err)
 		return err
 	}
-	log.Printf("Using hook: %+v", hook)
+	log.Printf("Using hook %d of repository %s/%s", hook.ID, hook.Organization, hook.Repository)
+
+	if event.Pull != nil && event.Pull.Fork {
+		repository, err := buildManager.Database.GetRepository(event.Organization, event.Repository)
+		if err != nil {
+			log.Printf("Error getting the repository settings. %s", err)
+			return err
+		}
+		if !repository.BuildForks {
+			log.Printf("Pull request #%d from a fork not built for %s/%s", event.Pull.Number, event.Organization, event.Repository)
+			return nil
+		}
+	}
 
 	githubClient := buildManager.GitHubManager.NewClient(buildManager.OAuth2Manager.GetClientFromAccessToken(hook.AccessToken))
 	buildSpec, err := buildManager.GetSpec(githubClient, event)
@@ -94,26 +108,102 @@ func (buildManager *Manager) Build(event *github.Event) error {
 		return err
 	}
 
-	trigger := buildManager.GetTrigger(buildSpec, event)
-	if trigger == nil {
+	buildManager.CompleteCommit(githubClient, event)
+
+	triggers := buildManager.GetTriggers(buildSpec, event)
+	if len(triggers) == 0 && event.Type == github.EventTypeSchedule {
+		// The schedules are read from the default branch, but the build spec of the branch built may differ
+		trigger := &TriggerSpec{Name: event.Schedule, Event: github.EventTypeSchedule}
+		buildManager.Skip(githubClient, event, queueJob, trigger,
+			fmt.Sprintf("No scheduled trigger '%s' in the build spec of branch '%s'", event.Schedule, event.Branch))
+		return nil
+	}
+	if len(triggers) == 0 {
 		return fmt.Errorf("No trigger matching the event '%s' and branch '%s'", event.Type, event.Branch)
 	}
+	triggers = buildManager.FilterTriggers(githubClient, event, queueJob, triggers)
+	if len(triggers) == 0 {
+		log.Printf("All the triggers matching the event '%s' were skipped", event.Type)
+		return nil
+	}
+
+	// Restarted and manual builds may be for an older SHA, so they never supersede other builds
+	var supersedingTriggers []*TriggerSpec
+	for _, trigger := range triggers {
+		if trigger.CancelSuperseded && !event.Restart && event.Type != github.EventTypeManual {
+			supersedingTriggers = append(supersedingTriggers, trigger)
+		}
+	}
+	if len(supersedingTriggers) > 0 {
+		buildManager.Supersede(queueJob, supersedingTriggers)
+	}
+
+	// Every trigger launches its own build
+	errs := make([]error, len(triggers))
+	var wg sync.WaitGroup
+	for i, trigger := range triggers {
+		wg.Add(1)
+		go func(i int, trigger *TriggerSpec) {
+			defer wg.Done()
+			errs[i] = buildManager.BuildTrigger(githubClient, buildSpec, event, queueJob, trigger)
+		}(i, trigger)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// BuildTrigger builds the pipeline of a trigger matching the GitHub event.
+func (buildManager *Manager) BuildTrigger(githubClient *github.Client, buildSpec *Spec, event *github.Event,
+	queueJob *mongodb.QueueJob, trigger *TriggerSpec) error {
 	pipeline := buildManager.GetPipeline(buildSpec, trigger)
 	if pipeline == nil {
 		return fmt.Errorf("No pipeline matching the trigger pipeline: %s", trigger.Pipeline)
 	}
 	log.Printf("Pipeline to be executed: %s", trigger.Pipeline)
 
-	buildRegister, err := NewRegister(buildManager.Database, githubClient, event, trigger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	envVars, secretValues, err := buildManager.GetEnvVars(buildSpec, event, trigger)
+	if err != nil {
+		log.Println("Error getting the environment variables:", err)
+		return err
+	}
+	masker := NewMasker(secretValues)
+	buildRegister, err := NewRegister(ctx, buildManager.Database, buildManager.LogBroker, githubClient, queueJob, event, trigger, masker)
 	if err != nil {
 		log.Println("Error creating build register:", err)
 		return err
 	}
+	go buildManager.watchCancel(buildRegister)
+
+	var graph *JobGraph
+	if err = pipeline.Validate(buildSpec); err == nil && pipeline.IsGraph(buildSpec) {
+		graph, err = NewJobGraph(buildSpec, pipeline)
+	}
+	if err != nil {
+		buildRegister.End(err)
+		return err
+	}
+	if graph != nil {
+		buildRegister.BuildWriter.SetGraph(graph.Nodes())
+	}
 
-	dockerManager, dockerSHA, err := buildManager.PrepareDockerImage(githubClient, event, buildSpec, buildRegister)
+	dockerManager, dockerSHA, err := buildManager.PrepareDockerImage(buildRegister.Context, githubClient, event, buildSpec, buildRegister)
+	if err != nil {
+		err = fmt.Errorf("Error preparing the docker image. %s", err)
+		buildRegister.End(err)
+		return err
+	}
+	dockerAccess, err := buildManager.GetDockerAccess(dockerManager, event)
 	if err != nil {
-		return fmt.Errorf("Error preparing the docker image. %s", err)
+		buildRegister.End(err)
+		return err
 	}
 
 	containerManager := &ContainerManager{
@@ -121,12 +211,24 @@ func (buildManager *Manager) Build(event *github.Event) error {
 		dockerManager: dockerManager,
 		buildSpec:     buildSpec,
 		pipeline:      pipeline,
+		graph:         graph,
 		trigger:       trigger,
+		envVars:       envVars,
 		event:         event,
 		dockerSHA:     dockerSHA,
 		buildRegister: buildRegister,
+		cacheConfig:   buildManager.Config.Caches,
+		savedCaches:   &sync.Map{},
+		artifacts:     newArtifactsLimit(buildManager.Config.Artifacts),
+		dockerAccess:  dockerAccess,
+		limits:        dockerManager.Limits.GetLimits(buildSpec.Docker.Resources, buildSpec.Docker.Security),
+	}
+	if pipeline.Matrix != nil {
+		err = buildManager.ExecuteMatrix(containerManager)
+	} else {
+		err = containerManager.ExecutePipeline()
 	}
-	if err := containerManager.ExecutePipeline(); err != nil {
+	if err != nil {
 		return fmt.Errorf("Error executing the pipeline. %s", err)
 	}
 
@@ -145,14 +247,50 @@ func (buildManager *Manager) GetSpec(githubClient *github.Client, event *github.
 	return &buildSpec, err
 }
 
-// GetTrigger to get the trigger matching the GitHub event from the build spec.
-func (buildManager *Manager) GetTrigger(buildSpec *Spec, event *github.Event) *TriggerSpec {
-	for _, triggerSpec := range buildSpec.Triggers {
-		if triggerSpec.Event == event.Type && triggerSpec.Branch == event.Branch {
-			return &triggerSpec
+// CompleteCommit gets the metadata of the commit when it is not included in the payload of the event
+// (e.g. pull requests, tags, scheduled or manual builds).
+func (buildManager *Manager) CompleteCommit(githubClient *github.Client, event *github.Event) {
+	if event.Commit != nil && event.Commit.Message != "" {
+		return
+	}
+	commit, err := githubClient.GetCommit(event.Organization, event.Repository, event.CommitSHA())
+	if err != nil {
+		log.Printf("Error getting the commit '%s'. %s", event.CommitSHA(), err)
+		return
+	}
+	if event.Commit != nil {
+		commit.CompareURL = event.Commit.CompareURL
+	}
+	event.Commit = commit
+}
+
+// GetTriggers to get the triggers matching the GitHub event from the build spec.
+// Triggers with invalid patterns are ignored. If the event is restricted to a pipeline, only the triggers
+// of this pipeline are returned. Manual events have their own trigger.
+func (buildManager *Manager) GetTriggers(buildSpec *Spec, event *github.Event) []*TriggerSpec {
+	if event.Type == github.EventTypeManual {
+		return []*TriggerSpec{{
+			Name:     github.EventTypeManual,
+			Event:    github.EventTypeManual,
+			Pipeline: event.Pipeline,
+			EnvVars:  event.EnvVars,
+		}}
+	}
+	var triggers []*TriggerSpec
+	for i := range buildSpec.Triggers {
+		triggerSpec := &buildSpec.Triggers[i]
+		if err := triggerSpec.Validate(); err != nil {
+			log.Println(err)
+			continue
+		}
+		if event.Pipeline != "" && triggerSpec.Pipeline != event.Pipeline {
+			continue
+		}
+		if triggerSpec.Match(event) {
+			triggers = append(triggers, triggerSpec)
 		}
 	}
-	return nil
+	return triggers
 }
 
 // GetPipeline to get the pipeline to be executed according to the trigger that matches the GitHub event.
@@ -166,7 +304,7 @@ func (buildManager *Manager) GetPipeline(buildSpec *Spec, triggerSpec *TriggerSp
 }
 
 // PrepareDockerImage to set up the docker image.
-func (buildManager *Manager) PrepareDockerImage(githubClient *github.Client, event *github.Event, buildSpec *Spec, buildRegister *Register) (*docker.Manager, string, error) {
+func (buildManager *Manager) PrepareDockerImage(ctx context.Context, githubClient *github.Client, event *github.Event, buildSpec *Spec, buildRegister *Register) (*docker.Manager, string, error) {
 	dockerSHA, err := githubClient.GetFileSHA(event.Organization, event.Repository, buildSpec.Docker.File, event.SHA)
 	if err != nil {
 		return nil, dockerSHA, err
@@ -184,7 +322,9 @@ func (buildManager *Manager) PrepareDockerImage(githubClient *github.Client, eve
 
 		dockerfileDir := filepath.Dir(filepath.Join(dir, buildSpec.Docker.File))
 		log.Printf("Directory to build the docker image: %s", dockerfileDir)
-		err = dockerManager.BuildImage(event.Organization, event.Repository, dockerSHA, dockerfileDir, buildRegister.BuildLogWriter)
+		stdout, _ := buildRegister.TaskLogWriters("image", buildRegister.BuildLogWriter, buildRegister.BuildLogWriter)
+		err = dockerManager.BuildImage(ctx, event.Organization, event.Repository, dockerSHA, dockerfileDir, stdout)
+		stdout.Flush()
 		if err != nil {
 			log.Println("Error building docker image", err)
 			return nil, dockerSHA, err
@@ -195,3 +335,17 @@ func (buildManager *Manager) PrepareDockerImage(githubClient *github.Client, eve
 	}
 	return dockerManager, dockerSHA, nil
 }
+
+// GetDockerAccess gets the access of the build containers to a docker daemon chosen in the repository settings.
+// It returns an error if the access is not allowed by the configuration of the docker manager.
+func (buildManager *Manager) GetDockerAccess(dockerManager *docker.Manager, event *github.Event) (string, error) {
+	repository, err := buildManager.Database.GetRepository(event.Organization, event.Repository)
+	if err != nil {
+		return "", fmt.Errorf("Error getting the settings of repository '%s/%s'. %s", event.Organization, event.Repository, err)
+	}
+	fork := event.Pull != nil && event.Pull.Fork
+	if err := dockerManager.DockerAccess.Allow(repository.Docker, event.Organization, event.Repository, fork); err != nil {
+		return "", err
+	}
+	return repository.Docker, nil
+}
@@ -0,0 +1,457 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/mgo.v2"
+
+	"github.com/gocilla/gocilla/managers/docker"
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+// defaultCacheMaxRepositorySize is the default maximum size (in MB) of the caches of a repository.
+const defaultCacheMaxRepositorySize = 1024
+
+// defaultCacheMaxTotalSize is the default maximum size (in MB) of the caches of all the repositories.
+const defaultCacheMaxTotalSize = 10240
+
+// CacheConfig type.
+// Maximum sizes (in MB) of the caches of a repository and of all the repositories. When a cache is saved,
+// the least recently used caches are evicted to keep the caches within these sizes.
+type CacheConfig struct {
+	MaxRepositorySize int64 `json:"maxRepositorySize"`
+	MaxTotalSize      int64 `json:"maxTotalSize"`
+}
+
+// cacheKeyData type.
+// Data of the key templates of the caches.
+type cacheKeyData struct {
+	Branch   string
+	Event    string
+	Pipeline string
+	Matrix   map[string]string
+}
+
+// cacheKey evaluates the key template of a cache in a container. Besides the build data, the template
+// may use the function checksum to get a hash of the content of some files (e.g. {{checksum "Gopkg.lock"}}).
+func (containerBuildManager *ContainerManager) cacheKey(containerManager *docker.ContainerManager, cacheSpec *CacheSpec) (string, error) {
+	build := containerBuildManager.buildRegister.BuildWriter.Build
+	funcs := template.FuncMap{
+		"checksum": func(files ...string) (string, error) {
+			return containerBuildManager.checksum(containerManager, files)
+		},
+	}
+	keyTemplate, err := template.New("key").Funcs(funcs).Parse(cacheSpec.Key)
+	if err != nil {
+		return "", err
+	}
+	var key bytes.Buffer
+	data := cacheKeyData{Branch: build.Branch, Event: build.Event, Pipeline: build.Pipeline, Matrix: build.Matrix}
+	if err := keyTemplate.Execute(&key, data); err != nil {
+		return "", err
+	}
+	if key.Len() == 0 {
+		return "", fmt.Errorf("Empty cache key")
+	}
+	return key.String(), nil
+}
+
+// checksum gets a hash of the content of files of the container.
+func (containerBuildManager *ContainerManager) checksum(containerManager *docker.ContainerManager, files []string) (string, error) {
+	if len(files) == 0 {
+		return "", fmt.Errorf("No files to checksum")
+	}
+	var args []string
+	for _, file := range files {
+		args = append(args, "'"+strings.Replace(file, "'", `'\''`, -1)+"'")
+	}
+	var stdout, stderr bytes.Buffer
+	command := "sha256sum -- " + strings.Join(args, " ")
+	if err := containerManager.ExecContainer(containerBuildManager.ctx, command, &stdout, &stderr); err != nil {
+		return "", fmt.Errorf("Error computing the checksum of %s. %s %s", strings.Join(files, ", "), err, stderr.String())
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(stdout.Bytes())), nil
+}
+
+// RestoreCaches restores the caches of the build spec in a container, before executing its first job.
+// The cache is looked up for the branch of the build, and then for the default branch of the repository.
+// Only the entries of the cache within its paths are restored. The errors are logged in the build log,
+// but they do not fail the build.
+func (containerBuildManager *ContainerManager) RestoreCaches(containerManager *docker.ContainerManager) {
+	buildRegister := containerBuildManager.buildRegister
+	for i := range containerBuildManager.buildSpec.Caches {
+		cacheSpec := &containerBuildManager.buildSpec.Caches[i]
+		key, err := containerBuildManager.cacheKey(containerManager, cacheSpec)
+		if err != nil {
+			buildRegister.logTask("cache", fmt.Sprintf("Error evaluating the cache key '%s'. %s\n", cacheSpec.Key, err))
+			continue
+		}
+		cache, err := containerBuildManager.findCache(key)
+		if err != nil {
+			buildRegister.logTask("cache", fmt.Sprintf("Error finding the cache '%s'. %s\n", key, err))
+			continue
+		}
+		if cache == nil {
+			buildRegister.logTask("cache", fmt.Sprintf("No cache found for key '%s'\n", key))
+			continue
+		}
+		file, err := containerBuildManager.database.OpenCache(cache.ID)
+		if err != nil {
+			buildRegister.logTask("cache", fmt.Sprintf("Error opening the cache '%s'. %s\n", key, err))
+			continue
+		}
+		skipped, err := containerBuildManager.restoreCache(containerManager, cacheSpec, file)
+		file.Close()
+		if err != nil {
+			buildRegister.logTask("cache", fmt.Sprintf("Error restoring the cache '%s'. %s\n", key, err))
+			continue
+		}
+		if skipped > 0 {
+			buildRegister.logTask("cache", fmt.Sprintf("Skipped %d entries of cache '%s' outside its paths\n", skipped, key))
+		}
+		scope := "branch '" + cache.Branch + "'"
+		if cache.Pull > 0 {
+			scope = fmt.Sprintf("pull request #%d", cache.Pull)
+		}
+		buildRegister.logTask("cache", fmt.Sprintf("Restored cache '%s' of %s (%d bytes)\n", key, scope, cache.Length))
+	}
+}
+
+// restoreCache uploads a gzipped tarball of a cache to the root directory of a container, skipping the entries
+// outside the paths of the cache (see cacheEntryAllowed). It returns the number of skipped entries.
+func (containerBuildManager *ContainerManager) restoreCache(containerManager *docker.ContainerManager, cacheSpec *CacheSpec, r io.Reader) (int, error) {
+	roots, err := containerBuildManager.cachePaths(containerManager, cacheSpec)
+	if err != nil {
+		return 0, err
+	}
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	pr, pw := io.Pipe()
+	skipped := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tarReader := tar.NewReader(gzipReader)
+		tarWriter := tar.NewWriter(pw)
+		symlinks := make(map[string]bool)
+		var err error
+		for {
+			var header *tar.Header
+			if header, err = tarReader.Next(); err != nil {
+				break
+			}
+			if !cacheEntryAllowed(header, roots, symlinks) {
+				skipped++
+				continue
+			}
+			if err = tarWriter.WriteHeader(header); err != nil {
+				break
+			}
+			if _, err = io.Copy(tarWriter, tarReader); err != nil {
+				break
+			}
+		}
+		if err == io.EOF {
+			err = tarWriter.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	err = containerManager.UploadArchive(containerBuildManager.ctx, "/", pr)
+	pr.CloseWithError(err)
+	<-done
+	return skipped, err
+}
+
+// cachePaths gets the absolute paths of a cache in a container.
+func (containerBuildManager *ContainerManager) cachePaths(containerManager *docker.ContainerManager, cacheSpec *CacheSpec) ([]string, error) {
+	workingDir, err := containerManager.WorkingDir()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, cachePath := range cacheSpec.Paths {
+		if !path.IsAbs(cachePath) {
+			cachePath = path.Join(workingDir, cachePath)
+		}
+		paths = append(paths, path.Clean(cachePath))
+	}
+	return paths, nil
+}
+
+// cacheEntryAllowed checks if an entry of a cache tarball is restored: it must be a directory, a regular
+// file or a link within the paths of the cache (roots), not below a symbolic link of the tarball, and the
+// links must point within the paths too. The name of the entry is normalized, and the symbolic links
+// are registered in symlinks.
+func cacheEntryAllowed(header *tar.Header, roots []string, symlinks map[string]bool) bool {
+	name := path.Join("/", header.Name)
+	if !withinPaths(name, roots) {
+		return false
+	}
+	for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+		if symlinks[dir] {
+			return false
+		}
+	}
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeDir:
+	case tar.TypeLink:
+		linkname := path.Join("/", header.Linkname)
+		if !withinPaths(linkname, roots) {
+			return false
+		}
+		header.Linkname = linkname[1:]
+	case tar.TypeSymlink:
+		target := header.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(name), target)
+		}
+		if !withinPaths(path.Clean(target), roots) {
+			return false
+		}
+		symlinks[name] = true
+	default:
+		return false
+	}
+	header.Name = name[1:]
+	if header.Typeflag == tar.TypeDir {
+		header.Name += "/"
+	}
+	return true
+}
+
+// withinPaths checks if an absolute path is any of the paths, or is included in any of them.
+func withinPaths(name string, paths []string) bool {
+	for _, root := range paths {
+		if name == root || root == "/" || strings.HasPrefix(name, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// findCache finds a cache for the pull request of the build (if any), for the branch of the build,
+// or for the default branch of the repository. It returns nil if not found.
+func (containerBuildManager *ContainerManager) findCache(key string) (*mongodb.CacheFile, error) {
+	build := containerBuildManager.buildRegister.BuildWriter.Build
+	if build.PullNumber > 0 {
+		cache, err := containerBuildManager.database.FindCache(build.Organization, build.Repository, build.Branch, build.PullNumber, key)
+		if err != mgo.ErrNotFound {
+			return cache, err
+		}
+	}
+	branches := []string{build.Branch}
+	if githubClient := containerBuildManager.buildRegister.GithubClient; githubClient != nil {
+		repository, err := githubClient.GetRepository(build.Organization, build.Repository)
+		if err != nil {
+			log.Printf("Error getting the default branch of repository '%s/%s'. %s", build.Organization, build.Repository, err)
+		} else if repository.DefaultBranch != nil && *repository.DefaultBranch != build.Branch {
+			branches = append(branches, *repository.DefaultBranch)
+		}
+	}
+	for _, branch := range branches {
+		cache, err := containerBuildManager.database.FindCache(build.Organization, build.Repository, branch, 0, key)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		return cache, err
+	}
+	return nil, nil
+}
+
+// SaveCaches saves the caches of the build spec from a container, after the pipeline is successful.
+// Every cache is saved once per build (and matrix build), as a gzipped tarball of its paths that replaces
+// the previous cache of the branch (or of the pull request) with the same key. Then the least recently used
+// caches are evicted. The caches of the pull requests from forks are not saved, as they could be restored
+// in other builds of the pull request.
+func (containerBuildManager *ContainerManager) SaveCaches(containerManager *docker.ContainerManager) {
+	buildRegister := containerBuildManager.buildRegister
+	build := buildRegister.BuildWriter.Build
+	if build.PullFork {
+		if len(containerBuildManager.buildSpec.Caches) > 0 {
+			buildRegister.logTask("cache", "The caches of pull requests from forks are not saved\n")
+		}
+		return
+	}
+	for i := range containerBuildManager.buildSpec.Caches {
+		cacheSpec := &containerBuildManager.buildSpec.Caches[i]
+		key, err := containerBuildManager.cacheKey(containerManager, cacheSpec)
+		if err != nil {
+			buildRegister.logTask("cache", fmt.Sprintf("Error evaluating the cache key '%s'. %s\n", cacheSpec.Key, err))
+			continue
+		}
+		if _, saved := containerBuildManager.savedCaches.LoadOrStore(key, true); saved {
+			continue
+		}
+		previous, err := containerBuildManager.database.FindCache(build.Organization, build.Repository, build.Branch, build.PullNumber, key)
+		if err != nil && err != mgo.ErrNotFound {
+			buildRegister.logTask("cache", fmt.Sprintf("Error finding the cache '%s'. %s\n", key, err))
+			continue
+		}
+		size, err := containerBuildManager.saveCache(containerManager, cacheSpec, key)
+		if err != nil {
+			buildRegister.logTask("cache", fmt.Sprintf("Error saving the cache '%s'. %s\n", key, err))
+			continue
+		}
+		if previous != nil {
+			containerBuildManager.database.RemoveCache(previous.ID)
+		}
+		buildRegister.logTask("cache", fmt.Sprintf("Saved cache '%s' (%d bytes)\n", key, size))
+	}
+	if len(containerBuildManager.buildSpec.Caches) > 0 {
+		containerBuildManager.evictCaches(build.Organization, build.Repository)
+	}
+}
+
+// saveCache stores the paths of a cache as a gzipped tarball, with the entries named by their absolute path
+// (without the leading slash) so that the tarball is restored in the root directory. It returns the stored size.
+func (containerBuildManager *ContainerManager) saveCache(containerManager *docker.ContainerManager, cacheSpec *CacheSpec, key string) (int64, error) {
+	cachePaths, err := containerBuildManager.cachePaths(containerManager, cacheSpec)
+	if err != nil {
+		return 0, err
+	}
+	build := containerBuildManager.buildRegister.BuildWriter.Build
+	file, err := containerBuildManager.database.CreateCache(&mongodb.Cache{
+		Organization: build.Organization,
+		Repository:   build.Repository,
+		Branch:       build.Branch,
+		Pull:         build.PullNumber,
+		Key:          key,
+		LastUsed:     time.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, cachePath := range cachePaths {
+		dir := path.Dir(cachePath)
+		err = containerBuildManager.copyArchive(containerManager, cachePath, func(header *tar.Header, r io.Reader) error {
+			header.Name = strings.TrimPrefix(path.Join(dir, header.Name), "/")
+			if header.Typeflag == tar.TypeDir {
+				header.Name += "/"
+			}
+			if header.Typeflag == tar.TypeLink {
+				header.Linkname = strings.TrimPrefix(path.Join(dir, header.Linkname), "/")
+			}
+			if err := tarWriter.WriteHeader(header); err != nil {
+				return err
+			}
+			_, err := io.Copy(tarWriter, r)
+			return err
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tarWriter.Close()
+	}
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	if err != nil {
+		file.Abort()
+		file.Close()
+		return 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+	return file.Size(), nil
+}
+
+// copyArchive downloads a path of the container as a tar archive, and calls copy for every entry.
+func (containerBuildManager *ContainerManager) copyArchive(containerManager *docker.ContainerManager, containerPath string,
+	copy func(header *tar.Header, r io.Reader) error) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := containerManager.DownloadPath(containerBuildManager.ctx, containerPath, pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	tarReader := tar.NewReader(pr)
+	var err error
+	for {
+		var header *tar.Header
+		header, err = tarReader.Next()
+		if err != nil {
+			break
+		}
+		if err = copy(header, tarReader); err != nil {
+			break
+		}
+	}
+	pr.CloseWithError(err)
+	if downloadErr := <-done; downloadErr != nil {
+		return downloadErr
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// evictCaches removes the least recently used caches of a repository, and then of all the repositories,
+// until their sizes are within the configured maximums.
+func (containerBuildManager *ContainerManager) evictCaches(organization, repository string) {
+	config := containerBuildManager.cacheConfig
+	maxRepositorySize, maxTotalSize := int64(defaultCacheMaxRepositorySize), int64(defaultCacheMaxTotalSize)
+	if config != nil && config.MaxRepositorySize > 0 {
+		maxRepositorySize = config.MaxRepositorySize
+	}
+	if config != nil && config.MaxTotalSize > 0 {
+		maxTotalSize = config.MaxTotalSize
+	}
+	for _, scope := range []struct {
+		organization, repository string
+		maxSize                  int64
+	}{{organization, repository, maxRepositorySize}, {"", "", maxTotalSize}} {
+		caches, err := containerBuildManager.database.FindCaches(scope.organization, scope.repository)
+		if err != nil {
+			log.Printf("Error finding the caches to evict. %s", err)
+			return
+		}
+		var size int64
+		for _, cache := range caches {
+			size += cache.Length
+		}
+		for _, cache := range caches {
+			if size <= scope.maxSize*1024*1024 {
+				break
+			}
+			if err := containerBuildManager.database.RemoveCache(cache.ID); err != nil {
+				log.Printf("Error evicting the cache '%s'. %s", cache.Key, err)
+				continue
+			}
+			log.Printf("Evicted cache '%s' of %s/%s (%s)", cache.Key, cache.Organization, cache.Repository, cache.Branch)
+			size -= cache.Length
+		}
+	}
+}
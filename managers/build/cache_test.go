@@ -0,0 +1,64 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+func TestCacheEntryAllowed(t *testing.T) {
+	roots := []string{"/go/src/app/vendor", "/root/.npm"}
+	tests := []struct {
+		name     string
+		header   tar.Header
+		want     bool
+		wantName string
+	}{
+		{"directory", tar.Header{Name: "go/src/app/vendor/", Typeflag: tar.TypeDir}, true, "go/src/app/vendor/"},
+		{"file", tar.Header{Name: "go/src/app/vendor/a/b.go", Typeflag: tar.TypeReg}, true, "go/src/app/vendor/a/b.go"},
+		{"absolute name", tar.Header{Name: "/root/.npm/x", Typeflag: tar.TypeReg}, true, "root/.npm/x"},
+		{"outside", tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg}, false, ""},
+		{"sibling prefix", tar.Header{Name: "go/src/app/vendored/x", Typeflag: tar.TypeReg}, false, ""},
+		{"parent", tar.Header{Name: "go/src/app/vendor/../../../../etc/passwd", Typeflag: tar.TypeReg}, false, ""},
+		{"working directory", tar.Header{Name: "go/src/app/main.go", Typeflag: tar.TypeReg}, false, ""},
+		{"device", tar.Header{Name: "root/.npm/dev", Typeflag: tar.TypeChar}, false, ""},
+		{"relative symlink", tar.Header{Name: "root/.npm/l", Linkname: "x/y", Typeflag: tar.TypeSymlink}, true, "root/.npm/l"},
+		{"symlink outside", tar.Header{Name: "root/.npm/etc", Linkname: "/etc", Typeflag: tar.TypeSymlink}, false, ""},
+		{"relative symlink outside", tar.Header{Name: "root/.npm/up", Linkname: "../../etc", Typeflag: tar.TypeSymlink}, false, ""},
+		{"hard link", tar.Header{Name: "root/.npm/h", Linkname: "root/.npm/x", Typeflag: tar.TypeLink}, true, "root/.npm/h"},
+		{"hard link outside", tar.Header{Name: "root/.npm/h", Linkname: "etc/shadow", Typeflag: tar.TypeLink}, false, ""},
+	}
+	for _, test := range tests {
+		header := test.header
+		got := cacheEntryAllowed(&header, roots, map[string]bool{})
+		if got != test.want || got && header.Name != test.wantName {
+			t.Errorf("%s: cacheEntryAllowed(%q) = %v (%q), want %v (%q)", test.name, test.header.Name, got, header.Name, test.want, test.wantName)
+		}
+	}
+}
+
+func TestCacheEntryAllowedBelowSymlink(t *testing.T) {
+	roots := []string{"/root/.npm"}
+	symlinks := map[string]bool{}
+	link := &tar.Header{Name: "root/.npm/link", Linkname: "sub", Typeflag: tar.TypeSymlink}
+	if !cacheEntryAllowed(link, roots, symlinks) {
+		t.Fatalf("cacheEntryAllowed(%q) = false", link.Name)
+	}
+	below := &tar.Header{Name: "root/.npm/link/file", Typeflag: tar.TypeReg}
+	if cacheEntryAllowed(below, roots, symlinks) {
+		t.Errorf("cacheEntryAllowed(%q) below a symlink = true", below.Name)
+	}
+}
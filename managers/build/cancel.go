@@ -0,0 +1,166 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+// cancelPollInterval is the period to check in mongodb if the cancellation of a running build was requested.
+const cancelPollInterval = 3 * time.Second
+
+// ErrBuildNotRunning is returned when cancelling a build that is not running.
+var ErrBuildNotRunning = errors.New("Build is not running")
+
+// Cancel a running build.
+// The cancellation is requested in mongodb so that the server instance running the build, that may be
+// a different one, cancels the build context. If the build runs in this instance, it is cancelled immediately.
+// The build is identified either by its ID or by its number.
+func (buildManager *Manager) Cancel(organization, repository, buildRef string) error {
+	build, err := buildManager.Database.GetBuildByRef(organization, repository, buildRef)
+	if err == mgo.ErrNotFound {
+		return ErrBuildNotRunning
+	}
+	if err != nil {
+		return err
+	}
+	return buildManager.cancelBuild(organization, repository, build.ID, "cancelled")
+}
+
+// Supersede cancels the builds of the same branch (or pull request) that were queued before the
+// queue job and for a different SHA. Queued builds are removed from the queue and running builds
+// of the trigger pipelines are cancelled. Both are registered with "superseded" status (a build for every trigger pipeline
+// in case of queued builds).
+func (buildManager *Manager) Supersede(queueJob *mongodb.QueueJob, triggers []*TriggerSpec) {
+	jobs, err := buildManager.Database.SupersedeQueueJobs(queueJob)
+	if err != nil {
+		log.Printf("Error removing the superseded jobs from the queue. %s", err)
+	}
+	now := time.Now()
+	for _, job := range jobs {
+		log.Printf("Queue job '%s' for SHA '%s' superseded by '%s'", job.ID.Hex(), job.SHA, queueJob.SHA)
+		for _, trigger := range triggers {
+			build := &mongodb.Build{
+				QueueJob:     job.ID,
+				Organization: job.Organization,
+				Repository:   job.Repository,
+				Event:        job.Event,
+				Branch:       job.Branch,
+				SHA:          job.SHA,
+				PullNumber:   job.PullNumber,
+				Pipeline:     trigger.Pipeline,
+				Status:       "superseded",
+				Error:        fmt.Sprintf("Build superseded by %s", queueJob.SHA),
+				Start:        &now,
+				End:          &now,
+				Tasks:        []*mongodb.BuildTask{},
+			}
+			if err := buildManager.Database.CreateBuild(build); err != nil {
+				log.Printf("Error registering superseded build. %s", err)
+			}
+		}
+	}
+
+	pipelines := make([]string, len(triggers))
+	for i, trigger := range triggers {
+		pipelines[i] = trigger.Pipeline
+	}
+	builds, err := buildManager.Database.FindSupersededBuilds(queueJob.Organization, queueJob.Repository,
+		queueJob.Event, queueJob.Branch, queueJob.PullNumber, queueJob.SHA, queueJob.ID, pipelines)
+	if err != nil {
+		log.Printf("Error finding the superseded builds. %s", err)
+	}
+	for _, build := range builds {
+		log.Printf("Build '%s' for SHA '%s' superseded by '%s'", build.ID.Hex(), build.SHA, queueJob.SHA)
+		err := buildManager.cancelBuild(build.Organization, build.Repository, build.ID, "superseded")
+		if err != nil && err != ErrBuildNotRunning {
+			log.Printf("Error cancelling superseded build '%s'. %s", build.ID.Hex(), err)
+		}
+	}
+}
+
+// cancelBuild requests the cancellation of a running build with a cancellation status.
+func (buildManager *Manager) cancelBuild(organization, repository string, id bson.ObjectId, status string) error {
+	err := buildManager.Database.RequestBuildCancel(organization, repository, id, status)
+	if err == mgo.ErrNotFound {
+		return ErrBuildNotRunning
+	}
+	if err != nil {
+		return err
+	}
+	buildManager.mutex.Lock()
+	register, ok := buildManager.running[id]
+	buildManager.mutex.Unlock()
+	if ok {
+		log.Printf("Cancelling build '%s' with status '%s'", id.Hex(), status)
+		register.Cancel(status)
+	}
+	return nil
+}
+
+// CancelQueueJob cancels the builds of a queue job running in this server instance (e.g. when the worker
+// lost the lease of the job).
+func (buildManager *Manager) CancelQueueJob(queueJob bson.ObjectId, status string) {
+	buildManager.mutex.Lock()
+	defer buildManager.mutex.Unlock()
+	for id, register := range buildManager.running {
+		if register.BuildWriter.Build.QueueJob == queueJob {
+			log.Printf("Cancelling build '%s' with status '%s'", id.Hex(), status)
+			register.Cancel(status)
+		}
+	}
+}
+
+// watchCancel cancels the build when its cancellation is requested in mongodb.
+// It returns when the build context is done.
+func (buildManager *Manager) watchCancel(register *Register) {
+	id := register.BuildWriter.Build.ID
+	buildManager.mutex.Lock()
+	buildManager.running[id] = register
+	buildManager.mutex.Unlock()
+	defer func() {
+		buildManager.mutex.Lock()
+		delete(buildManager.running, id)
+		buildManager.mutex.Unlock()
+	}()
+
+	ticker := time.NewTicker(cancelPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-register.Context.Done():
+			return
+		case <-ticker.C:
+			status, err := buildManager.Database.GetBuildCancelStatus(id)
+			if err != nil {
+				log.Printf("Error checking the cancellation of build '%s'. %s", id.Hex(), err)
+				continue
+			}
+			if status != "" {
+				log.Printf("Cancelling build '%s' with status '%s' as requested", id.Hex(), status)
+				register.Cancel(status)
+				return
+			}
+		}
+	}
+}
@@ -15,8 +15,12 @@
 package build
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/gocilla/gocilla/managers/docker"
 	"github.com/gocilla/gocilla/managers/github"
@@ -25,49 +29,135 @@ import (
 
 // ContainerManager type.
 // Manager to execute a pipeline in a docker container.
+// The context of the pipeline is derived from the build context with the pipeline timeout.
+// If the pipeline is executed as a dependency graph, every job is executed in its own container.
+// The environment variables of the containers are the build ones (see GetEnvVars), merged with the matrix variables of a matrix build.
+// The caches saved by the build are registered in savedCaches, shared by the combinations of a matrix build.
+// If the build has services, the containers are connected to the network of the services.
+// The dockerAccess of the repository (see GetDockerAccess) sets how the containers access a docker daemon,
+// and the limits are the resources and security options of every container (see docker.LimitsConfig).
 type ContainerManager struct {
+	ctx           context.Context
 	database      *mongodb.Database
 	dockerManager *docker.Manager
 	buildSpec     *Spec
 	pipeline      *PipelineSpec
+	graph         *JobGraph
 	trigger       *TriggerSpec
+	envVars       map[string]string
 	event         *github.Event
 	dockerSHA     string
 	buildRegister *Register
+	cacheConfig   *CacheConfig
+	savedCaches   *sync.Map
+	artifacts     *artifactsLimit
+	network       string
+	dockerAccess  string
+	limits        *docker.ContainerLimits
 }
 
 // ExecutePipeline executes the pipeline corresponding to the build triggered.
 func (containerBuildManager *ContainerManager) ExecutePipeline() (err error) {
 	event := containerBuildManager.event
-	dockerSHA := containerBuildManager.dockerSHA
-	user := containerBuildManager.buildSpec.Docker.User
-	workingDir := containerBuildManager.buildSpec.Docker.WorkingDir
-	defer containerBuildManager.buildRegister.End(err)
-
-	containerManager, error := containerBuildManager.dockerManager.CreateAndStartContainer(
-		event.Organization, event.Repository, dockerSHA, user, workingDir,
-		containerBuildManager.trigger.EnvVars)
+	defer func() {
+		containerBuildManager.buildRegister.End(err)
+	}()
+
+	pipelineTimeout := containerBuildManager.pipeline.GetTimeout(containerBuildManager.buildSpec)
+	containerBuildManager.ctx = containerBuildManager.buildRegister.Context
+	if pipelineTimeout > 0 {
+		var cancel context.CancelFunc
+		containerBuildManager.ctx, cancel = context.WithTimeout(containerBuildManager.ctx, pipelineTimeout)
+		defer cancel()
+	}
+
+	services, err := containerBuildManager.StartServices()
+	if err != nil {
+		err = fmt.Errorf("Error starting the services. %w", err)
+		return
+	}
+	if services != nil {
+		defer services.Stop()
+		containerBuildManager.network = services.Network
+	}
+
+	if containerBuildManager.graph != nil {
+		if err = containerBuildManager.ExecuteGraph(); err != nil {
+			err = fmt.Errorf("Error executing the pipeline. %w", err)
+			return
+		}
+		log.Printf("Completed successfully execution of pipeline '%s'", containerBuildManager.pipeline.Name)
+		return
+	}
+
+	containerManager, error := containerBuildManager.StartContainer()
 	if error != nil {
 		err = fmt.Errorf("Error creating and starting the container. %s", error)
 		return
 	}
 	defer containerManager.RemoveContainer()
+	finished := make(chan struct{})
+	defer close(finished)
+	go containerBuildManager.KillOnCancel(containerManager, finished)
 
-	if err = containerBuildManager.GitProjectClone(containerManager, event); err != nil {
-		err = fmt.Errorf("Error cloning the project. %s", err)
+	if err = containerBuildManager.GitProjectClone(containerManager, event, "clone", containerBuildManager.buildRegister.BuildLogWriter, containerBuildManager.buildRegister.BuildLogWriter); err != nil {
+		err = fmt.Errorf("Error cloning the project. %w", containerBuildManager.pipelineError(err))
 		return
 	}
+	containerBuildManager.RestoreCaches(containerManager)
 
 	if err = containerBuildManager.ExecutePipelineJobs(containerManager); err != nil {
-		err = fmt.Errorf("Error executing the pipeline. %s", err)
+		err = fmt.Errorf("Error executing the pipeline. %w", err)
 		return
 	}
+	containerBuildManager.SaveCaches(containerManager)
 	log.Printf("Completed successfully execution of pipeline '%s'", containerBuildManager.pipeline.Name)
 	return
 }
 
-// GitProjectClone clones a GitHub project in the container.
-func (containerBuildManager *ContainerManager) GitProjectClone(containerManager *docker.ContainerManager, event *github.Event) error {
+// StartContainer creates and starts a container with the docker image of the build.
+// The environment variables of the build are completed with the built-in variables.
+func (containerBuildManager *ContainerManager) StartContainer() (*docker.ContainerManager, error) {
+	event := containerBuildManager.event
+	envVars := make(map[string]string)
+	for name, value := range containerBuildManager.envVars {
+		envVars[name] = value
+	}
+	for name, value := range BuiltinEnvVars(containerBuildManager.buildRegister.BuildWriter.Build) {
+		envVars[name] = value
+	}
+	if containerBuildManager.dockerAccess == docker.DockerAccessDinD {
+		envVars["DOCKER_HOST"] = dindHost
+	}
+	options := docker.ContainerOptions{
+		Network:      containerBuildManager.network,
+		DockerSocket: containerBuildManager.dockerAccess == docker.DockerAccessSocket,
+		Limits:       containerBuildManager.limits,
+	}
+	return containerBuildManager.dockerManager.CreateAndStartContainer(
+		event.Organization, event.Repository, containerBuildManager.dockerSHA,
+		containerBuildManager.buildSpec.Docker.User, containerBuildManager.buildSpec.Docker.WorkingDir,
+		envVars, options)
+}
+
+// KillOnCancel kills the container if the build is cancelled, or the pipeline timeout is exceeded,
+// before the pipeline is finished. Killing the container also terminates the job being executed.
+func (containerBuildManager *ContainerManager) KillOnCancel(containerManager *docker.ContainerManager, finished chan struct{}) {
+	select {
+	case <-finished:
+	case <-containerBuildManager.ctx.Done():
+		log.Printf("Killing container of pipeline '%s'. %s", containerBuildManager.pipeline.Name, containerBuildManager.ctx.Err())
+		if err := containerManager.KillContainer(); err != nil {
+			log.Println("Error killing the container", err)
+		}
+	}
+}
+
+// GitProjectClone clones a GitHub project in the container. The output is logged as the given task.
+func (containerBuildManager *ContainerManager) GitProjectClone(containerManager *docker.ContainerManager, event *github.Event, task string, stdoutWriter, stderrWriter io.Writer) error {
+	stdout, stderr := containerBuildManager.buildRegister.TaskLogWriters(task, stdoutWriter, stderrWriter)
+	defer stdout.Flush()
+	defer stderr.Flush()
 	commands := []string{
 		fmt.Sprintf("git clone %s .", event.CloneURL),
 	}
@@ -79,7 +169,7 @@ func (containerBuildManager *ContainerManager) GitProjectClone(containerManager
 	}
 	for _, command := range commands {
 		log.Printf("Executing command: %s", command)
-		err := containerManager.ExecContainer(command, containerBuildManager.buildRegister.BuildLogWriter)
+		err := containerManager.ExecContainer(containerBuildManager.ctx, command, stdout, stderr)
 		if err != nil {
 			log.Println("Error executing command", err)
 			return err
@@ -88,10 +178,21 @@ func (containerBuildManager *ContainerManager) GitProjectClone(containerManager
 	return nil
 }
 
-// ExecutePipelineJobs executes the list of jobs of the pipeline.
+// ExecutePipelineJobs executes the stages of the pipeline in sequence.
+// A stage with a single job is executed in the pipeline container, and a stage with several jobs
+// is executed concurrently in a new container for every job.
 func (containerBuildManager *ContainerManager) ExecutePipelineJobs(containerManager *docker.ContainerManager) error {
-	for _, job := range containerBuildManager.pipeline.Jobs {
-		err := containerBuildManager.ExecutePipelineJob(containerManager, job)
+	for stage, jobs := range containerBuildManager.pipeline.Jobs {
+		if err := containerBuildManager.ctx.Err(); err != nil {
+			return containerBuildManager.pipelineError(err)
+		}
+		var err error
+		if len(jobs) == 1 {
+			err = containerBuildManager.ExecutePipelineJob(containerManager, stage, jobs[0],
+				containerBuildManager.buildRegister.BuildLogWriter, containerBuildManager.buildRegister.BuildLogWriter)
+		} else {
+			err = containerBuildManager.ExecuteStage(stage, jobs)
+		}
 		if err != nil {
 			return err
 		}
@@ -99,15 +200,176 @@ func (containerBuildManager *ContainerManager) ExecutePipelineJobs(containerMana
 	return nil
 }
 
-// ExecutePipelineJob executes a job of the pipeline.
-func (containerBuildManager *ContainerManager) ExecutePipelineJob(containerManager *docker.ContainerManager, job string) (err error) {
-	command := containerBuildManager.buildSpec.Jobs[job]
-	containerBuildManager.buildRegister.StartTask(job, command)
+// ExecuteStage executes concurrently the jobs of a stage. The stage fails if any job fails.
+func (containerBuildManager *ContainerManager) ExecuteStage(stage int, jobs []string) error {
+	log.Printf("Executing concurrently the jobs of stage %d: %v", stage, jobs)
+	errs := make([]error, len(jobs))
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job string) {
+			defer wg.Done()
+			errs[i] = containerBuildManager.ExecuteIsolatedJob(stage, job)
+		}(i, job)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExecuteGraph executes the jobs of the pipeline according to their dependency graph.
+// A job is executed once all the jobs it needs are successful, and it is skipped if any of them fails.
+// Up to the pipeline concurrency, the jobs ready to be executed are executed concurrently.
+func (containerBuildManager *ContainerManager) ExecuteGraph() error {
+	type jobResult struct {
+		job string
+		err error
+	}
+	graph := containerBuildManager.graph
+	concurrency := containerBuildManager.pipeline.GetConcurrency()
+	results := make(chan jobResult)
+	remaining := make(map[string]int)
+	for _, job := range graph.Jobs {
+		remaining[job] = len(graph.Needs[job])
+	}
+	skipped := make(map[string]bool)
+	ready := graph.Roots()
+	pending := len(graph.Jobs)
+	running := 0
+	var firstErr error
+
+	for pending > 0 {
+		for len(ready) > 0 && running < concurrency && containerBuildManager.ctx.Err() == nil {
+			job := ready[0]
+			ready = ready[1:]
+			running++
+			go func(job string) {
+				results <- jobResult{job, containerBuildManager.ExecuteIsolatedJob(graph.Levels[job], job)}
+			}(job)
+		}
+		if running == 0 {
+			break
+		}
+		result := <-results
+		running--
+		pending--
+		if result.err != nil {
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			for _, descendant := range graph.Descendants(result.job) {
+				if skipped[descendant] {
+					continue
+				}
+				skipped[descendant] = true
+				pending--
+				reason := fmt.Sprintf("Job '%s' failed", result.job)
+				containerBuildManager.buildRegister.SkipTask(graph.Levels[descendant], descendant,
+					containerBuildManager.buildSpec.Jobs[descendant].Command, reason)
+			}
+			continue
+		}
+		for _, dependent := range graph.Dependents[result.job] {
+			remaining[dependent]--
+			if remaining[dependent] == 0 && !skipped[dependent] {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := containerBuildManager.ctx.Err(); err != nil {
+		return containerBuildManager.pipelineError(err)
+	}
+	return nil
+}
+
+// ExecuteIsolatedJob executes a job in its own container, with a new clone of the project and the caches restored.
+// The output of the job is prefixed with the job name in the build log.
+// In a dependency graph, the caches are saved from the container of the first final job (a job that no other
+// job needs) that is successful.
+func (containerBuildManager *ContainerManager) ExecuteIsolatedJob(stage int, job string) error {
+	// Every stream has its own prefix writer, so that their lines are not mixed
+	stdoutWriter := NewPrefixWriter(containerBuildManager.buildRegister.BuildLogWriter, job)
+	stderrWriter := NewPrefixWriter(containerBuildManager.buildRegister.BuildLogWriter, job)
+	defer stdoutWriter.Flush()
+	defer stderrWriter.Flush()
+
+	containerManager, err := containerBuildManager.StartContainer()
+	if err != nil {
+		return fmt.Errorf("Error creating and starting the container of job: %s. %s", job, err)
+	}
+	defer containerManager.RemoveContainer()
+	finished := make(chan struct{})
+	defer close(finished)
+	go containerBuildManager.KillOnCancel(containerManager, finished)
+
+	if err := containerBuildManager.GitProjectClone(containerManager, containerBuildManager.event, "clone "+job, stdoutWriter, stderrWriter); err != nil {
+		return fmt.Errorf("Error cloning the project for job: %s. %w", job, containerBuildManager.pipelineError(err))
+	}
+	containerBuildManager.RestoreCaches(containerManager)
+	if err := containerBuildManager.ExecutePipelineJob(containerManager, stage, job, stdoutWriter, stderrWriter); err != nil {
+		return err
+	}
+	if graph := containerBuildManager.graph; graph != nil && len(graph.Dependents[job]) == 0 {
+		containerBuildManager.SaveCaches(containerManager)
+	}
+	return nil
+}
+
+// ExecutePipelineJob executes a job of the pipeline, and collects its artifacts.
+func (containerBuildManager *ContainerManager) ExecutePipelineJob(containerManager *docker.ContainerManager, stage int, job string, stdoutWriter, stderrWriter io.Writer) (err error) {
+	jobSpec := containerBuildManager.buildSpec.Jobs[job]
+	command := jobSpec.Command
+	taskID := containerBuildManager.buildRegister.StartTask(stage, job, command)
 	log.Printf("Executing job '%s' with command: %s", job, command)
-	err = containerManager.ExecContainer(command, containerBuildManager.buildRegister.BuildLogWriter)
+	ctx := containerBuildManager.ctx
+	if jobSpec.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, jobSpec.Timeout)
+		defer cancel()
+	}
+	stdout, stderr := containerBuildManager.buildRegister.TaskLogWriters(job, stdoutWriter, stderrWriter)
+	err = containerManager.ExecContainer(ctx, command, stdout, stderr)
+	stdout.Flush()
+	stderr.Flush()
+	if containerBuildManager.ctx.Err() == nil {
+		containerBuildManager.CollectArtifacts(containerManager, job)
+	}
 	if err != nil {
-		err = fmt.Errorf("Error executing job: %s. %s", job, err)
+		if containerBuildManager.ctx.Err() == nil && ctx.Err() == context.DeadlineExceeded {
+			err = &TimeoutError{Name: job, Timeout: jobSpec.Timeout}
+		} else {
+			err = fmt.Errorf("Error executing job: %s. %w", job, containerBuildManager.pipelineError(err))
+		}
 	}
-	containerBuildManager.buildRegister.EndTask(job, command, err)
+	containerBuildManager.buildRegister.EndTask(taskID, job, command, err)
 	return
 }
+
+// pipelineError replaces an error by a TimeoutError if the pipeline timeout was exceeded.
+func (containerBuildManager *ContainerManager) pipelineError(err error) error {
+	if containerBuildManager.ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{
+			Name:    containerBuildManager.pipeline.Name,
+			Timeout: containerBuildManager.pipeline.GetTimeout(containerBuildManager.buildSpec),
+		}
+	}
+	return err
+}
+
+// TimeoutError type.
+// Error of a job, or a pipeline, that exceeded its timeout.
+type TimeoutError struct {
+	Name    string
+	Timeout time.Duration
+}
+
+func (err *TimeoutError) Error() string {
+	return fmt.Sprintf("Timeout of %s exceeded by '%s'", err.Timeout, err.Name)
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gocilla/gocilla/managers/github"
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+// GetEnvVars gets the environment variables of the build. The variables are merged with this precedence
+// (every source overrides the previous ones):
+//  1. The variables of the repository settings (with the secret ones decrypted), according to their
+//     restrictions (see AllowEnvVar).
+//  2. The variables of the trigger (.gocilla.yml), or the variables of a manual build.
+//  3. The variables of the matrix combination (see ExecuteMatrix).
+//  4. The built-in GOCILLA_* variables (see BuiltinEnvVars), set when the container is created.
+//
+// It also returns the values to be masked in the build log: the values of the repository variables marked
+// as secret, and the values of the variables listed as secrets in the build spec.
+func (buildManager *Manager) GetEnvVars(buildSpec *Spec, event *github.Event, trigger *TriggerSpec) (map[string]string, []string, error) {
+	repository, err := buildManager.Database.GetRepository(event.Organization, event.Repository)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error getting the settings of repository '%s/%s'. %s", event.Organization, event.Repository, err)
+	}
+	envVars := make(map[string]string)
+	var secretValues []string
+	for i := range repository.EnvVars {
+		envVar := &repository.EnvVars[i]
+		if !AllowEnvVar(envVar, event) {
+			continue
+		}
+		value, err := buildManager.SecretsManager.Decrypt(repository, envVar)
+		if err != nil {
+			return nil, nil, err
+		}
+		envVars[envVar.Name] = value
+		if envVar.Secret {
+			secretValues = append(secretValues, value)
+		}
+	}
+	for name, value := range trigger.EnvVars {
+		envVars[name] = value
+	}
+	for _, name := range buildSpec.Secrets {
+		if value, ok := envVars[name]; ok {
+			secretValues = append(secretValues, value)
+		}
+	}
+	return envVars, secretValues, nil
+}
+
+// AllowEnvVar checks if a repository variable is set for the build of an event, according to its restrictions.
+// As the commands of a pull request build come from the pull request itself, the variables are restricted
+// by default in pull request builds:
+//   - A secret variable, or a variable restricted to some branches, is only set if it allows PullRequests.
+//     The branches are then matched with the base branch of the pull request.
+//   - No variable is set in the builds of pull requests from forks, unless it allows Forks.
+//
+// Invalid branch patterns do not match any branch.
+func AllowEnvVar(envVar *mongodb.PipelineEnvVar, event *github.Event) bool {
+	if event.Pull != nil {
+		if event.Pull.Fork && !envVar.Forks {
+			return false
+		}
+		if (envVar.Secret || len(envVar.Branches) > 0) && !envVar.PullRequests {
+			return false
+		}
+	}
+	if len(envVar.Branches) > 0 {
+		branches := PatternsSpec(envVar.Branches)
+		if branches.Validate() != nil || !branches.Match(event.Branch) {
+			return false
+		}
+	}
+	return true
+}
+
+// BuiltinEnvVars gets the built-in variables of a build. They are set in every build container, and
+// they cannot be overridden. The variables that do not apply to the build (e.g. GOCILLA_TAG for a push)
+// are set to an empty value.
+func BuiltinEnvVars(build *mongodb.Build) map[string]string {
+	envVars := map[string]string{
+		"GOCILLA":              "true",
+		"GOCILLA_ORGANIZATION": build.Organization,
+		"GOCILLA_REPOSITORY":   build.Repository,
+		"GOCILLA_EVENT":        build.Event,
+		"GOCILLA_BRANCH":       build.Branch,
+		"GOCILLA_TAG":          build.Tag,
+		"GOCILLA_SHA":          build.SHA,
+		"GOCILLA_PULL_NUMBER":  "",
+		"GOCILLA_PULL_FORK":    "",
+		"GOCILLA_PIPELINE":     build.Pipeline,
+		"GOCILLA_BUILD_ID":     build.ID.Hex(),
+		"GOCILLA_BUILD_NUMBER": "",
+		"GOCILLA_PARENT_ID":    "",
+	}
+	if build.PullNumber > 0 {
+		envVars["GOCILLA_PULL_NUMBER"] = strconv.Itoa(build.PullNumber)
+		envVars["GOCILLA_PULL_FORK"] = strconv.FormatBool(build.PullFork)
+	}
+	if build.DisplayNumber() > 0 {
+		envVars["GOCILLA_BUILD_NUMBER"] = strconv.Itoa(build.DisplayNumber())
+	}
+	if build.Parent != "" {
+		envVars["GOCILLA_PARENT_ID"] = build.Parent.Hex()
+	}
+	return envVars
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"github.com/gocilla/gocilla/managers/github"
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+func TestAllowEnvVar(t *testing.T) {
+	push := &github.Event{Type: github.EventTypePush, Branch: "master"}
+	pull := &github.Event{Type: github.EventTypePull, Branch: "master", Pull: &github.EventPull{Number: 1}}
+	fork := &github.Event{Type: github.EventTypePull, Branch: "master", Pull: &github.EventPull{Number: 2, Fork: true}}
+	tests := []struct {
+		envVar mongodb.PipelineEnvVar
+		event  *github.Event
+		allow  bool
+	}{
+		{mongodb.PipelineEnvVar{}, push, true},
+		{mongodb.PipelineEnvVar{}, pull, true},
+		{mongodb.PipelineEnvVar{}, fork, false},
+		{mongodb.PipelineEnvVar{Forks: true}, fork, true},
+		{mongodb.PipelineEnvVar{Secret: true}, push, true},
+		{mongodb.PipelineEnvVar{Secret: true}, pull, false},
+		{mongodb.PipelineEnvVar{Secret: true, PullRequests: true}, pull, true},
+		{mongodb.PipelineEnvVar{Secret: true, Forks: true}, fork, false},
+		{mongodb.PipelineEnvVar{Secret: true, PullRequests: true}, fork, false},
+		{mongodb.PipelineEnvVar{Secret: true, PullRequests: true, Forks: true}, fork, true},
+		{mongodb.PipelineEnvVar{Branches: []string{"master"}}, push, true},
+		{mongodb.PipelineEnvVar{Branches: []string{"release/*"}}, push, false},
+		{mongodb.PipelineEnvVar{Branches: []string{"master"}}, pull, false},
+		{mongodb.PipelineEnvVar{Branches: []string{"master"}, PullRequests: true}, pull, true},
+		{mongodb.PipelineEnvVar{Branches: []string{"release/*"}, PullRequests: true}, pull, false},
+		{mongodb.PipelineEnvVar{Branches: []string{"/[/"}}, push, false},
+	}
+	for _, test := range tests {
+		if allow := AllowEnvVar(&test.envVar, test.event); allow != test.allow {
+			t.Errorf("Variable %+v with event %+v: expected %t, got %t", test.envVar, test.event.Pull, test.allow, allow)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"log"
+	"time"
+
+	"github.com/gocilla/gocilla/managers/github"
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+// FilterTriggers removes the triggers whose path filters do not match the files changed by the event.
+// A "skipped" build is registered for every trigger removed. If the files changed are not available
+// (e.g. for tag events), the path filters are not applied.
+func (buildManager *Manager) FilterTriggers(githubClient *github.Client, event *github.Event, queueJob *mongodb.QueueJob,
+	triggers []*TriggerSpec) []*TriggerSpec {
+	var files []string
+	var filesErr error
+	filesLoaded := false
+
+	var filtered []*TriggerSpec
+	for _, trigger := range triggers {
+		if !trigger.HasPathFilters() {
+			filtered = append(filtered, trigger)
+			continue
+		}
+		if !filesLoaded {
+			files, filesErr = githubClient.GetChangedFiles(event)
+			filesLoaded = true
+			if filesErr != nil {
+				log.Printf("Error getting the changed files. Path filters are not applied. %s", filesErr)
+			}
+		}
+		if filesErr != nil {
+			filtered = append(filtered, trigger)
+			continue
+		}
+		if matches, reason := trigger.MatchFiles(files); !matches {
+			buildManager.Skip(githubClient, event, queueJob, trigger, reason)
+			continue
+		}
+		filtered = append(filtered, trigger)
+	}
+	return filtered
+}
+
+// Skip registers a build of a trigger with "skipped" status and the reason.
+// For pull requests, the GitHub status of the pipeline is successful so that it does not block the pull request.
+func (buildManager *Manager) Skip(githubClient *github.Client, event *github.Event, queueJob *mongodb.QueueJob,
+	trigger *TriggerSpec, reason string) {
+	log.Printf("Skipped pipeline '%s' of trigger '%s'. %s", trigger.Pipeline, trigger.Name, reason)
+	now := time.Now()
+	build := newBuild(queueJob, event, trigger)
+	build.Status = "skipped"
+	build.Error = reason
+	build.Start = &now
+	build.End = &now
+	build.Tasks = []*mongodb.BuildTask{}
+	if err := buildManager.Database.CreateBuild(build); err != nil {
+		log.Printf("Error registering skipped build. %s", err)
+	}
+	if event.Type == github.EventTypePull && githubClient != nil {
+		githubClient.CreateStatus(event.Organization, event.Repository, event.Pull.HeadSHA,
+			trigger.Pipeline, "Build skipped. "+reason, "success")
+	}
+}
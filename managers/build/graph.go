@@ -0,0 +1,137 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+// defaultConcurrency is the maximum number of jobs of a graph executed concurrently
+// if the pipeline does not set it.
+const defaultConcurrency = 4
+
+// JobGraph type.
+// Dependency graph of the jobs of a pipeline, built from the needs of the jobs.
+// The level of a job is the length of the longest path from a job without needs.
+type JobGraph struct {
+	Jobs       []string
+	Needs      map[string][]string
+	Dependents map[string][]string
+	Levels     map[string]int
+}
+
+// NewJobGraph validates the jobs of a pipeline (unknown or duplicated jobs, and cycles) and builds the graph.
+func NewJobGraph(buildSpec *Spec, pipeline *PipelineSpec) (*JobGraph, error) {
+	graph := &JobGraph{
+		Needs:      make(map[string][]string),
+		Dependents: make(map[string][]string),
+		Levels:     make(map[string]int),
+	}
+	for _, stage := range pipeline.Jobs {
+		for _, job := range stage {
+			if _, ok := graph.Needs[job]; ok {
+				return nil, fmt.Errorf("Job '%s' is duplicated in pipeline '%s'", job, pipeline.Name)
+			}
+			graph.Jobs = append(graph.Jobs, job)
+			graph.Needs[job] = buildSpec.Jobs[job].Needs
+		}
+	}
+	for _, job := range graph.Jobs {
+		for _, need := range graph.Needs[job] {
+			if _, ok := graph.Needs[need]; !ok {
+				return nil, fmt.Errorf("Job '%s' needs job '%s' that is not in pipeline '%s'", job, need, pipeline.Name)
+			}
+			graph.Dependents[need] = append(graph.Dependents[need], job)
+		}
+	}
+
+	// Kahn's algorithm to compute the levels and detect the cycles
+	remaining := make(map[string]int)
+	var ready []string
+	for _, job := range graph.Jobs {
+		remaining[job] = len(graph.Needs[job])
+		if remaining[job] == 0 {
+			ready = append(ready, job)
+		}
+	}
+	sorted := 0
+	for len(ready) > 0 {
+		job := ready[0]
+		ready = ready[1:]
+		sorted++
+		for _, dependent := range graph.Dependents[job] {
+			if graph.Levels[job]+1 > graph.Levels[dependent] {
+				graph.Levels[dependent] = graph.Levels[job] + 1
+			}
+			remaining[dependent]--
+			if remaining[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if sorted < len(graph.Jobs) {
+		var cycle []string
+		for _, job := range graph.Jobs {
+			if remaining[job] > 0 {
+				cycle = append(cycle, job)
+			}
+		}
+		sort.Strings(cycle)
+		return nil, fmt.Errorf("Cycle in the needs of jobs: %s", strings.Join(cycle, ", "))
+	}
+	return graph, nil
+}
+
+// Roots gets the jobs without needs.
+func (graph *JobGraph) Roots() []string {
+	var roots []string
+	for _, job := range graph.Jobs {
+		if len(graph.Needs[job]) == 0 {
+			roots = append(roots, job)
+		}
+	}
+	return roots
+}
+
+// Descendants gets the jobs that depend, directly or transitively, on a job.
+func (graph *JobGraph) Descendants(job string) []string {
+	var descendants []string
+	visited := make(map[string]bool)
+	pending := append([]string{}, graph.Dependents[job]...)
+	for len(pending) > 0 {
+		dependent := pending[0]
+		pending = pending[1:]
+		if visited[dependent] {
+			continue
+		}
+		visited[dependent] = true
+		descendants = append(descendants, dependent)
+		pending = append(pending, graph.Dependents[dependent]...)
+	}
+	return descendants
+}
+
+// Nodes gets the shape of the graph to be stored in the build.
+func (graph *JobGraph) Nodes() []mongodb.BuildNode {
+	nodes := make([]mongodb.BuildNode, len(graph.Jobs))
+	for i, job := range graph.Jobs {
+		nodes[i] = mongodb.BuildNode{Name: job, Needs: graph.Needs[job], Level: graph.Levels[job]}
+	}
+	return nodes
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNewJobGraph(t *testing.T) {
+	buildSpec := &Spec{
+		Jobs: map[string]JobSpec{
+			"build":   {Command: "make"},
+			"lint":    {Command: "make lint", Needs: []string{"build"}},
+			"test":    {Command: "make test", Needs: []string{"build"}},
+			"docs":    {Command: "make docs"},
+			"publish": {Command: "make publish", Needs: []string{"lint", "test", "docs"}},
+		},
+	}
+	pipeline := &PipelineSpec{Name: "ci", Jobs: []StageSpec{{"build", "docs"}, {"lint", "test"}, {"publish"}}}
+	graph, err := NewJobGraph(buildSpec, pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedLevels := map[string]int{"build": 0, "docs": 0, "lint": 1, "test": 1, "publish": 2}
+	for job, level := range expectedLevels {
+		if graph.Levels[job] != level {
+			t.Errorf("Expected level %d of job '%s', got %d", level, job, graph.Levels[job])
+		}
+	}
+	if roots := graph.Roots(); !reflect.DeepEqual(roots, []string{"build", "docs"}) {
+		t.Errorf("Expected roots [build docs], got %v", roots)
+	}
+	descendants := graph.Descendants("build")
+	sort.Strings(descendants)
+	if !reflect.DeepEqual(descendants, []string{"lint", "publish", "test"}) {
+		t.Errorf("Expected descendants [lint publish test], got %v", descendants)
+	}
+	if descendants := graph.Descendants("publish"); len(descendants) != 0 {
+		t.Errorf("Expected no descendants of a final job, got %v", descendants)
+	}
+	if nodes := graph.Nodes(); len(nodes) != 5 || nodes[4].Name != "publish" || nodes[4].Level != 2 {
+		t.Errorf("Unexpected nodes %+v", nodes)
+	}
+}
+
+func TestNewJobGraphErrors(t *testing.T) {
+	tests := []struct {
+		jobs     map[string]JobSpec
+		pipeline []StageSpec
+		err      string
+	}{
+		{
+			map[string]JobSpec{"a": {Command: "a"}},
+			[]StageSpec{{"a"}, {"a"}},
+			"Job 'a' is duplicated",
+		},
+		{
+			map[string]JobSpec{"a": {Command: "a", Needs: []string{"b"}}, "b": {Command: "b"}},
+			[]StageSpec{{"a"}},
+			"Job 'a' needs job 'b' that is not in pipeline",
+		},
+		{
+			map[string]JobSpec{"a": {Command: "a", Needs: []string{"b"}}, "b": {Command: "b", Needs: []string{"a"}}, "c": {Command: "c"}},
+			[]StageSpec{{"a", "b", "c"}},
+			"Cycle in the needs of jobs: a, b",
+		},
+		{
+			map[string]JobSpec{"a": {Command: "a", Needs: []string{"a"}}},
+			[]StageSpec{{"a"}},
+			"Cycle in the needs of jobs: a",
+		},
+	}
+	for _, test := range tests {
+		_, err := NewJobGraph(&Spec{Jobs: test.jobs}, &PipelineSpec{Name: "ci", Jobs: test.pipeline})
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("Expected error '%s', got %v", test.err, err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+// logStoreBatch is the maximum number of log lines stored at once.
+const logStoreBatch = 100
+
+// logStoreInterval is the maximum time a log line waits to be stored.
+const logStoreInterval = time.Second
+
+// logLineMaxLength is the maximum length of a stored log line. Longer lines are split.
+const logLineMaxLength = 64 * 1024
+
+// LogStore type.
+// Store of the log of a build as timestamped lines, segmented by task. The lines are numbered in
+// the order they are written, and they are stored in batches. The secret values are masked in every line.
+type LogStore struct {
+	database *mongodb.Database
+	build    *mongodb.Build
+	masker   *Masker
+	number   int
+	pending  []mongodb.LogLine
+	done     chan struct{}
+	mutex    sync.Mutex
+}
+
+// NewLogStore is the constructor of LogStore. The lines are stored periodically until the store is closed.
+func NewLogStore(database *mongodb.Database, build *mongodb.Build, masker *Masker) *LogStore {
+	logStore := &LogStore{database: database, build: build, masker: masker, done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(logStoreInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-logStore.done:
+				return
+			case <-ticker.C:
+				logStore.Flush()
+			}
+		}
+	}()
+	return logStore
+}
+
+// Add a line to the log of a task.
+func (logStore *LogStore) Add(task, stream, text string) {
+	logStore.mutex.Lock()
+	logStore.number++
+	logStore.pending = append(logStore.pending, mongodb.LogLine{
+		Build:  logStore.build.ID,
+		Number: logStore.number,
+		Task:   task,
+		Stream: stream,
+		Time:   time.Now(),
+		Text:   logStore.masker.Mask(text),
+	})
+	full := len(logStore.pending) >= logStoreBatch
+	logStore.mutex.Unlock()
+	if full {
+		logStore.Flush()
+	}
+}
+
+// Flush stores the pending lines.
+func (logStore *LogStore) Flush() {
+	logStore.mutex.Lock()
+	defer logStore.mutex.Unlock()
+	if len(logStore.pending) == 0 {
+		return
+	}
+	if err := logStore.database.InsertLogLines(logStore.pending); err != nil {
+		log.Printf("Error storing the log lines of build '%s'. %s", logStore.build.ID.Hex(), err)
+	}
+	logStore.pending = nil
+}
+
+// Close stores the pending lines and stops storing them periodically.
+func (logStore *LogStore) Close() {
+	close(logStore.done)
+	logStore.Flush()
+}
+
+// TaskLogWriter type.
+// Writer of a stream (stdout or stderr) of a task. The output is written to the build log as it is,
+// and it is added to the log store line by line. The last line is added on Flush, even if it is not terminated.
+// The lines longer than logLineMaxLength (e.g. an output without newlines) are split, so the buffer is bounded.
+type TaskLogWriter struct {
+	w        io.Writer
+	logStore *LogStore
+	task     string
+	stream   string
+	buf      []byte
+}
+
+// NewTaskLogWriter is the constructor of TaskLogWriter.
+func NewTaskLogWriter(w io.Writer, logStore *LogStore, task, stream string) *TaskLogWriter {
+	return &TaskLogWriter{w: w, logStore: logStore, task: task, stream: stream}
+}
+
+func (taskLogWriter *TaskLogWriter) Write(p []byte) (int, error) {
+	n, err := taskLogWriter.w.Write(p)
+	if taskLogWriter.logStore == nil {
+		return n, err
+	}
+	taskLogWriter.buf = append(taskLogWriter.buf, p...)
+	for {
+		i := bytes.IndexByte(taskLogWriter.buf, '\n')
+		if i < 0 {
+			break
+		}
+		taskLogWriter.logStore.Add(taskLogWriter.task, taskLogWriter.stream, string(taskLogWriter.buf[:i]))
+		taskLogWriter.buf = taskLogWriter.buf[i+1:]
+	}
+	for len(taskLogWriter.buf) > logLineMaxLength {
+		// Split the line at the start of a UTF-8 character
+		i := logLineMaxLength
+		for i > 0 && !utf8.RuneStart(taskLogWriter.buf[i]) {
+			i--
+		}
+		if i == 0 {
+			i = logLineMaxLength
+		}
+		taskLogWriter.logStore.Add(taskLogWriter.task, taskLogWriter.stream, string(taskLogWriter.buf[:i]))
+		taskLogWriter.buf = taskLogWriter.buf[i:]
+	}
+	// Release the memory of the lines already stored
+	if len(taskLogWriter.buf) == 0 {
+		taskLogWriter.buf = nil
+	}
+	return n, err
+}
+
+// Flush adds the last line to the log store even if it is not terminated.
+func (taskLogWriter *TaskLogWriter) Flush() {
+	if len(taskLogWriter.buf) > 0 && taskLogWriter.logStore != nil {
+		taskLogWriter.logStore.Add(taskLogWriter.task, taskLogWriter.stream, string(taskLogWriter.buf))
+	}
+	taskLogWriter.buf = nil
+}
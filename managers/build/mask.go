@@ -0,0 +1,171 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// secretMask replaces the secret values in the build log.
+const secretMask = "***"
+
+// secretMinLength is the minimum length of a secret value to be masked. Shorter values would mask
+// too much of the log.
+const secretMinLength = 3
+
+// Masker type.
+// Masker of the values of the secret variables of a build. Every value is masked as it is, encoded in base64
+// (standard and URL alphabets, without padding) and URL-encoded. The lines of multi-line values are masked
+// one by one as well. As a value may be encoded in base64 as part of longer data (e.g. "user:password"),
+// its encodings at the offsets 0, 1 and 2 of the data are masked too (see base64Forms).
+type Masker struct {
+	patterns [][]byte
+}
+
+// NewMasker is the constructor of Masker.
+func NewMasker(secrets []string) *Masker {
+	forms := make(map[string]bool)
+	addForm := func(form string) {
+		if len(form) >= secretMinLength {
+			forms[form] = true
+		}
+	}
+	for _, secret := range secrets {
+		values := []string{secret}
+		if strings.Contains(secret, "\n") {
+			values = append(values, strings.Split(secret, "\n")...)
+		}
+		for _, value := range values {
+			value = strings.TrimRight(value, "\r")
+			if len(value) < secretMinLength {
+				continue
+			}
+			addForm(value)
+			for _, encoding := range []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding} {
+				addForm(encoding.EncodeToString([]byte(value)))
+				for _, form := range base64Forms(encoding, []byte(value)) {
+					addForm(form)
+				}
+			}
+			addForm(url.QueryEscape(value))
+			addForm(url.PathEscape(value))
+		}
+	}
+	masker := &Masker{}
+	for form := range forms {
+		masker.patterns = append(masker.patterns, []byte(form))
+	}
+	// The longest patterns are masked first, so that a value including another one is fully masked
+	sort.Slice(masker.patterns, func(i, j int) bool {
+		if len(masker.patterns[i]) != len(masker.patterns[j]) {
+			return len(masker.patterns[i]) > len(masker.patterns[j])
+		}
+		return bytes.Compare(masker.patterns[i], masker.patterns[j]) < 0
+	})
+	return masker
+}
+
+// base64Forms gets the encodings in base64 of a value at the offsets 0, 1 and 2 of longer data. The characters
+// at the edges, that also encode the bytes before or after the value, are trimmed.
+func base64Forms(encoding *base64.Encoding, value []byte) []string {
+	var forms []string
+	for offset := 0; offset < 3; offset++ {
+		data := append(make([]byte, offset), value...)
+		encoded := encoding.EncodeToString(data)
+		// Every character encodes 6 bits: the first one not including bits of the offset bytes,
+		// and the last one not including bits of the following bytes
+		start, end := (8*offset+5)/6, 8*len(data)/6
+		forms = append(forms, encoded[start:end])
+	}
+	return forms
+}
+
+// Mask replaces the secret values in a string.
+func (masker *Masker) Mask(s string) string {
+	if masker == nil || len(masker.patterns) == 0 {
+		return s
+	}
+	masked, _ := masker.mask([]byte(s), true)
+	return string(masked)
+}
+
+// mask replaces the secret values in data. Unless final, the end of data that may be the beginning of
+// a secret value is not masked, but returned as rest to be masked with the following data.
+func (masker *Masker) mask(data []byte, final bool) (masked, rest []byte) {
+	masked = make([]byte, 0, len(data))
+	i := 0
+scan:
+	for i < len(data) {
+		// The patterns are sorted by length, so a shorter pattern is not masked if a longer one may still match
+		for _, pattern := range masker.patterns {
+			if bytes.HasPrefix(data[i:], pattern) {
+				masked = append(masked, secretMask...)
+				i += len(pattern)
+				continue scan
+			}
+			if !final && len(data)-i < len(pattern) && bytes.HasPrefix(pattern, data[i:]) {
+				return masked, data[i:]
+			}
+		}
+		masked = append(masked, data[i])
+		i++
+	}
+	return masked, nil
+}
+
+// MaskWriter type.
+// Writer that masks the secret values before writing to the underlying writer. The end of a write that may
+// be the beginning of a secret value is held until the following write (or Flush), so that the values
+// split across writes are masked as well.
+type MaskWriter struct {
+	w      io.Writer
+	masker *Masker
+	buf    []byte
+}
+
+// NewMaskWriter is the constructor of MaskWriter.
+func NewMaskWriter(w io.Writer, masker *Masker) *MaskWriter {
+	return &MaskWriter{w: w, masker: masker}
+}
+
+func (maskWriter *MaskWriter) Write(p []byte) (int, error) {
+	if maskWriter.masker == nil || len(maskWriter.masker.patterns) == 0 {
+		return maskWriter.w.Write(p)
+	}
+	masked, rest := maskWriter.masker.mask(append(maskWriter.buf, p...), false)
+	maskWriter.buf = append([]byte{}, rest...)
+	if len(masked) > 0 {
+		if _, err := maskWriter.w.Write(masked); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes the data held by the writer, once no more data is written.
+func (maskWriter *MaskWriter) Flush() error {
+	if len(maskWriter.buf) == 0 {
+		return nil
+	}
+	masked, _ := maskWriter.masker.mask(maskWriter.buf, true)
+	maskWriter.buf = nil
+	_, err := maskWriter.w.Write(masked)
+	return err
+}
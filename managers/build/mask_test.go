@@ -0,0 +1,87 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMaskerMask(t *testing.T) {
+	secret := "s3cr3t/p@ss"
+	masker := NewMasker([]string{secret, "ab", "line1\nline2"})
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"no secrets", "no secrets"},
+		{"pw=" + secret, "pw=***"},
+		{secret + secret, "******"},
+		{"short ab", "short ab"},
+		{"b64=" + base64.StdEncoding.EncodeToString([]byte(secret)), "b64=***="},
+		{"b64=" + base64.RawURLEncoding.EncodeToString([]byte(secret)), "b64=***"},
+		{"url=" + url.QueryEscape(secret), "url=***"},
+		{"path=" + url.PathEscape(secret), "path=***"},
+		{"line1 and line2", "*** and ***"},
+	}
+	for _, test := range tests {
+		if got := masker.Mask(test.s); got != test.want {
+			t.Errorf("Mask(%q) = %q, want %q", test.s, got, test.want)
+		}
+	}
+}
+
+func TestMaskerMaskBase64Offsets(t *testing.T) {
+	secret := "s3cr3t/p@ss"
+	masker := NewMasker([]string{secret})
+	for _, prefix := range []string{"", "u", "us", "usr", "user:"} {
+		for _, suffix := range []string{"", "!", "!!", "!!!"} {
+			for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding} {
+				encoded := encoding.EncodeToString([]byte(prefix + secret + suffix))
+				got := masker.Mask(encoded)
+				// Only the characters that also encode the prefix or the suffix are not masked
+				i := strings.Index(got, secretMask)
+				before, after := (8*len(prefix)+5)/6, len(encoded)-8*(len(prefix)+len(secret))/6
+				if i < 0 || i > before || len(got)-i-len(secretMask) > after {
+					t.Errorf("Mask(%q) of %q = %q", encoded, prefix+secret+suffix, got)
+				}
+			}
+		}
+	}
+}
+
+func TestMaskWriter(t *testing.T) {
+	secret := "s3cr3t/p@ss"
+	masker := NewMasker([]string{secret})
+	in := "pw=" + secret + " b64=" + base64.StdEncoding.EncodeToString([]byte(secret)) + " s3cr"
+	for _, size := range []int{1, 2, 3, 7, len(in)} {
+		var out bytes.Buffer
+		w := NewMaskWriter(&out, masker)
+		for i := 0; i < len(in); i += size {
+			end := i + size
+			if end > len(in) {
+				end = len(in)
+			}
+			w.Write([]byte(in[i:end]))
+		}
+		w.Flush()
+		if want := "pw=*** b64=***= s3cr"; out.String() != want {
+			t.Errorf("MaskWriter with writes of %d bytes = %q, want %q", size, out.String(), want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Expand gets the combinations of the matrix variables.
+// The combinations are sorted by the values of the variables, sorted by name.
+func (matrixSpec *MatrixSpec) Expand() []map[string]string {
+	names := make([]string, 0, len(matrixSpec.Vars))
+	for name := range matrixSpec.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combinations := []map[string]string{}
+	if len(names) > 0 {
+		combinations = append(combinations, map[string]string{})
+	}
+	for _, name := range names {
+		expanded := []map[string]string{}
+		for _, combination := range combinations {
+			for _, value := range matrixSpec.Vars[name] {
+				next := map[string]string{name: value}
+				for k, v := range combination {
+					next[k] = v
+				}
+				expanded = append(expanded, next)
+			}
+		}
+		combinations = expanded
+	}
+
+	result := []map[string]string{}
+	for _, combination := range combinations {
+		if !matchesAny(combination, matrixSpec.Exclude) {
+			result = append(result, combination)
+		}
+	}
+	for _, include := range matrixSpec.Include {
+		if !containsCombination(result, include) {
+			result = append(result, include)
+		}
+	}
+	return result
+}
+
+// MatrixName gets the name of a matrix combination (e.g. "DB=mongo, GO_VERSION=1.6").
+func MatrixName(matrix map[string]string) string {
+	vars := make([]string, 0, len(matrix))
+	for name, value := range matrix {
+		vars = append(vars, name+"="+value)
+	}
+	sort.Strings(vars)
+	return strings.Join(vars, ", ")
+}
+
+// matchesAny checks if the combination has the values of any of the entries.
+func matchesAny(combination map[string]string, entries []map[string]string) bool {
+	for _, entry := range entries {
+		if len(entry) == 0 {
+			continue
+		}
+		matches := true
+		for name, value := range entry {
+			if combination[name] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// containsCombination checks if the combination is already in the list.
+func containsCombination(combinations []map[string]string, combination map[string]string) bool {
+	for _, c := range combinations {
+		if len(c) == len(combination) && matchesAny(c, []map[string]string{combination}) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExecuteMatrix executes the pipeline once for every combination of the matrix, each one in a child build
+// with the matrix variables merged into the environment variables. Up to the pipeline concurrency, the
+// combinations are executed concurrently. The build fails if any child build fails, and, with FailFast,
+// the failure of a child build cancels the others.
+func (buildManager *Manager) ExecuteMatrix(containerManager *ContainerManager) (err error) {
+	buildRegister := containerManager.buildRegister
+	defer func() {
+		buildRegister.End(err)
+	}()
+	pipeline := containerManager.pipeline
+	combinations := pipeline.Matrix.Expand()
+	if len(combinations) == 0 {
+		err = fmt.Errorf("No matrix combinations for pipeline: %s", pipeline.Name)
+		return
+	}
+	log.Printf("Executing pipeline '%s' for %d matrix combinations", pipeline.Name, len(combinations))
+
+	var mutex sync.Mutex
+	var children []*Register
+	var firstErr error
+	failed := false
+	fail := func(childErr error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if firstErr == nil {
+			firstErr = childErr
+		}
+		if failed || !pipeline.Matrix.FailFast {
+			return
+		}
+		failed = true
+		for _, child := range children {
+			child.Cancel("cancelled")
+		}
+	}
+
+	semaphore := make(chan struct{}, pipeline.GetConcurrency())
+	var wg sync.WaitGroup
+	for _, matrix := range combinations {
+		wg.Add(1)
+		go func(matrix map[string]string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			envVars := make(map[string]string)
+			for name, value := range containerManager.envVars {
+				envVars[name] = value
+			}
+			for name, value := range matrix {
+				envVars[name] = value
+			}
+
+			mutex.Lock()
+			if failed || buildRegister.Context.Err() != nil {
+				mutex.Unlock()
+				return
+			}
+			child, err := buildRegister.NewChild(matrix, envVars)
+			if err == nil {
+				children = append(children, child)
+			}
+			mutex.Unlock()
+			if err != nil {
+				fail(fmt.Errorf("Error creating build register for matrix '%s'. %s", MatrixName(matrix), err))
+				return
+			}
+			go buildManager.watchCancel(child)
+
+			childManager := *containerManager
+			childManager.envVars = envVars
+			childManager.buildRegister = child
+			if err := childManager.ExecutePipeline(); err != nil {
+				fail(fmt.Errorf("Error executing matrix '%s'. %s", MatrixName(matrix), err))
+			}
+		}(matrix)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		err = firstErr
+		return
+	}
+	if buildRegister.Context.Err() != nil {
+		err = buildRegister.Context.Err()
+	}
+	return
+}
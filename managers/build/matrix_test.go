@@ -0,0 +1,120 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestMatrixSpecExpand(t *testing.T) {
+	tests := []struct {
+		matrix       MatrixSpec
+		combinations []map[string]string
+	}{
+		{
+			MatrixSpec{},
+			[]map[string]string{},
+		},
+		{
+			MatrixSpec{Vars: map[string][]string{"GO": {"1.6", "1.7"}}},
+			[]map[string]string{{"GO": "1.6"}, {"GO": "1.7"}},
+		},
+		{
+			MatrixSpec{Vars: map[string][]string{"GO": {"1.6", "1.7"}, "DB": {"mongo", "redis"}}},
+			[]map[string]string{
+				{"DB": "mongo", "GO": "1.6"}, {"DB": "mongo", "GO": "1.7"},
+				{"DB": "redis", "GO": "1.6"}, {"DB": "redis", "GO": "1.7"},
+			},
+		},
+		{
+			MatrixSpec{
+				Vars:    map[string][]string{"GO": {"1.6", "1.7"}, "DB": {"mongo", "redis"}},
+				Exclude: []map[string]string{{"DB": "redis", "GO": "1.6"}, {}},
+			},
+			[]map[string]string{{"DB": "mongo", "GO": "1.6"}, {"DB": "mongo", "GO": "1.7"}, {"DB": "redis", "GO": "1.7"}},
+		},
+		{
+			MatrixSpec{
+				Vars:    map[string][]string{"GO": {"1.6", "1.7"}, "DB": {"mongo"}},
+				Exclude: []map[string]string{{"GO": "1.6"}},
+				Include: []map[string]string{{"GO": "1.8", "DB": "mongo"}, {"GO": "1.7", "DB": "mongo"}},
+			},
+			[]map[string]string{{"DB": "mongo", "GO": "1.7"}, {"DB": "mongo", "GO": "1.8"}},
+		},
+		{
+			MatrixSpec{Include: []map[string]string{{"GO": "1.8"}}},
+			[]map[string]string{{"GO": "1.8"}},
+		},
+		{
+			MatrixSpec{Vars: map[string][]string{"GO": {"1.6"}, "DB": {}}},
+			[]map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		if combinations := test.matrix.Expand(); !reflect.DeepEqual(combinations, test.combinations) {
+			t.Errorf("Matrix %+v: expected %v, got %v", test.matrix, test.combinations, combinations)
+		}
+	}
+}
+
+func TestMatrixSpecUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		yaml   string
+		matrix MatrixSpec
+		valid  bool
+	}{
+		{
+			"vars: {GO_VERSION: [1.6, 1.7]}\nfailFast: true",
+			MatrixSpec{Vars: map[string][]string{"GO_VERSION": {"1.6", "1.7"}}, FailFast: true},
+			true,
+		},
+		{
+			"GO_VERSION: [1.6, '1.10']\nDB: [mongo]\nexclude: [{GO_VERSION: 1.6}]\ninclude: [{GO_VERSION: 1.8, DB: redis}]",
+			MatrixSpec{
+				Vars:    map[string][]string{"GO_VERSION": {"1.6", "1.10"}, "DB": {"mongo"}},
+				Exclude: []map[string]string{{"GO_VERSION": "1.6"}},
+				Include: []map[string]string{{"GO_VERSION": "1.8", "DB": "redis"}},
+			},
+			true,
+		},
+		{
+			"vars: {GO_VERSION: [1.6]}\nDB: [mongo]",
+			MatrixSpec{Vars: map[string][]string{"GO_VERSION": {"1.6"}, "DB": {"mongo"}}},
+			true,
+		},
+		{"vars: {GO_VERSION: [1.6]}\nGO_VERSION: [1.7]", MatrixSpec{}, false},
+		{"GO_VERSION: {version: 1.6}", MatrixSpec{}, false},
+	}
+	for _, test := range tests {
+		var matrix MatrixSpec
+		err := yaml.Unmarshal([]byte(test.yaml), &matrix)
+		if (err == nil) != test.valid {
+			t.Errorf("Matrix %q: expected valid %t, got error %v", test.yaml, test.valid, err)
+			continue
+		}
+		if test.valid && !reflect.DeepEqual(matrix, test.matrix) {
+			t.Errorf("Matrix %q: expected %+v, got %+v", test.yaml, test.matrix, matrix)
+		}
+	}
+}
+
+func TestMatrixName(t *testing.T) {
+	if name := MatrixName(map[string]string{"GO_VERSION": "1.6", "DB": "mongo"}); name != "DB=mongo, GO_VERSION=1.6" {
+		t.Errorf("Unexpected matrix name: %s", name)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"regexp"
+	"strings"
+)
+
+// PatternsSpec type.
+// List of patterns to match names (e.g. branches or tags). A single pattern is specified as a plain string.
+// A pattern enclosed in slashes (e.g. "/^release-[0-9]+$/") is a regular expression. Otherwise, it is a glob
+// pattern where "*" matches any sequence of characters except "/", "**" matches any sequence of characters,
+// and "?" matches any character except "/".
+type PatternsSpec []string
+
+// UnmarshalYAML to accept both forms of the patterns.
+func (patternsSpec *PatternsSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var pattern string
+	if err := unmarshal(&pattern); err == nil {
+		*patternsSpec = PatternsSpec{pattern}
+		return nil
+	}
+	var patterns []string
+	if err := unmarshal(&patterns); err != nil {
+		return err
+	}
+	*patternsSpec = PatternsSpec(patterns)
+	return nil
+}
+
+// Validate checks that the patterns are valid.
+func (patternsSpec PatternsSpec) Validate() error {
+	for _, pattern := range patternsSpec {
+		if _, err := compilePattern(pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match checks if the name matches any of the patterns. Invalid patterns do not match any name.
+func (patternsSpec PatternsSpec) Match(name string) bool {
+	for _, pattern := range patternsSpec {
+		re, err := compilePattern(pattern)
+		if err == nil && re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLiteralPattern checks if a pattern only matches a name equal to the pattern itself.
+func isLiteralPattern(pattern string) bool {
+	isRegexp := len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+	return pattern != "" && !isRegexp && !strings.ContainsAny(pattern, "*?")
+}
+
+// compilePattern compiles a pattern, either a regular expression or a glob pattern, into a regular expression.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile(pattern[1 : len(pattern)-1])
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				// "**/" also matches no directory at all
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					expr.WriteString("(.*/)?")
+				} else {
+					expr.WriteString(".*")
+				}
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import "testing"
+
+func TestPatternsSpecMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"master", "master", true},
+		{"master", "master2", false},
+		{"release/*", "release/1.0", true},
+		{"release/*", "release/", true},
+		{"release/*", "release/1.0/fix", false},
+		{"release/*", "release", false},
+		{"*", "master", true},
+		{"*", "feature/x", false},
+		{"**", "feature/x/y", true},
+		{"release/**", "release/1.0/fix", true},
+		{"src/**/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/a/b/main.go", true},
+		{"src/**/*.go", "src/main.js", false},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "docs/README.md", true},
+		{"v?.0", "v1.0", true},
+		{"v?.0", "v10.0", false},
+		{"v?", "v/", false},
+		{"v1.0", "v1x0", false},
+		{"feature-(1)", "feature-(1)", true},
+		{"/^hotfix-[0-9]+$/", "hotfix-12", true},
+		{"/^hotfix-[0-9]+$/", "hotfix-x", false},
+		{"/hotfix/", "my-hotfix-branch", true},
+		{"/[/", "[", false},
+		{"/", "/", true},
+		{"", "", true},
+		{"", "master", false},
+	}
+	for _, test := range tests {
+		if match := (PatternsSpec{test.pattern}).Match(test.name); match != test.match {
+			t.Errorf("Pattern '%s' with name '%s': expected %t, got %t", test.pattern, test.name, test.match, match)
+		}
+	}
+}
+
+func TestPatternsSpecMatchAny(t *testing.T) {
+	patterns := PatternsSpec{"master", "release/*", "/^hotfix-/"}
+	for _, name := range []string{"master", "release/1.0", "hotfix-1"} {
+		if !patterns.Match(name) {
+			t.Errorf("Expected '%s' to match %v", name, patterns)
+		}
+	}
+	if patterns.Match("develop") {
+		t.Errorf("Expected 'develop' not to match %v", patterns)
+	}
+	if (PatternsSpec{}).Match("master") {
+		t.Error("Expected no patterns not to match")
+	}
+}
+
+func TestPatternsSpecValidate(t *testing.T) {
+	tests := []struct {
+		patterns PatternsSpec
+		valid    bool
+	}{
+		{PatternsSpec{"master", "release/*", "**"}, true},
+		{PatternsSpec{"/^v[0-9]+$/"}, true},
+		{PatternsSpec{"master", "/[/"}, false},
+		{PatternsSpec{"/(/"}, false},
+	}
+	for _, test := range tests {
+		if err := test.patterns.Validate(); (err == nil) != test.valid {
+			t.Errorf("Patterns %v: expected valid %t, got error %v", test.patterns, test.valid, err)
+		}
+	}
+}
@@ -15,10 +15,15 @@
 package build
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
 
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 
 	"github.com/gocilla/gocilla/managers/github"
 	"github.com/gocilla/gocilla/managers/mongodb"
@@ -26,98 +31,308 @@ import (
 
 // Register type.
 // Manager to register a build and its operations.
+// The context of the build is cancelled with Cancel, and the build is registered with the cancellation status.
+// The builds of the combinations of a matrix build have a parent register, and their own GitHub status context.
+// The log is written to a GridFS file and published in the log broker. It is also stored line by line,
+// segmented by task, in the log store. The values of the secret variables are masked by the Masker before
+// they reach the log, the log store or the GitHub statuses.
 type Register struct {
+	Context        context.Context
 	Database       *mongodb.Database
+	LogBroker      *LogBroker
 	GithubClient   *github.Client
 	Event          *github.Event
 	Trigger        *TriggerSpec
+	Parent         *Register
+	StatusContext  string
 	BuildWriter    *mongodb.BuildWriter
 	BuildLogFile   *mgo.GridFile
 	BuildLogWriter io.Writer
+	BuildLogStore  *LogStore
+	Masker         *Masker
+	logMaskWriter  *MaskWriter
+	logTopic       *LogTopic
+	cancel         context.CancelFunc
+	cancelStatus   string
+	mutex          sync.Mutex
 }
 
 // NewRegister is the constructor for Register.
-func NewRegister(database *mongodb.Database, githubClient *github.Client, event *github.Event, trigger *TriggerSpec) (register *Register, err error) {
-	register = &Register{
-		Database:     database,
-		GithubClient: githubClient,
-		Event:        event,
-		Trigger:      trigger,
+func NewRegister(ctx context.Context, database *mongodb.Database, logBroker *LogBroker, githubClient *github.Client,
+	queueJob *mongodb.QueueJob, event *github.Event, trigger *TriggerSpec, masker *Masker) (*Register, error) {
+	build := newBuild(queueJob, event, trigger)
+	register := &Register{
+		Database:      database,
+		LogBroker:     logBroker,
+		GithubClient:  githubClient,
+		Event:         event,
+		Trigger:       trigger,
+		Masker:        masker,
+		StatusContext: trigger.Pipeline,
 	}
+	return register, register.init(ctx, build)
+}
+
+// newBuild creates the build of a trigger for a GitHub event, without registering it in mongodb.
+func newBuild(queueJob *mongodb.QueueJob, event *github.Event, trigger *TriggerSpec) *mongodb.Build {
+	build := &mongodb.Build{
+		QueueJob:     queueJob.ID,
+		Organization: event.Organization,
+		Repository:   event.Repository,
+		Event:        event.Type,
+		Branch:       event.Branch,
+		Tag:          event.Tag,
+		SHA:          event.CommitSHA(),
+		CloneURL:     event.CloneURL,
+		User:         event.User,
+		Pipeline:     trigger.Pipeline,
+		Schedule:     event.Schedule,
+		EnvVars:      trigger.EnvVars,
+	}
+	if event.Pull != nil {
+		build.PullNumber = event.Pull.Number
+		build.PullFork = event.Pull.Fork
+	}
+	if event.Commit != nil {
+		build.Commit = &mongodb.BuildCommit{
+			Message:    event.Commit.Message,
+			Author:     event.Commit.Author,
+			Email:      event.Commit.Email,
+			CompareURL: event.Commit.CompareURL,
+		}
+	}
+	return build
+}
+
+// NewChild creates the register for the build of a combination of a matrix build.
+// The environment variables of the child build include the matrix variables.
+func (register *Register) NewChild(matrix, envVars map[string]string) (*Register, error) {
+	parentBuild := register.BuildWriter.Build
+	build := &mongodb.Build{
+		QueueJob:     parentBuild.QueueJob,
+		Organization: parentBuild.Organization,
+		Repository:   parentBuild.Repository,
+		Event:        parentBuild.Event,
+		Branch:       parentBuild.Branch,
+		Tag:          parentBuild.Tag,
+		SHA:          parentBuild.SHA,
+		CloneURL:     parentBuild.CloneURL,
+		User:         parentBuild.User,
+		Commit:       parentBuild.Commit,
+		PullNumber:   parentBuild.PullNumber,
+		PullFork:     parentBuild.PullFork,
+		Pipeline:     parentBuild.Pipeline,
+		Schedule:     parentBuild.Schedule,
+		EnvVars:      envVars,
+		Graph:        parentBuild.Graph,
+		Parent:       parentBuild.ID,
+		ParentNumber: parentBuild.Number,
+		Matrix:       matrix,
+	}
+	child := &Register{
+		Database:      register.Database,
+		LogBroker:     register.LogBroker,
+		GithubClient:  register.GithubClient,
+		Event:         register.Event,
+		Trigger:       register.Trigger,
+		Masker:        register.Masker,
+		Parent:        register,
+		StatusContext: fmt.Sprintf("%s (%s)", register.StatusContext, MatrixName(matrix)),
+	}
+	if err := child.init(register.Context, build); err != nil {
+		return child, err
+	}
+	return child, register.BuildWriter.AddChild(build.ID, matrix)
+}
+
+// init creates the build in mongodb and its log file.
+func (register *Register) init(ctx context.Context, build *mongodb.Build) (err error) {
+	register.Context, register.cancel = context.WithCancel(ctx)
 
 	// Create the build writer in mongodb (with info about the executed steps)
-	register.BuildWriter, err = mongodb.NewBuildWriter(
-		database,
-		event.Organization, event.Repository, event.Type, event.Branch,
-		trigger.Pipeline, trigger.EnvVars)
+	register.BuildWriter, err = mongodb.NewBuildWriter(register.Database, build)
 	if err != nil {
 		err = fmt.Errorf("Error creating build writer. %s", err)
 		return
 	}
-	buildID := register.BuildWriter.Build.ID.Hex()
 
 	// Write logs to a mongodb gridfs file and to console
-	buildLogFileName := fmt.Sprintf("/%s/%s/%s", event.Organization, event.Repository, buildID)
-	register.BuildLogFile, err = database.CreateFile(buildLogFileName)
+	buildLogFileName := build.LogFileName()
+	register.BuildLogFile, err = register.Database.CreateFile(buildLogFileName)
 	if err != nil {
 		err = fmt.Errorf("Error creating build mongo log file: %s. %s", buildLogFileName, err)
 		register.End(err)
 		return
 	}
-	register.BuildLogWriter = io.MultiWriter(register.BuildLogFile)
+	register.BuildLogFile.SetChunkSize(logChunkSize)
+	if logFileID, ok := register.BuildLogFile.Id().(bson.ObjectId); ok {
+		build.LogFile = logFileID
+		register.Database.UpdateBuildLogFile(build.ID, logFileID)
+	}
+	register.logTopic = register.LogBroker.Open(build.ID)
+	register.logMaskWriter = NewMaskWriter(io.MultiWriter(register.BuildLogFile, register.logTopic), register.Masker)
+	register.BuildLogWriter = NewSyncWriter(register.logMaskWriter)
+	register.BuildLogStore = NewLogStore(register.Database, build, register.Masker)
+	register.createStatus(register.StatusContext, "Build in progress", "pending")
 	return
 }
 
+// Cancel the build. The status (e.g. "cancelled") is registered for the build and for the task in progress.
+func (register *Register) Cancel(status string) {
+	register.mutex.Lock()
+	if register.cancelStatus == "" {
+		register.cancelStatus = status
+	}
+	register.mutex.Unlock()
+	register.cancel()
+}
+
 // End logs the end of a pipeline build and closes the shared resources.
 func (register *Register) End(err error) {
+	defer register.cancel()
+	status, error := register.statusFromError(err)
+	error = register.Masker.Mask(error)
 	if register.BuildWriter != nil {
-		status, error := statusFromError(err)
 		register.BuildWriter.EndBuild(status, error)
 	}
+	description := "Build completed successfully"
+	if err != nil {
+		description = error
+	}
+	register.createStatus(register.StatusContext, description, status)
+	if register.Parent != nil && register.BuildWriter != nil {
+		register.Parent.BuildWriter.EndChild(register.BuildWriter.Build.ID, status)
+	}
+	if register.BuildLogStore != nil {
+		register.BuildLogStore.Close()
+	}
+	if register.logMaskWriter != nil {
+		register.logMaskWriter.Flush()
+	}
 	if register.BuildLogFile != nil {
 		register.BuildLogFile.Close()
 	}
+	if register.logTopic != nil {
+		register.logTopic.Close()
+	}
 }
 
-// StartTask logs the start of a pipeline task.
-func (register *Register) StartTask(task, command string) {
+// StartTask logs the start of a pipeline task in a stage of the pipeline.
+// It returns the identifier of the task, required to end it.
+func (register *Register) StartTask(stage int, task, command string) (taskID int) {
+	command = register.Masker.Mask(command)
 	logString := fmt.Sprintf("Starting task '%s' with command '%s'\n", task, command)
-	io.WriteString(register.BuildLogWriter, logString)
+	register.logTask(task, logString)
 
 	if register.BuildWriter != nil {
-		register.BuildWriter.StartBuildTask(task, command)
+		taskID, _ = register.BuildWriter.StartBuildTask(stage, task, command)
 	}
-	if register.Event.Type == github.EventTypePull && register.GithubClient != nil {
-		register.GithubClient.CreateStatus(
-			register.Event.Organization, register.Event.Repository, register.Event.Pull.HeadSHA,
-			task, command, "pending")
+	register.createStatus(register.taskStatusContext(task), command, "pending")
+	return
+}
+
+// SkipTask logs a pipeline task that is not executed.
+func (register *Register) SkipTask(stage int, task, command, reason string) {
+	command = register.Masker.Mask(command)
+	logString := fmt.Sprintf("Skipped task '%s'. %s\n", task, reason)
+	register.logTask(task, logString)
+
+	if register.BuildWriter != nil {
+		register.BuildWriter.SkipBuildTask(stage, task, command, reason)
 	}
 }
 
-// EndTask logs the start of a pipeline task.
-func (register *Register) EndTask(task, command string, err error) {
-	status, error := statusFromError(err)
+// EndTask logs the end of a pipeline task.
+func (register *Register) EndTask(taskID int, task, command string, err error) {
+	command = register.Masker.Mask(command)
+	status, error := register.statusFromError(err)
+	error = register.Masker.Mask(error)
 
 	logString := fmt.Sprintf("Ended task '%s' with status '%s'. %s\n", task, status, error)
-	io.WriteString(register.BuildLogWriter, logString)
+	register.logTask(task, logString)
 
 	if register.BuildWriter != nil {
-		register.BuildWriter.EndBuildTask(status, error)
+		register.BuildWriter.EndBuildTask(taskID, status, error)
+	}
+	description := command
+	if err != nil {
+		description = error
+	}
+	register.createStatus(register.taskStatusContext(task), description, status)
+}
+
+// TaskLogWriters gets the writers of the stdout and stderr streams of a task. The output of every stream is written
+// to its own writer (stdoutWriter or stderrWriter), which is either the build log writer or a writer wrapping it.
+// The writers must be flushed when the task ends.
+func (register *Register) TaskLogWriters(task string, stdoutWriter, stderrWriter io.Writer) (stdout, stderr *TaskLogWriter) {
+	stdout = NewTaskLogWriter(stdoutWriter, register.BuildLogStore, task, "stdout")
+	stderr = NewTaskLogWriter(stderrWriter, register.BuildLogStore, task, "stderr")
+	return
+}
+
+// logTask writes a message about a task to the build log, and stores it as a system line of the task.
+func (register *Register) logTask(task, message string) {
+	io.WriteString(register.BuildLogWriter, message)
+	if register.BuildLogStore != nil {
+		register.BuildLogStore.Add(task, "system", strings.TrimSuffix(message, "\n"))
 	}
+}
+
+// taskStatusContext gets the GitHub status context of a task.
+// The tasks of a matrix combination are prefixed with the status context of the combination.
+func (register *Register) taskStatusContext(task string) string {
+	if register.Parent == nil {
+		return task
+	}
+	return register.StatusContext + " / " + task
+}
+
+// getCancelStatus gets the cancellation status of the build, or of its parent build.
+func (register *Register) getCancelStatus() string {
+	register.mutex.Lock()
+	cancelStatus := register.cancelStatus
+	register.mutex.Unlock()
+	if cancelStatus == "" && register.Parent != nil {
+		return register.Parent.getCancelStatus()
+	}
+	return cancelStatus
+}
+
+// createStatus creates a GitHub status for the pull request being built.
+// The description is prefixed with the build number.
+func (register *Register) createStatus(context, description, status string) {
 	if register.Event.Type == github.EventTypePull && register.GithubClient != nil {
-		description := command
-		if err != nil {
-			description = error
+		if register.BuildWriter != nil && register.BuildWriter.Build.DisplayNumber() > 0 {
+			description = fmt.Sprintf("#%d %s", register.BuildWriter.Build.DisplayNumber(), description)
 		}
 		register.GithubClient.CreateStatus(
 			register.Event.Organization, register.Event.Repository, register.Event.Pull.HeadSHA,
-			task, description, status)
+			context, description, githubState(status))
 	}
 }
 
-func statusFromError(err error) (status, error string) {
+// statusFromError gets the status of a build (or task) from its error.
+// Any error after the build is cancelled is a consequence of the cancellation.
+func (register *Register) statusFromError(err error) (status, error string) {
 	if err == nil {
 		return "success", ""
 	}
+	if cancelStatus := register.getCancelStatus(); cancelStatus != "" {
+		return cancelStatus, "Build " + cancelStatus
+	}
+	var timeoutError *TimeoutError
+	if errors.As(err, &timeoutError) {
+		return "timeout", timeoutError.Error()
+	}
 	return "error", err.Error()
 }
+
+// githubState maps a build status into a GitHub status state (pending, success, failure or error).
+func githubState(status string) string {
+	switch status {
+	case "pending", "success", "failure":
+		return status
+	default:
+		return "error"
+	}
+}
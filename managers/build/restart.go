@@ -0,0 +1,78 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+
+	"github.com/gocilla/gocilla/managers/github"
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+// RestartEvent gets the event to build again the pipeline of a build, for the same SHA.
+// The path filters of the triggers are not applied because the files changed are not stored in the build.
+// The builds of a pull request are built again for the head SHA that was built, not for the current one.
+func RestartEvent(build *mongodb.Build, user string) *github.Event {
+	event := &github.Event{
+		Type:         build.Event,
+		Branch:       build.Branch,
+		Tag:          build.Tag,
+		Schedule:     build.Schedule,
+		Organization: build.Organization,
+		Repository:   build.Repository,
+		CloneURL:     build.CloneURL,
+		SHA:          build.SHA,
+		User:         user,
+		Pipeline:     build.Pipeline,
+		Restart:      true,
+	}
+	if build.Event == github.EventTypeManual {
+		event.EnvVars = build.EnvVars
+		if len(build.Matrix) > 0 {
+			event.EnvVars = make(map[string]string)
+			for name, value := range build.EnvVars {
+				if _, ok := build.Matrix[name]; !ok {
+					event.EnvVars[name] = value
+				}
+			}
+		}
+	}
+	if build.Commit != nil {
+		event.Commit = &github.EventCommit{
+			Message:    build.Commit.Message,
+			Author:     build.Commit.Author,
+			Email:      build.Commit.Email,
+			CompareURL: build.Commit.CompareURL,
+		}
+	}
+	if build.PullNumber > 0 {
+		event.Pull = &github.EventPull{Number: build.PullNumber, HeadSHA: build.SHA, Fork: build.PullFork}
+	}
+	return event
+}
+
+// ValidateManualEvent checks that the pipeline of a manual event exists in the build spec of the SHA.
+func (buildManager *Manager) ValidateManualEvent(githubClient *github.Client, event *github.Event) error {
+	buildSpec, err := buildManager.GetSpec(githubClient, event)
+	if err != nil {
+		return fmt.Errorf("Error getting the project specification. %s", err)
+	}
+	for _, pipeline := range buildSpec.Pipelines {
+		if pipeline.Name == event.Pipeline {
+			return nil
+		}
+	}
+	return fmt.Errorf("No pipeline '%s' in the project specification", event.Pipeline)
+}
@@ -0,0 +1,191 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gocilla/gocilla/managers/docker"
+)
+
+// serviceNameRegexp is the format of the service names, used as host names in the network of the build.
+var serviceNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+// dindService is the name of the Docker-in-Docker sidecar, and dindHost the DOCKER_HOST of the build containers to use it.
+const (
+	dindService = "docker"
+	dindHost    = "tcp://docker:2375"
+)
+
+// Services type.
+// Service containers of a build, connected to a private network of the build together with the build containers.
+// The output of every service is written to the build log, prefixed with "service {name}", until the service is stopped.
+type Services struct {
+	dockerManager *docker.Manager
+	Network       string
+	containers    []*docker.ContainerManager
+	writers       []*PrefixWriter
+	taskWriters   []*TaskLogWriter
+	cancelLogs    context.CancelFunc
+	logs          sync.WaitGroup
+}
+
+// ValidateServices checks that the services of the build spec have a valid and unique name, and an image.
+// With the Docker-in-Docker sidecar, the name of the sidecar is reserved.
+func ValidateServices(services []ServiceSpec, dockerAccess string) error {
+	names := map[string]bool{dindService: dockerAccess == docker.DockerAccessDinD}
+	for _, service := range services {
+		if !serviceNameRegexp.MatchString(service.Name) {
+			return fmt.Errorf("Invalid service name: '%s'", service.Name)
+		}
+		if names[service.Name] {
+			return fmt.Errorf("Duplicated service: %s", service.Name)
+		}
+		names[service.Name] = true
+		if service.Image == "" {
+			return fmt.Errorf("No image for service: %s", service.Name)
+		}
+	}
+	return nil
+}
+
+// GetServiceConfigs gets the configuration of the service containers of the build: the Docker-in-Docker sidecar
+// (if the repository uses it) and the services of the build spec.
+func (containerBuildManager *ContainerManager) GetServiceConfigs() ([]*docker.ServiceConfig, error) {
+	serviceSpecs := containerBuildManager.buildSpec.Services
+	if err := ValidateServices(serviceSpecs, containerBuildManager.dockerAccess); err != nil {
+		return nil, err
+	}
+	var serviceConfigs []*docker.ServiceConfig
+	if containerBuildManager.dockerAccess == docker.DockerAccessDinD {
+		serviceConfigs = append(serviceConfigs, &docker.ServiceConfig{
+			Name:           dindService,
+			Image:          containerBuildManager.dockerManager.DockerAccess.GetDinDImage(),
+			EnvVars:        map[string]string{"DOCKER_TLS_CERTDIR": ""},
+			Privileged:     true,
+			HealthCheck:    "docker info",
+			HealthInterval: time.Second,
+			HealthRetries:  60,
+			Limits:         containerBuildManager.limits,
+		})
+	}
+	for _, serviceSpec := range serviceSpecs {
+		serviceConfig := &docker.ServiceConfig{
+			Name:    serviceSpec.Name,
+			Image:   serviceSpec.Image,
+			EnvVars: serviceSpec.EnvVars,
+			Command: serviceSpec.Command,
+			Limits:  containerBuildManager.limits,
+		}
+		if healthCheck := serviceSpec.HealthCheck; healthCheck != nil {
+			serviceConfig.HealthCheck = healthCheck.Command
+			serviceConfig.HealthInterval = healthCheck.Interval
+			serviceConfig.HealthTimeout = healthCheck.Timeout
+			serviceConfig.HealthRetries = healthCheck.Retries
+		}
+		serviceConfigs = append(serviceConfigs, serviceConfig)
+	}
+	return serviceConfigs, nil
+}
+
+// StartServices creates the network of the build and starts the service containers (see GetServiceConfigs),
+// waiting until they are healthy. If any service fails, the services already started and the network are removed.
+// It returns nil if the build has no services.
+func (containerBuildManager *ContainerManager) StartServices() (services *Services, err error) {
+	serviceConfigs, err := containerBuildManager.GetServiceConfigs()
+	if err != nil || len(serviceConfigs) == 0 {
+		return nil, err
+	}
+	buildRegister := containerBuildManager.buildRegister
+	dockerManager := containerBuildManager.dockerManager
+	network := "gocilla-" + buildRegister.BuildWriter.Build.ID.Hex()
+	networkID, err := dockerManager.CreateNetwork(network)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating the network of the build. %s", err)
+	}
+	logsCtx, cancelLogs := context.WithCancel(context.Background())
+	services = &Services{
+		dockerManager: dockerManager,
+		Network:       networkID,
+		cancelLogs:    cancelLogs,
+	}
+	defer func() {
+		if err != nil {
+			services.Stop()
+			services = nil
+		}
+	}()
+
+	for _, serviceConfig := range serviceConfigs {
+		task := "service " + serviceConfig.Name
+		// Every stream has its own prefix writer, so that their lines are not mixed
+		stdoutWriter := NewPrefixWriter(buildRegister.BuildLogWriter, task)
+		stderrWriter := NewPrefixWriter(buildRegister.BuildLogWriter, task)
+		stdout, stderr := buildRegister.TaskLogWriters(task, stdoutWriter, stderrWriter)
+		services.writers = append(services.writers, stdoutWriter, stderrWriter)
+		services.taskWriters = append(services.taskWriters, stdout, stderr)
+
+		buildRegister.logTask(task, fmt.Sprintf("Starting service '%s' with image '%s'\n", serviceConfig.Name, serviceConfig.Image))
+		if err := dockerManager.PullImage(containerBuildManager.ctx, serviceConfig.Image, stdout); err != nil {
+			return services, fmt.Errorf("Error pulling the image of service: %s. %w", serviceConfig.Name, containerBuildManager.pipelineError(err))
+		}
+		containerManager, err := dockerManager.StartService(containerBuildManager.ctx, networkID, serviceConfig)
+		if err != nil {
+			return services, fmt.Errorf("Error starting service: %s. %w", serviceConfig.Name, containerBuildManager.pipelineError(err))
+		}
+		services.containers = append(services.containers, containerManager)
+		services.logs.Add(1)
+		go func(name string) {
+			defer services.logs.Done()
+			if err := containerManager.FollowLogs(logsCtx, stdout, stderr); err != nil && logsCtx.Err() == nil {
+				log.Printf("Error following the logs of service '%s'. %s", name, err)
+			}
+		}(serviceConfig.Name)
+	}
+
+	for i, containerManager := range services.containers {
+		name := serviceConfigs[i].Name
+		if err := containerManager.WaitHealthy(containerBuildManager.ctx); err != nil {
+			return services, fmt.Errorf("Error waiting for service: %s. %w", name, containerBuildManager.pipelineError(err))
+		}
+		buildRegister.logTask("service "+name, fmt.Sprintf("Service '%s' ready\n", name))
+	}
+	return services, nil
+}
+
+// Stop removes the service containers and the network of the build. The logs of the services are flushed.
+func (services *Services) Stop() {
+	for _, containerManager := range services.containers {
+		if err := containerManager.RemoveContainer(); err != nil {
+			log.Println("Error removing the container of a service", err)
+		}
+	}
+	services.cancelLogs()
+	services.logs.Wait()
+	for _, taskWriter := range services.taskWriters {
+		taskWriter.Flush()
+	}
+	for _, w := range services.writers {
+		w.Flush()
+	}
+	if err := services.dockerManager.RemoveNetwork(services.Network); err != nil {
+		log.Println("Error removing the network of the build", err)
+	}
+}
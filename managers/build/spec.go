@@ -0,0 +1,369 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gocilla/gocilla/managers/cron"
+	"github.com/gocilla/gocilla/managers/docker"
+	"github.com/gocilla/gocilla/managers/github"
+)
+
+// Spec type.
+// Build specification of a repository (.gocilla.yml).
+// Timeout is the default timeout of the pipelines (0 means no timeout).
+// Secrets are the names of the environment variables (e.g. of the triggers) whose values are masked in the build log.
+// ArtifactsRetention is the time the artifacts of the jobs are kept (defaultArtifactsRetention if 0).
+// Caches are the directories restored before the first job and saved after a successful pipeline.
+type Spec struct {
+	Docker             DockerSpec
+	Jobs               map[string]JobSpec
+	Pipelines          []PipelineSpec
+	Triggers           []TriggerSpec
+	Timeout            time.Duration
+	Secrets            []string
+	ArtifactsRetention time.Duration `json:"artifactsRetention" yaml:"artifactsRetention"`
+	Caches             []CacheSpec
+	Services           []ServiceSpec
+}
+
+// DockerSpec type.
+// Resources override the default resources of the build and service containers, up to the maximums of the
+// configuration. Security adds capabilities to drop, or no-new-privileges, to the security options of the configuration.
+type DockerSpec struct {
+	File       string
+	User       string
+	WorkingDir string `json:"workingDir" yaml:"workingDir"`
+	Resources  *docker.Resources
+	Security   *docker.SecurityConfig
+}
+
+// CacheSpec type.
+// Directories (relative to the working directory, or absolute) saved together as a cache. The Key is a
+// text/template (e.g. "go-{{checksum \"Gopkg.lock\"}}") with the Branch, Event, Pipeline and Matrix of the
+// build, and the function checksum to hash the content of some files of the repository.
+type CacheSpec struct {
+	Key   string
+	Paths []string
+}
+
+// ServiceSpec type.
+// Container (e.g. a database) started before the build containers and reachable from them with the service Name
+// as host name. The build waits until the service is healthy (see HealthCheckSpec).
+type ServiceSpec struct {
+	Name        string
+	Image       string
+	EnvVars     map[string]string `json:"envVars" yaml:"envVars"`
+	Command     []string
+	HealthCheck *HealthCheckSpec `json:"healthCheck" yaml:"healthCheck"`
+}
+
+// HealthCheckSpec type.
+// Shell command executed in the service container to check if it is ready. Without a health check,
+// the service is ready once it is running, unless its image defines its own health check.
+type HealthCheckSpec struct {
+	Command  string
+	Interval time.Duration
+	Timeout  time.Duration
+	Retries  int
+}
+
+// JobSpec type.
+// A job is specified either with its command (plain string) or with an object
+// including the command, the timeout of the job (e.g. "10m"), the jobs it needs and the artifacts it produces.
+// Artifacts are patterns of the paths (relative to the working directory) of the files stored after the job,
+// even if it fails. A pattern matching a directory stores all its files.
+type JobSpec struct {
+	Command   string
+	Timeout   time.Duration
+	Needs     []string
+	Artifacts PatternsSpec
+}
+
+// UnmarshalYAML to accept both forms of a job.
+func (jobSpec *JobSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var command string
+	if err := unmarshal(&command); err == nil {
+		jobSpec.Command = command
+		return nil
+	}
+	var spec struct {
+		Command   string
+		Timeout   time.Duration
+		Needs     []string
+		Artifacts PatternsSpec
+	}
+	if err := unmarshal(&spec); err != nil {
+		return err
+	}
+	jobSpec.Command = spec.Command
+	jobSpec.Timeout = spec.Timeout
+	jobSpec.Needs = spec.Needs
+	jobSpec.Artifacts = spec.Artifacts
+	return nil
+}
+
+// PipelineSpec type.
+// The pipeline is a sequence of stages. A stage is either a job or a list of jobs executed concurrently.
+// If any job of the pipeline needs other jobs, the stages are ignored and the jobs are executed
+// as a dependency graph with up to Concurrency jobs at the same time.
+// Timeout overrides the default timeout of the build spec for this pipeline.
+type PipelineSpec struct {
+	Name        string
+	Jobs        []StageSpec
+	Timeout     time.Duration
+	Concurrency int
+	Matrix      *MatrixSpec
+}
+
+// MatrixSpec type.
+// The pipeline is executed once for every combination of the values of the matrix variables.
+// Combinations matching an Exclude entry are discarded, and every Include entry is an extra combination.
+// If FailFast is set, the failure of a combination cancels the others.
+type MatrixSpec struct {
+	Vars     map[string][]string
+	Exclude  []map[string]string
+	Include  []map[string]string
+	FailFast bool `json:"failFast" yaml:"failFast"`
+}
+
+// UnmarshalYAML to accept both forms of a matrix: the variables may be listed in vars, or directly in the matrix
+// (e.g. "matrix: {GO_VERSION: [1.6, 1.7]}"), where every key but exclude, include and failFast is a variable.
+func (matrixSpec *MatrixSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var spec struct {
+		Vars     map[string][]string
+		Exclude  []map[string]string
+		Include  []map[string]string
+		FailFast bool `yaml:"failFast"`
+	}
+	if err := unmarshal(&spec); err != nil {
+		return err
+	}
+	var vars map[string]matrixValuesSpec
+	if err := unmarshal(&vars); err != nil {
+		return err
+	}
+	for name, values := range vars {
+		switch name {
+		case "vars", "exclude", "include", "failFast":
+			continue
+		}
+		if values.invalid {
+			return fmt.Errorf("Invalid values of matrix variable '%s'", name)
+		}
+		if _, ok := spec.Vars[name]; ok {
+			return fmt.Errorf("Duplicated matrix variable '%s'", name)
+		}
+		if spec.Vars == nil {
+			spec.Vars = make(map[string][]string)
+		}
+		spec.Vars[name] = values.values
+	}
+	*matrixSpec = MatrixSpec{Vars: spec.Vars, Exclude: spec.Exclude, Include: spec.Include, FailFast: spec.FailFast}
+	return nil
+}
+
+// matrixValuesSpec type.
+// Values of a variable in the flat form of a matrix. It is invalid if the values are not a list of strings
+// (e.g. the exclude entries), so that the other keys of the matrix are not rejected.
+type matrixValuesSpec struct {
+	values  []string
+	invalid bool
+}
+
+// UnmarshalYAML to accept any value, marking it invalid if it is not a list of strings.
+func (matrixValues *matrixValuesSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&matrixValues.values); err != nil {
+		matrixValues.invalid = true
+	}
+	return nil
+}
+
+// StageSpec type.
+// List of jobs executed concurrently. A stage with a single job is specified as a plain string.
+type StageSpec []string
+
+// UnmarshalYAML to accept both forms of a stage.
+func (stageSpec *StageSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var job string
+	if err := unmarshal(&job); err == nil {
+		*stageSpec = StageSpec{job}
+		return nil
+	}
+	var jobs []string
+	if err := unmarshal(&jobs); err != nil {
+		return err
+	}
+	*stageSpec = StageSpec(jobs)
+	return nil
+}
+
+// TriggerSpec type.
+// The trigger matches the events of its type whose branch matches any of the Branch patterns (any branch if empty)
+// and none of the BranchesIgnore patterns. Tag events must also match the Tag and TagsIgnore patterns with the tag name.
+// Paths and PathsIgnore filter the triggers of push and pull events by the files changed (see MatchFiles).
+// Triggers of schedule events build the head of Branch (the default branch if empty) according to the
+// Schedule cron expression, evaluated in UTC.
+// If CancelSuperseded is set, a new build cancels the older builds of the same branch or pull request.
+type TriggerSpec struct {
+	Name             string
+	Event            string
+	Branch           PatternsSpec
+	BranchesIgnore   PatternsSpec `json:"branchesIgnore" yaml:"branchesIgnore"`
+	Tag              PatternsSpec
+	TagsIgnore       PatternsSpec `json:"tagsIgnore" yaml:"tagsIgnore"`
+	Paths            PatternsSpec
+	PathsIgnore      PatternsSpec `json:"pathsIgnore" yaml:"pathsIgnore"`
+	Schedule         string
+	Pipeline         string
+	EnvVars          map[string]string `json:"envVars" yaml:"envVars"`
+	CancelSuperseded bool              `json:"cancelSuperseded" yaml:"cancelSuperseded"`
+}
+
+// Validate checks that the patterns of the trigger are valid.
+func (triggerSpec *TriggerSpec) Validate() error {
+	for _, patterns := range []PatternsSpec{triggerSpec.Branch, triggerSpec.BranchesIgnore, triggerSpec.Tag, triggerSpec.TagsIgnore,
+		triggerSpec.Paths, triggerSpec.PathsIgnore} {
+		if err := patterns.Validate(); err != nil {
+			return fmt.Errorf("Invalid pattern in trigger '%s'. %s", triggerSpec.Name, err)
+		}
+	}
+	if triggerSpec.Event == github.EventTypeSchedule {
+		if triggerSpec.Name == "" {
+			return fmt.Errorf("Scheduled trigger without name")
+		}
+		if _, err := cron.Parse(triggerSpec.Schedule); err != nil {
+			return fmt.Errorf("Invalid schedule in trigger '%s'. %s", triggerSpec.Name, err)
+		}
+		if len(triggerSpec.Branch) > 1 || (len(triggerSpec.Branch) == 1 && !isLiteralPattern(triggerSpec.Branch[0])) {
+			return fmt.Errorf("Scheduled trigger '%s' must build a single branch, not a pattern", triggerSpec.Name)
+		}
+	}
+	return nil
+}
+
+// GetScheduleBranch gets the branch built by a scheduled trigger. It is empty for the default branch.
+func (triggerSpec *TriggerSpec) GetScheduleBranch() string {
+	if len(triggerSpec.Branch) > 0 {
+		return triggerSpec.Branch[0]
+	}
+	return ""
+}
+
+// Match checks if the trigger matches the GitHub event.
+func (triggerSpec *TriggerSpec) Match(event *github.Event) bool {
+	if triggerSpec.Event != event.Type {
+		return false
+	}
+	// A schedule event is launched for a single trigger
+	if event.Type == github.EventTypeSchedule {
+		return triggerSpec.Name == event.Schedule
+	}
+	if len(triggerSpec.Branch) > 0 && !triggerSpec.Branch.Match(event.Branch) {
+		return false
+	}
+	if triggerSpec.BranchesIgnore.Match(event.Branch) {
+		return false
+	}
+	if event.Type == github.EventTypeTag {
+		if len(triggerSpec.Tag) > 0 && !triggerSpec.Tag.Match(event.Tag) {
+			return false
+		}
+		if triggerSpec.TagsIgnore.Match(event.Tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// HasPathFilters checks if the trigger filters the events by the files changed.
+func (triggerSpec *TriggerSpec) HasPathFilters() bool {
+	return len(triggerSpec.Paths) > 0 || len(triggerSpec.PathsIgnore) > 0
+}
+
+// MatchFiles checks if the files changed by an event match the path filters of the trigger.
+// With Paths, any file must match them. With PathsIgnore, any file must not match them.
+// If the files do not match, it returns the reason.
+func (triggerSpec *TriggerSpec) MatchFiles(files []string) (bool, string) {
+	if len(triggerSpec.Paths) > 0 {
+		matches := false
+		for _, file := range files {
+			if triggerSpec.Paths.Match(file) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return false, fmt.Sprintf("No changed files matching the paths: %s", strings.Join(triggerSpec.Paths, ", "))
+		}
+	}
+	if len(triggerSpec.PathsIgnore) > 0 && len(files) > 0 {
+		for _, file := range files {
+			if !triggerSpec.PathsIgnore.Match(file) {
+				return true, ""
+			}
+		}
+		return false, fmt.Sprintf("All changed files match the ignored paths: %s", strings.Join(triggerSpec.PathsIgnore, ", "))
+	}
+	return true, ""
+}
+
+// GetTimeout gets the timeout of the pipeline (0 means no timeout).
+func (pipelineSpec *PipelineSpec) GetTimeout(buildSpec *Spec) time.Duration {
+	if pipelineSpec.Timeout > 0 {
+		return pipelineSpec.Timeout
+	}
+	return buildSpec.Timeout
+}
+
+// Validate checks that the jobs of the pipeline are specified, and that the docker resources are valid.
+func (pipelineSpec *PipelineSpec) Validate(buildSpec *Spec) error {
+	if resources := buildSpec.Docker.Resources; resources != nil {
+		if err := resources.Validate(); err != nil {
+			return fmt.Errorf("Invalid docker resources. %s", err)
+		}
+	}
+	for _, stage := range pipelineSpec.Jobs {
+		for _, job := range stage {
+			if _, ok := buildSpec.Jobs[job]; !ok {
+				return fmt.Errorf("Unknown job '%s' in pipeline '%s'", job, pipelineSpec.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// IsGraph checks if the jobs of the pipeline are executed as a dependency graph.
+func (pipelineSpec *PipelineSpec) IsGraph(buildSpec *Spec) bool {
+	for _, stage := range pipelineSpec.Jobs {
+		for _, job := range stage {
+			if len(buildSpec.Jobs[job].Needs) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetConcurrency gets the maximum number of jobs executed concurrently in a dependency graph.
+func (pipelineSpec *PipelineSpec) GetConcurrency() int {
+	if pipelineSpec.Concurrency > 0 {
+		return pipelineSpec.Concurrency
+	}
+	return defaultConcurrency
+}
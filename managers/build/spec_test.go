@@ -0,0 +1,43 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"github.com/gocilla/gocilla/managers/github"
+)
+
+func TestTriggerSpecValidateSchedule(t *testing.T) {
+	tests := []struct {
+		branch PatternsSpec
+		valid  bool
+	}{
+		{nil, true},
+		{PatternsSpec{"master"}, true},
+		{PatternsSpec{"release/1.0"}, true},
+		{PatternsSpec{"release/*"}, false},
+		{PatternsSpec{"v?"}, false},
+		{PatternsSpec{"/^master$/"}, false},
+		{PatternsSpec{"master", "develop"}, false},
+		{PatternsSpec{""}, false},
+	}
+	for _, test := range tests {
+		triggerSpec := &TriggerSpec{Name: "nightly", Event: github.EventTypeSchedule, Schedule: "0 2 * * *", Branch: test.branch}
+		if err := triggerSpec.Validate(); (err == nil) != test.valid {
+			t.Errorf("Scheduled trigger with branch %v: expected valid %t, got error %v", test.branch, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+// logChunkSize is the size of the GridFS chunks of the build logs. Small chunks reduce the delay
+// to stream the log of a build running in another server instance.
+const logChunkSize = 16 * 1024
+
+// logPollInterval is the period to poll the GridFS chunks of the log of a build running in another server instance.
+const logPollInterval = time.Second
+
+// logKeepAliveInterval is the maximum time without sending anything to the subscriber of a log.
+const logKeepAliveInterval = 15 * time.Second
+
+// logEndedPolls is the number of polls to wait for the log file of an ended build to be closed.
+const logEndedPolls = 5
+
+// logTopicTail is the size of the tail of the log kept in memory for a build running in this server instance.
+// It is greater than logChunkSize, so the older part of the log is already stored in GridFS chunks.
+const logTopicTail = 64 * logChunkSize
+
+// LogBroker type.
+// Broker to stream the logs of the builds running in this server instance.
+type LogBroker struct {
+	topics map[bson.ObjectId]*LogTopic
+	mutex  sync.Mutex
+}
+
+// NewLogBroker is the constructor of LogBroker.
+func NewLogBroker() *LogBroker {
+	return &LogBroker{topics: make(map[bson.ObjectId]*LogTopic)}
+}
+
+// Open the topic of the log of a build.
+func (logBroker *LogBroker) Open(id bson.ObjectId) *LogTopic {
+	topic := &LogTopic{broker: logBroker, id: id, changed: make(chan struct{})}
+	logBroker.mutex.Lock()
+	logBroker.topics[id] = topic
+	logBroker.mutex.Unlock()
+	return topic
+}
+
+// Get the topic of the log of a build. It is nil if the build is not running in this server instance.
+func (logBroker *LogBroker) Get(id bson.ObjectId) *LogTopic {
+	logBroker.mutex.Lock()
+	defer logBroker.mutex.Unlock()
+	return logBroker.topics[id]
+}
+
+// LogTopic type.
+// Log of a build running in this server instance. Only the tail of the log (from the offset start) is kept
+// in memory, and the subscribers read the older part from the GridFS chunks of the log. The channel changed
+// is closed (and replaced) every time the log is written, to notify the subscribers.
+type LogTopic struct {
+	broker  *LogBroker
+	id      bson.ObjectId
+	data    []byte
+	start   int64
+	closed  bool
+	changed chan struct{}
+	mutex   sync.Mutex
+}
+
+// Write the log and notify the subscribers.
+func (logTopic *LogTopic) Write(p []byte) (int, error) {
+	logTopic.mutex.Lock()
+	defer logTopic.mutex.Unlock()
+	if logTopic.closed {
+		return 0, io.ErrClosedPipe
+	}
+	logTopic.data = append(logTopic.data, p...)
+	// The tail is trimmed once it exceeds logTopicTail by a chunk, to avoid copying it on every write
+	if excess := len(logTopic.data) - logTopicTail; excess > logChunkSize {
+		logTopic.data = append([]byte(nil), logTopic.data[excess:]...)
+		logTopic.start += int64(excess)
+	}
+	close(logTopic.changed)
+	logTopic.changed = make(chan struct{})
+	return len(p), nil
+}
+
+// Close the topic when the build ends. The subscribers still read the log, but new subscribers
+// are not served by the broker.
+func (logTopic *LogTopic) Close() {
+	logTopic.broker.mutex.Lock()
+	delete(logTopic.broker.topics, logTopic.id)
+	logTopic.broker.mutex.Unlock()
+
+	logTopic.mutex.Lock()
+	defer logTopic.mutex.Unlock()
+	if !logTopic.closed {
+		logTopic.closed = true
+		close(logTopic.changed)
+	}
+}
+
+// Read the log from an offset. It returns the offset of the tail kept in memory (no data is returned if
+// the offset is older), a channel closed when the log is written again, and whether the topic is closed
+// (i.e. the log is complete).
+func (logTopic *LogTopic) Read(offset int64) ([]byte, int64, <-chan struct{}, bool) {
+	logTopic.mutex.Lock()
+	defer logTopic.mutex.Unlock()
+	var data []byte
+	if offset >= logTopic.start && offset < logTopic.start+int64(len(logTopic.data)) {
+		data = append(data, logTopic.data[offset-logTopic.start:]...)
+	}
+	return data, logTopic.start, logTopic.changed, logTopic.closed
+}
+
+// LogSender is a function to send a fragment of a log starting at an offset.
+// It is invoked without data to keep alive the connection with the subscriber.
+type LogSender func(data []byte, offset int64) error
+
+// StreamLog sends the log of a build, from an offset, as it is written until the build ends or the context is done.
+// The log of a build running in this server instance is streamed from the log broker. The log of a build
+// running in another server instance is streamed polling its GridFS chunks. The log of an ended build
+// is read from its GridFS file.
+func (buildManager *Manager) StreamLog(ctx context.Context, build *mongodb.Build, offset int64, send LogSender) error {
+	if topic := buildManager.LogBroker.Get(build.ID); topic != nil {
+		return buildManager.streamTopic(ctx, build, topic, offset, send)
+	}
+
+	endedPolls := 0
+	for {
+		current, err := buildManager.Database.GetBuild(build.Organization, build.Repository, build.ID)
+		if err != nil {
+			return err
+		}
+		if current.End != nil {
+			sent, err := buildManager.sendLogFile(&current, offset, send)
+			if err != mgo.ErrNotFound {
+				return err
+			}
+			// Builds without log (e.g. skipped builds)
+			if current.LogFile == "" {
+				return nil
+			}
+			// The log file is not closed yet, or it will never be (e.g. interrupted builds)
+			offset = sent
+			if endedPolls++; endedPolls > logEndedPolls {
+				_, err := buildManager.sendLogChunks(&current, offset, true, send)
+				return err
+			}
+		} else if topic := buildManager.LogBroker.Get(build.ID); topic != nil {
+			return buildManager.streamTopic(ctx, &current, topic, offset, send)
+		}
+		if offset, err = buildManager.sendLogChunks(&current, offset, false, send); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(logPollInterval):
+		}
+	}
+}
+
+// streamTopic sends the log of a build running in this server instance. The part of the log older
+// than the tail of the topic is sent from its GridFS chunks.
+func (buildManager *Manager) streamTopic(ctx context.Context, build *mongodb.Build, topic *LogTopic, offset int64, send LogSender) error {
+	keepAlive := time.NewTicker(logKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		data, start, changed, closed := topic.Read(offset)
+		if offset < start {
+			sent, err := buildManager.sendLogChunks(build, offset, false, send)
+			if err != nil {
+				return err
+			}
+			// The chunks may not be stored yet (or the build may not have the log file yet)
+			if sent == offset {
+				if build.LogFile == "" {
+					if current, err := buildManager.Database.GetBuild(build.Organization, build.Repository, build.ID); err == nil {
+						build = &current
+					}
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(logPollInterval):
+				}
+			}
+			offset = sent
+			continue
+		}
+		if len(data) > 0 {
+			if err := send(data, offset); err != nil {
+				return err
+			}
+			offset += int64(len(data))
+		}
+		if closed {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-keepAlive.C:
+			if err := send(nil, offset); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendLogChunks sends the stored chunks of the log of a build from an offset. The last chunk
+// is not sent until it is complete, unless partial is set. It returns the offset of the log not sent.
+// It keeps alive the connection if there is nothing to send.
+func (buildManager *Manager) sendLogChunks(build *mongodb.Build, offset int64, partial bool, send LogSender) (int64, error) {
+	if build.LogFile == "" {
+		return offset, send(nil, offset)
+	}
+	chunks, err := buildManager.Database.FindFileChunks(build.LogFile, int(offset/logChunkSize))
+	if err != nil {
+		return offset, err
+	}
+	sent := false
+	for _, chunk := range chunks {
+		start := int64(chunk.N) * logChunkSize
+		end := start + int64(len(chunk.Data))
+		if start > offset || (len(chunk.Data) < logChunkSize && !partial) {
+			break
+		}
+		if end > offset {
+			if err := send(chunk.Data[offset-start:], offset); err != nil {
+				return offset, err
+			}
+			offset = end
+			sent = true
+		}
+	}
+	if !sent {
+		return offset, send(nil, offset)
+	}
+	return offset, nil
+}
+
+// sendLogFile sends the log file of an ended build from an offset. It returns the offset of the log not sent.
+func (buildManager *Manager) sendLogFile(build *mongodb.Build, offset int64, send LogSender) (int64, error) {
+	logFile, err := buildManager.Database.OpenFile(build.LogFileName())
+	if err != nil {
+		return offset, err
+	}
+	defer logFile.Close()
+	if offset > 0 {
+		if _, err := logFile.Seek(offset, io.SeekStart); err != nil {
+			return offset, err
+		}
+	}
+	buf := make([]byte, logChunkSize)
+	for {
+		n, err := logFile.Read(buf)
+		if n > 0 {
+			if err := send(buf[:n], offset); err != nil {
+				return offset, err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+	}
+}
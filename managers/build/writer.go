@@ -0,0 +1,104 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"unicode/utf8"
+)
+
+// SyncWriter type.
+// Writer shared by the tasks of a build executed concurrently. Every Write is atomic.
+type SyncWriter struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+// NewSyncWriter is the constructor for SyncWriter.
+func NewSyncWriter(w io.Writer) *SyncWriter {
+	return &SyncWriter{w: w}
+}
+
+func (syncWriter *SyncWriter) Write(p []byte) (int, error) {
+	syncWriter.mutex.Lock()
+	defer syncWriter.mutex.Unlock()
+	return syncWriter.w.Write(p)
+}
+
+// PrefixWriter type.
+// Writer that prefixes every line with the task name, so that the output of the tasks
+// executed concurrently can be told apart in the build log. Every line is written at once.
+// A PrefixWriter buffers a single stream: the lines longer than logLineMaxLength are split, so the buffer is bounded.
+type PrefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+// NewPrefixWriter is the constructor for PrefixWriter.
+func NewPrefixWriter(w io.Writer, task string) *PrefixWriter {
+	return &PrefixWriter{w: w, prefix: []byte("[" + task + "] ")}
+}
+
+func (prefixWriter *PrefixWriter) Write(p []byte) (int, error) {
+	prefixWriter.buf = append(prefixWriter.buf, p...)
+	for {
+		i := bytes.IndexByte(prefixWriter.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := prefixWriter.writeLine(prefixWriter.buf[:i+1]); err != nil {
+			return len(p), err
+		}
+		prefixWriter.buf = prefixWriter.buf[i+1:]
+	}
+	for len(prefixWriter.buf) > logLineMaxLength {
+		// Split the line at the start of a UTF-8 character
+		i := logLineMaxLength
+		for i > 0 && !utf8.RuneStart(prefixWriter.buf[i]) {
+			i--
+		}
+		if i == 0 {
+			i = logLineMaxLength
+		}
+		line := append(append([]byte{}, prefixWriter.buf[:i]...), '\n')
+		if err := prefixWriter.writeLine(line); err != nil {
+			return len(p), err
+		}
+		prefixWriter.buf = prefixWriter.buf[i:]
+	}
+	// Release the memory of the lines already written
+	if len(prefixWriter.buf) == 0 {
+		prefixWriter.buf = nil
+	}
+	return len(p), nil
+}
+
+// Flush writes the last line even if it is not terminated.
+func (prefixWriter *PrefixWriter) Flush() error {
+	if len(prefixWriter.buf) == 0 {
+		return nil
+	}
+	line := append(prefixWriter.buf, '\n')
+	prefixWriter.buf = nil
+	return prefixWriter.writeLine(line)
+}
+
+func (prefixWriter *PrefixWriter) writeLine(line []byte) error {
+	_, err := prefixWriter.w.Write(append(append([]byte{}, prefixWriter.prefix...), line...))
+	return err
+}
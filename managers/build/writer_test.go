@@ -0,0 +1,55 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"lines", []string{"one\ntwo\n"}, "[task] one\n[task] two\n"},
+		{"partial lines", []string{"o", "ne\ntw", "o\n"}, "[task] one\n[task] two\n"},
+		{"unterminated line", []string{"one\ntwo"}, "[task] one\n[task] two\n"},
+		{"long line", []string{strings.Repeat("a", logLineMaxLength+1)},
+			"[task] " + strings.Repeat("a", logLineMaxLength) + "\n[task] a\n"},
+		{"long line split by character", []string{strings.Repeat("a", logLineMaxLength-1) + "é"},
+			"[task] " + strings.Repeat("a", logLineMaxLength-1) + "\n[task] é\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := NewPrefixWriter(&buf, "task")
+		for _, write := range test.writes {
+			if n, err := w.Write([]byte(write)); n != len(write) || err != nil {
+				t.Errorf("%s: Write = %d, %v", test.name, n, err)
+			}
+		}
+		if len(w.buf) > logLineMaxLength {
+			t.Errorf("%s: buffered %d bytes", test.name, len(w.buf))
+		}
+		if err := w.Flush(); err != nil {
+			t.Errorf("%s: Flush = %v", test.name, err)
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
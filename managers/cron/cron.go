@@ -0,0 +1,145 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule type.
+// Schedule parsed from a cron expression with five fields: minute, hour, day of month, month and day of week.
+// Every field accepts "*", values, ranges ("1-5"), steps ("*/15" or "0-30/10") and lists ("1,15").
+// The descriptors @hourly, @daily (or @midnight), @weekly, @monthly and @yearly (or @annually) are also accepted.
+// As in standard cron, if both day fields are restricted, a time matches if any of them matches.
+type Schedule struct {
+	minute     uint64
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	anyDay     bool
+}
+
+// field type.
+// Range of values of a field of a cron expression.
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+var descriptors = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// Parse a cron expression.
+func Parse(expression string) (*Schedule, error) {
+	expression = strings.TrimSpace(expression)
+	if descriptor, ok := descriptors[expression]; ok {
+		expression = descriptor
+	}
+	values := strings.Fields(expression)
+	if len(values) != len(fields) {
+		return nil, fmt.Errorf("Invalid cron expression '%s'. It must have %d fields", expression, len(fields))
+	}
+	bits := make([]uint64, len(fields))
+	for i, value := range values {
+		var err error
+		if bits[i], err = parseField(value, fields[i]); err != nil {
+			return nil, fmt.Errorf("Invalid cron expression '%s'. %s", expression, err)
+		}
+	}
+	// Sunday is either 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &Schedule{
+		minute:     bits[0],
+		hour:       bits[1],
+		dayOfMonth: bits[2],
+		month:      bits[3],
+		dayOfWeek:  bits[4],
+		anyDay:     values[2] == "*" || values[4] == "*",
+	}, nil
+}
+
+// parseField parses a field of a cron expression into a bit set with the values of the field.
+func parseField(value string, f field) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(value, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("Invalid step in %s field: %s", f.name, part)
+			}
+			part = part[:i]
+		}
+		min, max := f.min, f.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if min, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("Invalid value in %s field: %s", f.name, part)
+			}
+			max = min
+			if len(bounds) == 2 {
+				if max, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("Invalid value in %s field: %s", f.name, part)
+				}
+			} else if step > 1 {
+				max = f.max
+			}
+			if min < f.min || max > f.max || min > max {
+				return 0, fmt.Errorf("Value out of range in %s field: %s", f.name, part)
+			}
+		}
+		for v := min; v <= max; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Match checks if the schedule is triggered at the minute of the time.
+func (schedule *Schedule) Match(t time.Time) bool {
+	if schedule.minute&(1<<uint(t.Minute())) == 0 ||
+		schedule.hour&(1<<uint(t.Hour())) == 0 ||
+		schedule.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dayOfMonth := schedule.dayOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := schedule.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	if schedule.anyDay {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
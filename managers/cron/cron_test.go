@@ -0,0 +1,108 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleMatch(t *testing.T) {
+	tests := []struct {
+		expression string
+		time       string
+		match      bool
+	}{
+		{"* * * * *", "2016-05-17 13:27", true},
+		{"0 2 * * *", "2016-05-17 02:00", true},
+		{"0 2 * * *", "2016-05-17 02:01", false},
+		{"0 2 * * *", "2016-05-17 03:00", false},
+		{"*/15 * * * *", "2016-05-17 13:45", true},
+		{"*/15 * * * *", "2016-05-17 13:46", false},
+		{"5/10 * * * *", "2016-05-17 13:25", true},
+		{"5/10 * * * *", "2016-05-17 13:04", false},
+		{"0-30/10 * * * *", "2016-05-17 13:30", true},
+		{"0-30/10 * * * *", "2016-05-17 13:40", false},
+		{"1,15,30 * * * *", "2016-05-17 13:15", true},
+		{"1,15,30 * * * *", "2016-05-17 13:16", false},
+		{"0 9-17 * * 1-5", "2016-05-17 12:00", true},  // Tuesday
+		{"0 9-17 * * 1-5", "2016-05-21 12:00", false}, // Saturday
+		{"0 0 * * 0", "2016-05-22 00:00", true},       // Sunday as 0
+		{"0 0 * * 7", "2016-05-22 00:00", true},       // Sunday as 7
+		{"0 0 * * 7", "2016-05-23 00:00", false},
+		{"0 0 1 * *", "2016-06-01 00:00", true},
+		{"0 0 1 * *", "2016-06-02 00:00", false},
+		{"0 0 * 2 *", "2016-02-29 00:00", true},
+		{"0 0 * 2 *", "2016-03-01 00:00", false},
+		// Both day fields restricted: any of them matches
+		{"0 0 1 * 1", "2016-05-23 00:00", true}, // Monday
+		{"0 0 1 * 1", "2016-06-01 00:00", true}, // 1st
+		{"0 0 1 * 1", "2016-05-24 00:00", false},
+		// A single day field restricted: it must match
+		{"0 0 1 * *", "2016-05-23 00:00", false},
+		{"0 0 * * 1", "2016-06-01 00:00", false},
+		{"@hourly", "2016-05-17 13:00", true},
+		{"@hourly", "2016-05-17 13:01", false},
+		{"@daily", "2016-05-17 00:00", true},
+		{"@midnight", "2016-05-17 00:00", true},
+		{"@weekly", "2016-05-22 00:00", true},
+		{"@weekly", "2016-05-23 00:00", false},
+		{"@monthly", "2016-06-01 00:00", true},
+		{"@yearly", "2017-01-01 00:00", true},
+		{"@annually", "2016-06-01 00:00", false},
+		{"  0 2 * * *  ", "2016-05-17 02:00", true},
+	}
+	for _, test := range tests {
+		schedule, err := Parse(test.expression)
+		if err != nil {
+			t.Errorf("Error parsing '%s'. %s", test.expression, err)
+			continue
+		}
+		at, err := time.Parse("2006-01-02 15:04", test.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match := schedule.Match(at); match != test.match {
+			t.Errorf("Schedule '%s' at %s: expected %t, got %t", test.expression, test.time, test.match, match)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	expressions := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@reboot",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"a * * * *",
+		"1-a * * * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"-1 * * * *",
+		"1,,2 * * * *",
+	}
+	for _, expression := range expressions {
+		if _, err := Parse(expression); err == nil {
+			t.Errorf("Expected error parsing '%s'", expression)
+		}
+	}
+}
@@ -14,11 +14,91 @@
 
 package docker
 
+import (
+	"fmt"
+	"path"
+)
+
+// Modes of access of the build containers to a docker daemon.
+const (
+	DockerAccessNone   = ""
+	DockerAccessSocket = "socket"
+	DockerAccessDinD   = "dind"
+)
+
+// defaultDinDImage is the image of the Docker-in-Docker sidecar if not configured.
+const defaultDinDImage = "docker:dind"
+
 // ClusterConfig type.
 type ClusterConfig struct {
-	Hosts     []string
-	CertPath  string
-	TLSVerify bool
+	Hosts        []string
+	CertPath     string
+	TLSVerify    bool
+	DockerAccess *DockerAccessConfig
+	Limits       *LimitsConfig
+}
+
+// DockerAccessConfig type.
+// Restrictions of the administrators to the access of the build containers to a docker daemon, chosen
+// in the settings of every repository. The docker socket of the host is only mounted for the repositories
+// matching any of SocketRepositories (patterns as "{organization}/{repository}", e.g. "gocilla/*"), and never
+// for pull requests from forks unless SocketForks is set. If DinD is set, the repositories matching any of
+// DinDRepositories can use a Docker-in-Docker sidecar instead, and never for pull requests from forks unless
+// DinDForks is set. As the sidecar is a privileged container (with the DinDImage), it can also control
+// the docker host.
+type DockerAccessConfig struct {
+	SocketRepositories []string
+	SocketForks        bool
+	DinD               bool
+	DinDRepositories   []string
+	DinDForks          bool
+	DinDImage          string
+}
+
+// Allow checks if a repository can use a mode of docker access in the build of an event.
+func (accessConfig *DockerAccessConfig) Allow(mode, organization, repository string, fork bool) error {
+	switch mode {
+	case DockerAccessNone:
+		return nil
+	case DockerAccessSocket:
+		if accessConfig == nil || !matchRepository(accessConfig.SocketRepositories, organization+"/"+repository) {
+			return fmt.Errorf("Docker socket not allowed for repository: %s/%s", organization, repository)
+		}
+		if fork && !accessConfig.SocketForks {
+			return fmt.Errorf("Docker socket not allowed for pull requests from forks")
+		}
+		return nil
+	case DockerAccessDinD:
+		if accessConfig == nil || !accessConfig.DinD {
+			return fmt.Errorf("Docker-in-Docker not allowed")
+		}
+		if !matchRepository(accessConfig.DinDRepositories, organization+"/"+repository) {
+			return fmt.Errorf("Docker-in-Docker not allowed for repository: %s/%s", organization, repository)
+		}
+		if fork && !accessConfig.DinDForks {
+			return fmt.Errorf("Docker-in-Docker not allowed for pull requests from forks")
+		}
+		return nil
+	}
+	return fmt.Errorf("Invalid docker access: %s", mode)
+}
+
+// GetDinDImage gets the image of the Docker-in-Docker sidecar.
+func (accessConfig *DockerAccessConfig) GetDinDImage() string {
+	if accessConfig == nil || accessConfig.DinDImage == "" {
+		return defaultDinDImage
+	}
+	return accessConfig.DinDImage
+}
+
+// matchRepository checks if a repository full name matches any of the patterns. Invalid patterns do not match.
+func matchRepository(patterns []string, fullName string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, fullName); err == nil && matched {
+			return true
+		}
+	}
+	return false
 }
 
 // Managers is the list of docker managers (cluster) available for executing builds.
@@ -34,6 +114,8 @@ func NewManagers(clusterConfig *ClusterConfig) Managers {
 			TLSVerify: clusterConfig.TLSVerify,
 		}
 		dockerManagers[i] = NewManager(dockerConfig)
+		dockerManagers[i].DockerAccess = clusterConfig.DockerAccess
+		dockerManagers[i].Limits = clusterConfig.Limits
 	}
 	return dockerManagers
 }
@@ -0,0 +1,64 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDockerAccessConfigAllow(t *testing.T) {
+	accessConfig := &DockerAccessConfig{
+		SocketRepositories: []string{"gocilla/*"},
+		DinD:               true,
+		DinDRepositories:   []string{"gocilla/gocilla", "other/*"},
+	}
+	forks := &DockerAccessConfig{
+		SocketRepositories: []string{"gocilla/*"},
+		SocketForks:        true,
+		DinD:               true,
+		DinDRepositories:   []string{"gocilla/*"},
+		DinDForks:          true,
+	}
+	tests := []struct {
+		config     *DockerAccessConfig
+		mode       string
+		repository string
+		fork       bool
+		want       bool
+	}{
+		{nil, DockerAccessNone, "gocilla/gocilla", true, true},
+		{nil, DockerAccessSocket, "gocilla/gocilla", false, false},
+		{nil, DockerAccessDinD, "gocilla/gocilla", false, false},
+		{accessConfig, DockerAccessSocket, "gocilla/gocilla", false, true},
+		{accessConfig, DockerAccessSocket, "other/repo", false, false},
+		{accessConfig, DockerAccessSocket, "gocilla/gocilla", true, false},
+		{accessConfig, DockerAccessDinD, "gocilla/gocilla", false, true},
+		{accessConfig, DockerAccessDinD, "other/repo", false, true},
+		{accessConfig, DockerAccessDinD, "gocilla/other", false, false},
+		{accessConfig, DockerAccessDinD, "gocilla/gocilla", true, false},
+		{&DockerAccessConfig{DinDRepositories: []string{"*/*"}}, DockerAccessDinD, "gocilla/gocilla", false, false},
+		{forks, DockerAccessSocket, "gocilla/gocilla", true, true},
+		{forks, DockerAccessDinD, "gocilla/gocilla", true, true},
+		{accessConfig, "host", "gocilla/gocilla", false, false},
+	}
+	for _, test := range tests {
+		fullName := strings.SplitN(test.repository, "/", 2)
+		err := test.config.Allow(test.mode, fullName[0], fullName[1], test.fork)
+		if (err == nil) != test.want {
+			t.Errorf("Allow(%q, %q, fork %v) with %+v = %v, want allowed %v", test.mode, test.repository, test.fork, test.config, err, test.want)
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package docker
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -25,8 +26,12 @@ import (
 
 // Manager type.
 // Manager to create and destroy the docker containers that execute the builds.
+// DockerAccess restricts the access of the build containers to a docker daemon (see DockerAccessConfig), and
+// Limits sets the resources and security options of the containers (see LimitsConfig).
 type Manager struct {
-	Client *docker.Client
+	Client       *docker.Client
+	DockerAccess *DockerAccessConfig
+	Limits       *LimitsConfig
 }
 
 // ContainerManager type.
@@ -35,6 +40,15 @@ type ContainerManager struct {
 	Container *docker.Container
 }
 
+// ContainerOptions type.
+// Options of a build container: the network to connect it to (e.g. with the service containers of the build),
+// if the docker socket of the host is mounted, and its limits (see LimitsConfig.GetLimits).
+type ContainerOptions struct {
+	Network      string
+	DockerSocket bool
+	Limits       *ContainerLimits
+}
+
 // Config type.
 type Config struct {
 	Host      string
@@ -76,14 +90,16 @@ func NewManager(dockerConfig *Config) *Manager {
 	cert := fmt.Sprintf("%s/cert.pem", dockerConfig.CertPath)
 	key := fmt.Sprintf("%s/key.pem", dockerConfig.CertPath)
 	client, _ := docker.NewTLSClient(dockerConfig.Host, cert, key, ca)
-	return &Manager{client}
+	return &Manager{Client: client}
 }
 
 // BuildImage to build a docker image.
-func (dockerManager *Manager) BuildImage(organization, repository, sha, directory string, w io.Writer) error {
+// The build of the image is aborted if the context is done.
+func (dockerManager *Manager) BuildImage(ctx context.Context, organization, repository, sha, directory string, w io.Writer) error {
 	imageName := GetImageName(organization, repository)
 
 	buildImageOptions := docker.BuildImageOptions{
+		Context:      ctx,
 		Name:         imageName,
 		ContextDir:   directory,
 		OutputStream: w,
@@ -114,23 +130,29 @@ func (dockerManager *Manager) ExistsImage(organization, repository, sha string)
 }
 
 // CreateAndStartContainer creates and starts a docker container.
-func (dockerManager *Manager) CreateAndStartContainer(organization, repository, sha, user, workingDir string, envVars map[string]string) (*ContainerManager, error) {
+func (dockerManager *Manager) CreateAndStartContainer(organization, repository, sha, user, workingDir string, envVars map[string]string,
+	options ContainerOptions) (*ContainerManager, error) {
 	imageName := GetTaggedImageName(organization, repository, sha)
 	log.Printf("CreateAndStartContainer for image: %s", imageName)
 	log.Printf("WorkingDir: %s", workingDir)
-	// Create volumes map to share the docker socket
 	containerOptions := docker.CreateContainerOptions{
 		Config: &docker.Config{
 			Image:      imageName,
 			Env:        GetEnv(envVars),
 			User:       user,
 			WorkingDir: workingDir,
-			Memory:     1024000000,
 		},
 		HostConfig: &docker.HostConfig{
-			Binds: []string{"/var/run/docker.sock:/var/run/docker.sock"},
+			NetworkMode: options.Network,
 		},
 	}
+	if options.DockerSocket {
+		containerOptions.HostConfig.Binds = []string{"/var/run/docker.sock:/var/run/docker.sock"}
+	}
+	if err := options.Limits.apply(containerOptions.HostConfig, false); err != nil {
+		log.Println("Error applying the limits of the container", err)
+		return nil, err
+	}
 	container, err := dockerManager.Client.CreateContainer(containerOptions)
 	if err != nil {
 		log.Println("Error creating container with image", imageName)
@@ -153,9 +175,22 @@ func (containerManager *ContainerManager) RemoveContainer() error {
 	return containerManager.Client.RemoveContainer(removeContainerOptions)
 }
 
+// KillContainer kills a running docker container.
+// The executions in progress in the container are terminated as well.
+func (containerManager *ContainerManager) KillContainer() error {
+	killContainerOptions := docker.KillContainerOptions{
+		ID:     containerManager.Container.ID,
+		Signal: docker.SIGKILL,
+	}
+	return containerManager.Client.KillContainer(killContainerOptions)
+}
+
 // ExecContainer executes a command on a running docker container.
-func (containerManager *ContainerManager) ExecContainer(command string, w io.Writer) error {
+// The output of the command is written to stdout and stderr.
+// It returns the context error if the context is done before the command is completed.
+func (containerManager *ContainerManager) ExecContainer(ctx context.Context, command string, stdout, stderr io.Writer) error {
 	execOptions := docker.CreateExecOptions{
+		Context:      ctx,
 		Container:    containerManager.Container.ID,
 		AttachStdin:  true,
 		AttachStdout: true,
@@ -170,11 +205,16 @@ func (containerManager *ContainerManager) ExecContainer(command string, w io.Wri
 	}
 
 	startExecOptions := docker.StartExecOptions{
+		Context:      ctx,
 		Detach:       false,
-		OutputStream: w,
-		ErrorStream:  w,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
 	}
 	err = containerManager.Client.StartExec(exec.ID, startExecOptions)
+	if ctx.Err() != nil {
+		log.Printf("Execution of command '%s' interrupted. %s", command, ctx.Err())
+		return ctx.Err()
+	}
 	if err != nil {
 		log.Println("Error starting the execution of command", command)
 		return err
@@ -182,6 +222,7 @@ func (containerManager *ContainerManager) ExecContainer(command string, w io.Wri
 	inspect, err := containerManager.Client.InspectExec(exec.ID)
 	if err != nil {
 		log.Printf("Error inspecting the execution of command '%s'", command)
+		return err
 	}
 	if inspect.ExitCode != 0 {
 		log.Println("Invalid exit code")
@@ -190,3 +231,44 @@ func (containerManager *ContainerManager) ExecContainer(command string, w io.Wri
 
 	return err
 }
+
+// WorkingDir gets the working directory of the container.
+func (containerManager *ContainerManager) WorkingDir() (string, error) {
+	container, err := containerManager.Client.InspectContainer(containerManager.Container.ID)
+	if err != nil {
+		log.Println("Error inspecting the container", err)
+		return "", err
+	}
+	if container.Config != nil && container.Config.WorkingDir != "" {
+		return container.Config.WorkingDir, nil
+	}
+	return "/", nil
+}
+
+// DownloadPath writes a tar archive with a file or directory of the container.
+// Relative paths are relative to the working directory of the container.
+func (containerManager *ContainerManager) DownloadPath(ctx context.Context, path string, w io.Writer) error {
+	if !strings.HasPrefix(path, "/") {
+		workingDir, err := containerManager.WorkingDir()
+		if err != nil {
+			return err
+		}
+		path = strings.TrimSuffix(workingDir, "/") + "/" + path
+	}
+	downloadOptions := docker.DownloadFromContainerOptions{
+		Context:      ctx,
+		Path:         path,
+		OutputStream: w,
+	}
+	return containerManager.Client.DownloadFromContainer(containerManager.Container.ID, downloadOptions)
+}
+
+// UploadArchive extracts a tar archive (optionally compressed with gzip) in a directory of the container.
+func (containerManager *ContainerManager) UploadArchive(ctx context.Context, path string, r io.Reader) error {
+	uploadOptions := docker.UploadToContainerOptions{
+		Context:     ctx,
+		Path:        path,
+		InputStream: r,
+	}
+	return containerManager.Client.UploadToContainer(containerManager.Container.ID, uploadOptions)
+}
@@ -0,0 +1,253 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// cpuPeriod is the CFS period (in microseconds) of the CPU quota of the containers.
+const cpuPeriod = 100000
+
+// defaultMemory is the memory limit (in MB) of the containers if the default memory is not configured.
+const defaultMemory = 1024
+
+// LimitsConfig type.
+// Resources and security options of the build and service containers. The resources of a container are the
+// Defaults overridden by the resources of the repository (.gocilla.yml), clamped to the Maximums (a zero
+// maximum is unlimited). The default memory is 1 GB if not configured, or unlimited if negative. The Security options are always applied, and a repository can only add restrictions.
+type LimitsConfig struct {
+	Defaults Resources
+	Maximums Resources
+	Security SecurityConfig
+}
+
+// Resources type.
+// Memory and MemorySwap (memory plus swap, -1 for unlimited swap) are in MB. CPUs is the CPU quota in number of CPUs
+// (e.g. 1.5), and CPUShares the relative weight of the container. A zero value is not set (unlimited, or the docker default).
+// Ulimits replace the ulimits with the same name.
+type Resources struct {
+	CPUShares  int64    `json:"cpuShares" yaml:"cpuShares"`
+	CPUs       float64  `json:"cpus" yaml:"cpus"`
+	Memory     int64    `json:"memory" yaml:"memory"`
+	MemorySwap int64    `json:"memorySwap" yaml:"memorySwap"`
+	PidsLimit  int64    `json:"pidsLimit" yaml:"pidsLimit"`
+	Ulimits    []Ulimit `json:"ulimits" yaml:"ulimits"`
+}
+
+// Ulimit type.
+type Ulimit struct {
+	Name string `json:"name" yaml:"name"`
+	Soft int64  `json:"soft" yaml:"soft"`
+	Hard int64  `json:"hard" yaml:"hard"`
+}
+
+// SecurityConfig type.
+// CapDrop are the capabilities dropped (e.g. "NET_RAW", or "ALL"), and NoNewPrivileges prevents the processes
+// of the container from gaining privileges (e.g. with setuid binaries). SeccompProfile is the path of a seccomp
+// profile (JSON) in the Gocilla server, or "unconfined"; the docker default profile is used if empty.
+// ReadOnlyRootfs mounts the root filesystem of the container as read only (only the volumes are writable).
+type SecurityConfig struct {
+	CapDrop         []string `json:"capDrop" yaml:"capDrop"`
+	NoNewPrivileges bool     `json:"noNewPrivileges" yaml:"noNewPrivileges"`
+	ReadOnlyRootfs  bool     `json:"readOnlyRootfs" yaml:"readOnlyRootfs"`
+	SeccompProfile  string   `json:"seccompProfile" yaml:"-"`
+}
+
+// ContainerLimits type.
+// Resources and security options applied to a container.
+type ContainerLimits struct {
+	Resources Resources
+	Security  SecurityConfig
+}
+
+// GetLimits gets the limits of a container with the resources and security options of the repository.
+// Without a default memory, the memory is limited to 1 GB.
+func (limitsConfig *LimitsConfig) GetLimits(resources *Resources, security *SecurityConfig) *ContainerLimits {
+	if limitsConfig == nil {
+		limitsConfig = &LimitsConfig{}
+	}
+	defaults := limitsConfig.Defaults
+	if defaults.Memory == 0 {
+		defaults.Memory = defaultMemory
+	}
+	limits := &ContainerLimits{
+		Resources: defaults.override(resources).clamp(&limitsConfig.Maximums),
+		Security:  limitsConfig.Security,
+	}
+	if security != nil {
+		limits.Security.CapDrop = append(append([]string{}, limitsConfig.Security.CapDrop...), security.CapDrop...)
+		limits.Security.NoNewPrivileges = limitsConfig.Security.NoNewPrivileges || security.NoNewPrivileges
+		limits.Security.ReadOnlyRootfs = limitsConfig.Security.ReadOnlyRootfs || security.ReadOnlyRootfs
+	}
+	return limits
+}
+
+// Validate checks that the resources (of a repository) are not negative, but for the unlimited swap (-1).
+func (resources *Resources) Validate() error {
+	for name, value := range map[string]int64{
+		"cpuShares": resources.CPUShares,
+		"memory":    resources.Memory,
+		"pidsLimit": resources.PidsLimit,
+	} {
+		if value < 0 {
+			return fmt.Errorf("Negative %s: %d", name, value)
+		}
+	}
+	if resources.CPUs < 0 {
+		return fmt.Errorf("Negative cpus: %g", resources.CPUs)
+	}
+	if resources.MemorySwap < -1 {
+		return fmt.Errorf("Invalid memorySwap: %d", resources.MemorySwap)
+	}
+	for _, ulimit := range resources.Ulimits {
+		if ulimit.Soft < 0 || ulimit.Hard < 0 {
+			return fmt.Errorf("Negative ulimit %s: %d/%d", ulimit.Name, ulimit.Soft, ulimit.Hard)
+		}
+	}
+	return nil
+}
+
+// override gets the resources with the non-zero values of overrides.
+func (resources Resources) override(overrides *Resources) Resources {
+	if overrides == nil {
+		return resources
+	}
+	if overrides.CPUShares != 0 {
+		resources.CPUShares = overrides.CPUShares
+	}
+	if overrides.CPUs != 0 {
+		resources.CPUs = overrides.CPUs
+	}
+	if overrides.Memory != 0 {
+		resources.Memory = overrides.Memory
+	}
+	if overrides.MemorySwap != 0 {
+		resources.MemorySwap = overrides.MemorySwap
+	}
+	if overrides.PidsLimit != 0 {
+		resources.PidsLimit = overrides.PidsLimit
+	}
+	ulimits := append([]Ulimit{}, resources.Ulimits...)
+	for _, ulimit := range overrides.Ulimits {
+		if i := findUlimit(ulimits, ulimit.Name); i >= 0 {
+			ulimits[i] = ulimit
+		} else {
+			ulimits = append(ulimits, ulimit)
+		}
+	}
+	resources.Ulimits = ulimits
+	return resources
+}
+
+// clamp gets the resources limited to the maximums. An unlimited (zero or negative) value is set to the maximum,
+// except the CPU shares, as they are a relative weight and not a limit.
+func (resources Resources) clamp(maximums *Resources) Resources {
+	if maximums.CPUShares > 0 && resources.CPUShares > maximums.CPUShares {
+		resources.CPUShares = maximums.CPUShares
+	}
+	if maximums.CPUs > 0 && (resources.CPUs <= 0 || resources.CPUs > maximums.CPUs) {
+		resources.CPUs = maximums.CPUs
+	}
+	resources.Memory = clampInt(resources.Memory, maximums.Memory)
+	resources.MemorySwap = clampInt(resources.MemorySwap, maximums.MemorySwap)
+	if resources.MemorySwap > 0 && resources.MemorySwap < resources.Memory {
+		resources.MemorySwap = resources.Memory
+	}
+	resources.PidsLimit = clampInt(resources.PidsLimit, maximums.PidsLimit)
+	ulimits := append([]Ulimit{}, resources.Ulimits...)
+	for _, maximum := range maximums.Ulimits {
+		i := findUlimit(ulimits, maximum.Name)
+		if i < 0 {
+			ulimits = append(ulimits, maximum)
+			continue
+		}
+		ulimits[i].Hard = clampInt(ulimits[i].Hard, maximum.Hard)
+		ulimits[i].Soft = clampInt(ulimits[i].Soft, ulimits[i].Hard)
+	}
+	resources.Ulimits = ulimits
+	return resources
+}
+
+// clampInt limits a value to a maximum (if positive). An unlimited (zero or negative) value is set to the maximum.
+func clampInt(value, maximum int64) int64 {
+	if maximum > 0 && (value <= 0 || value > maximum) {
+		return maximum
+	}
+	return value
+}
+
+// findUlimit gets the index of the ulimit with a name, or -1.
+func findUlimit(ulimits []Ulimit, name string) int {
+	for i := range ulimits {
+		if ulimits[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// apply sets the limits in the host configuration of a container. If privileged (the Docker-in-Docker sidecar),
+// only the resources are set, as the security options would prevent it from working.
+func (limits *ContainerLimits) apply(hostConfig *docker.HostConfig, privileged bool) error {
+	if limits == nil {
+		return nil
+	}
+	resources := &limits.Resources
+	hostConfig.CPUShares = resources.CPUShares
+	if resources.CPUs > 0 {
+		hostConfig.CPUPeriod = cpuPeriod
+		hostConfig.CPUQuota = int64(resources.CPUs * cpuPeriod)
+	}
+	if resources.Memory > 0 {
+		hostConfig.Memory = resources.Memory * 1024 * 1024
+	}
+	hostConfig.MemorySwap = resources.MemorySwap
+	if resources.MemorySwap > 0 {
+		hostConfig.MemorySwap = resources.MemorySwap * 1024 * 1024
+	}
+	if resources.PidsLimit > 0 {
+		pidsLimit := resources.PidsLimit
+		hostConfig.PidsLimit = &pidsLimit
+	}
+	for _, ulimit := range resources.Ulimits {
+		hostConfig.Ulimits = append(hostConfig.Ulimits, docker.ULimit{Name: ulimit.Name, Soft: ulimit.Soft, Hard: ulimit.Hard})
+	}
+	if privileged {
+		return nil
+	}
+
+	security := &limits.Security
+	hostConfig.CapDrop = security.CapDrop
+	hostConfig.ReadonlyRootfs = security.ReadOnlyRootfs
+	if security.NoNewPrivileges {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "no-new-privileges")
+	}
+	switch security.SeccompProfile {
+	case "":
+	case "unconfined":
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp=unconfined")
+	default:
+		profile, err := ioutil.ReadFile(security.SeccompProfile)
+		if err != nil {
+			return fmt.Errorf("Error reading the seccomp profile. %s", err)
+		}
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp="+string(profile))
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestResourcesClamp(t *testing.T) {
+	maximums := Resources{
+		CPUShares:  2048,
+		CPUs:       2,
+		Memory:     2048,
+		MemorySwap: 4096,
+		PidsLimit:  500,
+		Ulimits:    []Ulimit{{Name: "nofile", Hard: 4096}, {Name: "nproc", Soft: 100, Hard: 200}},
+	}
+	tests := []struct {
+		name      string
+		resources Resources
+		maximums  Resources
+		want      Resources
+	}{
+		{"no maximums", Resources{CPUs: 8, Memory: 8192}, Resources{}, Resources{CPUs: 8, Memory: 8192, Ulimits: []Ulimit{}}},
+		{"within maximums", Resources{CPUShares: 512, CPUs: 1, Memory: 512, MemorySwap: 1024, PidsLimit: 100}, maximums, Resources{
+			CPUShares: 512, CPUs: 1, Memory: 512, MemorySwap: 1024, PidsLimit: 100,
+			Ulimits: []Ulimit{{Name: "nofile", Hard: 4096}, {Name: "nproc", Soft: 100, Hard: 200}},
+		}},
+		{"above maximums", Resources{CPUShares: 4096, CPUs: 4, Memory: 8192, MemorySwap: 8192, PidsLimit: 1000}, maximums, Resources{
+			CPUShares: 2048, CPUs: 2, Memory: 2048, MemorySwap: 4096, PidsLimit: 500,
+			Ulimits: []Ulimit{{Name: "nofile", Hard: 4096}, {Name: "nproc", Soft: 100, Hard: 200}},
+		}},
+		{"unlimited", Resources{MemorySwap: -1}, maximums, Resources{
+			CPUs: 2, Memory: 2048, MemorySwap: 4096, PidsLimit: 500,
+			Ulimits: []Ulimit{{Name: "nofile", Hard: 4096}, {Name: "nproc", Soft: 100, Hard: 200}},
+		}},
+		{"swap below memory", Resources{Memory: 1024, MemorySwap: 512}, Resources{}, Resources{Memory: 1024, MemorySwap: 1024, Ulimits: []Ulimit{}}},
+		{"unlimited swap without maximum", Resources{Memory: 1024, MemorySwap: -1}, Resources{}, Resources{Memory: 1024, MemorySwap: -1, Ulimits: []Ulimit{}}},
+		{"ulimits", Resources{Ulimits: []Ulimit{{Name: "nofile", Soft: 10000, Hard: 10000}, {Name: "core", Soft: 0, Hard: 0}}},
+			Resources{Ulimits: []Ulimit{{Name: "nofile", Hard: 4096}}},
+			Resources{Ulimits: []Ulimit{{Name: "nofile", Soft: 4096, Hard: 4096}, {Name: "core"}}}},
+	}
+	for _, test := range tests {
+		if got := test.resources.clamp(&test.maximums); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: clamp = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLimitsConfigGetLimitsMemory(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    *LimitsConfig
+		resources *Resources
+		want      int64
+	}{
+		{"no limits", nil, nil, defaultMemory},
+		{"no default memory", &LimitsConfig{Defaults: Resources{CPUs: 1}}, nil, defaultMemory},
+		{"default memory", &LimitsConfig{Defaults: Resources{Memory: 512}}, nil, 512},
+		{"unlimited default memory", &LimitsConfig{Defaults: Resources{Memory: -1}}, nil, -1},
+		{"repository memory", &LimitsConfig{}, &Resources{Memory: 4096}, 4096},
+		{"maximum memory", &LimitsConfig{Maximums: Resources{Memory: 512}}, nil, 512},
+		{"repository memory above maximum", &LimitsConfig{Maximums: Resources{Memory: 2048}}, &Resources{Memory: 4096}, 2048},
+	}
+	for _, test := range tests {
+		if got := test.config.GetLimits(test.resources, nil).Resources.Memory; got != test.want {
+			t.Errorf("%s: GetLimits memory = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLimitsConfigGetLimitsReadOnlyRootfs(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *LimitsConfig
+		security *SecurityConfig
+		want     bool
+	}{
+		{"no limits", nil, nil, false},
+		{"configuration", &LimitsConfig{Security: SecurityConfig{ReadOnlyRootfs: true}}, nil, true},
+		{"repository", &LimitsConfig{}, &SecurityConfig{ReadOnlyRootfs: true}, true},
+		{"repository cannot disable it", &LimitsConfig{Security: SecurityConfig{ReadOnlyRootfs: true}}, &SecurityConfig{}, true},
+	}
+	for _, test := range tests {
+		if got := test.config.GetLimits(nil, test.security).Security.ReadOnlyRootfs; got != test.want {
+			t.Errorf("%s: GetLimits read only rootfs = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestContainerLimitsApplyReadOnlyRootfs(t *testing.T) {
+	limits := &ContainerLimits{Security: SecurityConfig{ReadOnlyRootfs: true}}
+	tests := []struct {
+		name       string
+		privileged bool
+		want       bool
+	}{
+		{"container", false, true},
+		{"privileged container", true, false},
+	}
+	for _, test := range tests {
+		hostConfig := &docker.HostConfig{}
+		if err := limits.apply(hostConfig, test.privileged); err != nil {
+			t.Fatalf("%s: apply = %s", test.name, err)
+		}
+		if hostConfig.ReadonlyRootfs != test.want {
+			t.Errorf("%s: ReadonlyRootfs = %v, want %v", test.name, hostConfig.ReadonlyRootfs, test.want)
+		}
+	}
+}
+
+func TestResourcesValidate(t *testing.T) {
+	tests := []struct {
+		resources Resources
+		wantErr   bool
+	}{
+		{Resources{}, false},
+		{Resources{CPUShares: 512, CPUs: 1.5, Memory: 1024, MemorySwap: 2048, PidsLimit: 100}, false},
+		{Resources{MemorySwap: -1}, false},
+		{Resources{Ulimits: []Ulimit{{Name: "nofile", Soft: 1024, Hard: 4096}}}, false},
+		{Resources{CPUShares: -1}, true},
+		{Resources{CPUs: -0.5}, true},
+		{Resources{Memory: -1}, true},
+		{Resources{MemorySwap: -2}, true},
+		{Resources{PidsLimit: -1}, true},
+		{Resources{Ulimits: []Ulimit{{Name: "nofile", Soft: -1, Hard: 4096}}}, true},
+		{Resources{Ulimits: []Ulimit{{Name: "nofile", Soft: 1024, Hard: -1}}}, true},
+	}
+	for _, test := range tests {
+		if err := test.resources.Validate(); (err != nil) != test.wantErr {
+			t.Errorf("Validate(%+v) = %v, want error %v", test.resources, err, test.wantErr)
+		}
+	}
+}
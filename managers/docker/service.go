@@ -0,0 +1,180 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// healthPollInterval is the time between checks of the health of a service container.
+const healthPollInterval = time.Second
+
+// ServiceConfig type.
+// Service container (e.g. a database) started on the network of a build, where it is reachable by its name.
+// HealthCheck is a shell command to check that the service is ready. If empty, the health check of the image
+// (if any) is used. Privileged is only set for the Docker-in-Docker sidecar. Limits are the same as the build containers.
+type ServiceConfig struct {
+	Name           string
+	Image          string
+	EnvVars        map[string]string
+	Command        []string
+	Privileged     bool
+	Limits         *ContainerLimits
+	HealthCheck    string
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+	HealthRetries  int
+}
+
+// CreateNetwork creates a private bridge network (e.g. for the containers of a build). It returns its ID.
+func (dockerManager *Manager) CreateNetwork(name string) (string, error) {
+	networkOptions := docker.CreateNetworkOptions{
+		Name:           name,
+		Driver:         "bridge",
+		CheckDuplicate: true,
+		Labels:         map[string]string{"gocilla": "true"},
+	}
+	network, err := dockerManager.Client.CreateNetwork(networkOptions)
+	if err != nil {
+		log.Println("Error creating the network", name)
+		return "", err
+	}
+	return network.ID, nil
+}
+
+// RemoveNetwork removes a network.
+func (dockerManager *Manager) RemoveNetwork(id string) error {
+	return dockerManager.Client.RemoveNetwork(id)
+}
+
+// splitImage splits an image name into repository and tag (latest by default).
+func splitImage(image string) (repository, tag string) {
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
+
+// PullImage pulls an image unless it already exists.
+func (dockerManager *Manager) PullImage(ctx context.Context, image string, w io.Writer) error {
+	repository, tag := splitImage(image)
+	if existing, _ := dockerManager.Client.InspectImage(repository + ":" + tag); existing != nil {
+		return nil
+	}
+	pullImageOptions := docker.PullImageOptions{
+		Context:      ctx,
+		Repository:   repository,
+		Tag:          tag,
+		OutputStream: w,
+	}
+	if err := dockerManager.Client.PullImage(pullImageOptions, docker.AuthConfiguration{}); err != nil {
+		log.Println("Error pulling the image", image)
+		return err
+	}
+	return nil
+}
+
+// StartService creates and starts a service container on a network, with its name as network alias.
+func (dockerManager *Manager) StartService(ctx context.Context, network string, service *ServiceConfig) (*ContainerManager, error) {
+	config := &docker.Config{
+		Image:  service.Image,
+		Env:    GetEnv(service.EnvVars),
+		Cmd:    service.Command,
+		Labels: map[string]string{"gocilla": "true"},
+	}
+	if service.HealthCheck != "" {
+		config.Healthcheck = &docker.HealthConfig{
+			Test:     []string{"CMD-SHELL", service.HealthCheck},
+			Interval: service.HealthInterval,
+			Timeout:  service.HealthTimeout,
+			Retries:  service.HealthRetries,
+		}
+	}
+	containerOptions := docker.CreateContainerOptions{
+		Context: ctx,
+		Config:  config,
+		HostConfig: &docker.HostConfig{
+			NetworkMode: network,
+			Privileged:  service.Privileged,
+		},
+		NetworkingConfig: &docker.NetworkingConfig{
+			EndpointsConfig: map[string]*docker.EndpointConfig{
+				network: {Aliases: []string{service.Name}},
+			},
+		},
+	}
+	if err := service.Limits.apply(containerOptions.HostConfig, service.Privileged); err != nil {
+		log.Println("Error applying the limits of the container of service", service.Name)
+		return nil, err
+	}
+	container, err := dockerManager.Client.CreateContainer(containerOptions)
+	if err != nil {
+		log.Println("Error creating the container of service", service.Name)
+		return nil, err
+	}
+	containerManager := &ContainerManager{dockerManager.Client, container}
+	if err := dockerManager.Client.StartContainer(container.ID, nil); err != nil {
+		log.Println("Error starting the container of service", service.Name)
+		containerManager.RemoveContainer()
+		return nil, err
+	}
+	return containerManager, nil
+}
+
+// WaitHealthy waits until the container is healthy. A container without health check is ready once it is running.
+// It returns an error if the container is unhealthy or stopped.
+func (containerManager *ContainerManager) WaitHealthy(ctx context.Context) error {
+	for {
+		container, err := containerManager.Client.InspectContainer(containerManager.Container.ID)
+		if err != nil {
+			return err
+		}
+		if !container.State.Running {
+			return fmt.Errorf("Container stopped with exit code %d", container.State.ExitCode)
+		}
+		switch container.State.Health.Status {
+		case "", "healthy":
+			return nil
+		case "unhealthy":
+			return fmt.Errorf("Container unhealthy")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(healthPollInterval):
+		}
+	}
+}
+
+// FollowLogs writes the output of the container until it is stopped or the context is done.
+func (containerManager *ContainerManager) FollowLogs(ctx context.Context, stdout, stderr io.Writer) error {
+	logsOptions := docker.LogsOptions{
+		Context:      ctx,
+		Container:    containerManager.Container.ID,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Follow:       true,
+		Stdout:       true,
+		Stderr:       true,
+	}
+	return containerManager.Client.Logs(logsOptions)
+}
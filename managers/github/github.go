@@ -17,18 +17,24 @@ package github
 import (
 	"archive/tar"
 	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/google/go-github/github"
 )
 
 const pageSize = 1000
 
+// ErrNoPushPermission is returned when the user cannot push to a repository.
+var ErrNoPushPermission = errors.New("The user cannot push to the repository")
+
 // Config type.
 type Config struct {
 	Events    []string `json:"events"`
@@ -80,15 +86,13 @@ func (githubClient Client) GetRepositories() (repositories []github.Repository,
 }
 
 // CreateHook to create a hook on a repository.
-func (githubClient Client) CreateHook(owner, repo string) (hookID *int, err error) {
+// The secret is used by GitHub to sign the payload of every event delivered by the hook.
+func (githubClient Client) CreateHook(owner, repo, secret string) (hookID *int, err error) {
 	hookName := "web"
 	hookConfig := &github.Hook{
 		Name:   &hookName,
 		Events: githubClient.Config.Events,
-		Config: map[string]interface{}{
-			"url":          githubClient.Config.EventsURL,
-			"content_type": "json",
-		},
+		Config: githubClient.hookConfig(secret),
 	}
 	h, _, error := githubClient.Client.Repositories.CreateHook(owner, repo, hookConfig)
 	if error != nil {
@@ -98,6 +102,28 @@ func (githubClient Client) CreateHook(owner, repo string) (hookID *int, err erro
 	return h.ID, nil
 }
 
+// UpdateHookSecret to replace the secret of an existing hook on a repository.
+func (githubClient Client) UpdateHookSecret(owner, repo string, hookID int, secret string) error {
+	hookConfig := &github.Hook{
+		Events: githubClient.Config.Events,
+		Config: githubClient.hookConfig(secret),
+	}
+	_, _, error := githubClient.Client.Repositories.EditHook(owner, repo, hookID, hookConfig)
+	if error != nil {
+		log.Println("Error updating hook secret", error)
+		return error
+	}
+	return nil
+}
+
+func (githubClient Client) hookConfig(secret string) map[string]interface{} {
+	return map[string]interface{}{
+		"url":          githubClient.Config.EventsURL,
+		"content_type": "json",
+		"secret":       secret,
+	}
+}
+
 // DeleteHook to remove a hook on a repository.
 func (githubClient Client) DeleteHook(owner, repo string, hookID int) error {
 	_, error := githubClient.Client.Repositories.DeleteHook(owner, repo, hookID)
@@ -119,6 +145,106 @@ func (githubClient Client) CreateStatus(owner, repo, ref, context, description,
 	return err
 }
 
+// GetRepository gets a repository.
+func (githubClient Client) GetRepository(owner, repo string) (*github.Repository, error) {
+	repository, _, err := githubClient.Client.Repositories.Get(owner, repo)
+	return repository, err
+}
+
+// GetPushRepository gets a repository, only if the user can push to it (or administer it).
+// Otherwise, it returns ErrNoPushPermission.
+func (githubClient Client) GetPushRepository(owner, repo string) (*github.Repository, error) {
+	repository, err := githubClient.GetRepository(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	if repository.Permissions == nil || !(*repository.Permissions)["push"] && !(*repository.Permissions)["admin"] {
+		return nil, ErrNoPushPermission
+	}
+	return repository, nil
+}
+
+// IsBranchCommit checks if a commit is the head of a branch, or one of its ancestors.
+func (githubClient Client) IsBranchCommit(owner, repo, branch, sha string) (bool, error) {
+	comparison, _, err := githubClient.Client.Repositories.CompareCommits(owner, repo, branch, sha)
+	if err != nil {
+		return false, err
+	}
+	return comparison.Status != nil && (*comparison.Status == "behind" || *comparison.Status == "identical"), nil
+}
+
+// GetBranchSHA gets the SHA of the head commit of a branch.
+func (githubClient Client) GetBranchSHA(owner, repo, branch string) (string, error) {
+	githubBranch, _, err := githubClient.Client.Repositories.GetBranch(owner, repo, branch)
+	if err != nil {
+		return "", err
+	}
+	return *githubBranch.Commit.SHA, nil
+}
+
+// GetCommit gets the metadata of a commit.
+func (githubClient Client) GetCommit(owner, repo, sha string) (*EventCommit, error) {
+	repositoryCommit, _, err := githubClient.Client.Repositories.GetCommit(owner, repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	commit := &EventCommit{}
+	if repositoryCommit.Commit != nil {
+		if repositoryCommit.Commit.Message != nil {
+			commit.Message = *repositoryCommit.Commit.Message
+		}
+		if author := repositoryCommit.Commit.Author; author != nil {
+			if author.Name != nil {
+				commit.Author = *author.Name
+			}
+			if author.Email != nil {
+				commit.Email = *author.Email
+			}
+		}
+	}
+	return commit, nil
+}
+
+// GetChangedFiles gets the files changed by a push or by a pull request.
+// The files of a pull request are listed in the base repository (the repository of the event), as the head
+// repository may be a fork. If the push payload does not include all the commits, the files are obtained comparing the commits.
+func (githubClient Client) GetChangedFiles(event *Event) ([]string, error) {
+	switch {
+	case event.Pull != nil:
+		var files []string
+		options := &github.ListOptions{PerPage: 100}
+		for {
+			commitFiles, resp, err := githubClient.Client.PullRequests.ListFiles(event.Organization, event.Repository, event.Pull.Number, options)
+			if err != nil {
+				return nil, err
+			}
+			for _, commitFile := range commitFiles {
+				files = append(files, *commitFile.Filename)
+			}
+			if resp == nil || resp.NextPage == 0 {
+				return files, nil
+			}
+			options.Page = resp.NextPage
+		}
+	case event.Push != nil && event.Type == EventTypePush:
+		// A new branch has no previous commit to compare with
+		if !event.Push.Truncated || strings.Trim(event.Push.Before, "0") == "" {
+			return event.Push.Files, nil
+		}
+		comparison, _, err := githubClient.Client.Repositories.CompareCommits(event.Organization, event.Repository, event.Push.Before, event.SHA)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, commitFile := range comparison.Files {
+			files = append(files, *commitFile.Filename)
+		}
+		return files, nil
+	default:
+		return nil, fmt.Errorf("No changed files for event '%s'", event.Type)
+	}
+}
+
 // GetFileContent to download a file from a user's repository.
 func (githubClient Client) GetFileContent(owner, repo, path, ref string) ([]byte, error) {
 	options := &github.RepositoryContentGetOptions{Ref: ref}
@@ -31,6 +31,10 @@ const (
 	EventTypePush string = "push"
 	// EventTypeTag is a contant for Tag event type
 	EventTypeTag string = "tag"
+	// EventTypeSchedule is a contant for the event type of scheduled builds
+	EventTypeSchedule string = "schedule"
+	// EventTypeManual is a contant for the event type of builds launched through the API
+	EventTypeManual string = "manual"
 )
 
 // ExtendedWebHookPayload type.
@@ -50,26 +54,68 @@ type FixRepository struct {
 }
 
 // Event type.
+// For tag events, Tag is the tag name and Branch is the branch the tag was created from (if available).
+// For schedule events, Schedule is the name of the scheduled trigger.
+// User is the login of the user that triggered the event.
+// Pipeline restricts the build to a pipeline (e.g. when restarting a build), and it is the pipeline of
+// manual events. EnvVars are the environment variables of manual events. Restart is set when the event
+// builds again a previous build.
+// Commit is the metadata of the commit built, if available in the payload of the event.
 type Event struct {
 	Type         string
 	Branch       string
+	Tag          string
+	Schedule     string
 	Organization string
 	Repository   string
 	CloneURL     string
 	SSHURL       string
 	SHA          string
+	User         string
+	Pipeline     string
+	EnvVars      map[string]string
+	Restart      bool
+	Commit       *EventCommit
 	Push         *EventPush
 	Pull         *EventPull
 }
 
+// EventCommit type.
+// Metadata of the commit built. CompareURL is the GitHub page with the changes of the push or pull request.
+type EventCommit struct {
+	Message    string
+	Author     string
+	Email      string
+	CompareURL string
+}
+
 // EventPull type.
+// Fork is set if the pull request comes from another repository.
 type EventPull struct {
 	Number  int
 	HeadSHA string
+	Fork    bool
 }
 
 // EventPush type.
+// Files are the files changed by the commits of the push. GitHub includes up to
+// pushPayloadCommits commits in the payload, so Truncated is set if there could be more.
 type EventPush struct {
+	Before    string
+	Files     []string
+	Truncated bool
+}
+
+// pushPayloadCommits is the maximum number of commits in the payload of a push event.
+const pushPayloadCommits = 20
+
+// CommitSHA gets the SHA of the commit to be built.
+// For pull requests, SHA is a git reference to the pull request head, so it returns the head SHA.
+func (event *Event) CommitSHA() string {
+	if event.Pull != nil {
+		return event.Pull.HeadSHA
+	}
+	return event.SHA
 }
 
 // ParsePushEvent to parse a GitHub push event.
@@ -91,10 +137,33 @@ func ParsePushEvent(r *http.Request) (*Event, error) {
 		CloneURL:     *payload.Repo.CloneURL,
 		SSHURL:       *payload.Repo.SSHURL,
 		SHA:          *payload.HeadCommit.ID,
-		Push:         &EventPush{},
+		Push:         &EventPush{Files: changedFiles(payload.Commits)},
+	}
+	if payload.Before != nil {
+		event.Push.Before = *payload.Before
+	}
+	if payload.Sender != nil && payload.Sender.Login != nil {
+		event.User = *payload.Sender.Login
 	}
+	event.Commit = &EventCommit{}
+	if payload.HeadCommit.Message != nil {
+		event.Commit.Message = *payload.HeadCommit.Message
+	}
+	if author := payload.HeadCommit.Author; author != nil {
+		if author.Name != nil {
+			event.Commit.Author = *author.Name
+		}
+		if author.Email != nil {
+			event.Commit.Email = *author.Email
+		}
+	}
+	if payload.Compare != nil {
+		event.Commit.CompareURL = *payload.Compare
+	}
+	event.Push.Truncated = len(payload.Commits) >= pushPayloadCommits
 	if strings.HasPrefix(*payload.Ref, "refs/tags/") {
 		event.Type = EventTypeTag
+		event.Tag = (*payload.Ref)[len("refs/tags/"):]
 		if payload.BaseRef != nil {
 			event.Branch = (*payload.BaseRef)[len("refs/heads/"):]
 		}
@@ -105,6 +174,23 @@ func ParsePushEvent(r *http.Request) (*Event, error) {
 	return event, nil
 }
 
+// changedFiles gets the files added, modified or removed by the commits of a push.
+func changedFiles(commits []github.WebHookCommit) []string {
+	files := []string{}
+	found := make(map[string]bool)
+	for _, commit := range commits {
+		for _, list := range [][]string{commit.Added, commit.Modified, commit.Removed} {
+			for _, file := range list {
+				if !found[file] {
+					found[file] = true
+					files = append(files, file)
+				}
+			}
+		}
+	}
+	return files
+}
+
 // ParsePullEvent to parse a pull request event.
 func ParsePullEvent(r *http.Request) (*Event, error) {
 	var payload github.PullRequestEvent
@@ -117,15 +203,29 @@ func ParsePullEvent(r *http.Request) (*Event, error) {
 		return nil, nil
 	}
 
+	// The pull request is built in the base repository, that includes the head of the pull request
+	// (even from a fork, that may have been deleted) as "pull/<number>/head"
+	head, base := payload.PullRequest.Head, payload.PullRequest.Base
 	event := &Event{
 		Type:         EventTypePull,
-		Branch:       *payload.PullRequest.Base.Ref,
-		Organization: *payload.PullRequest.Head.Repo.Owner.Login,
-		Repository:   *payload.PullRequest.Head.Repo.Name,
-		CloneURL:     *payload.PullRequest.Head.Repo.CloneURL,
-		SSHURL:       *payload.PullRequest.Head.Repo.SSHURL,
+		Branch:       *base.Ref,
+		Organization: *base.Repo.Owner.Login,
+		Repository:   *base.Repo.Name,
+		CloneURL:     *base.Repo.CloneURL,
+		SSHURL:       *base.Repo.SSHURL,
 		SHA:          fmt.Sprintf("pull/%d/head", *payload.Number),
-		Pull:         &EventPull{Number: *payload.Number, HeadSHA: *payload.PullRequest.Head.SHA},
+		Pull: &EventPull{
+			Number:  *payload.Number,
+			HeadSHA: *head.SHA,
+			Fork:    head.Repo == nil || *head.Repo.Owner.Login != *base.Repo.Owner.Login || *head.Repo.Name != *base.Repo.Name,
+		},
+	}
+	if payload.Sender != nil && payload.Sender.Login != nil {
+		event.User = *payload.Sender.Login
+	}
+	// The message and author of the head commit are not included in the payload
+	if payload.PullRequest.HTMLURL != nil {
+		event.Commit = &EventCommit{CompareURL: *payload.PullRequest.HTMLURL + "/files"}
 	}
 	return event, nil
 }
@@ -0,0 +1,83 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package github
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// SignatureHeader is the HTTP header with the HMAC (SHA-256) of the event payload.
+const SignatureHeader = "X-Hub-Signature-256"
+
+const signaturePrefix = "sha256="
+
+// GenerateSecret to generate a random secret to sign the events delivered by a hook.
+func GenerateSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// ValidSignature checks that the signature (value of SignatureHeader) corresponds to
+// the HMAC of the payload with the hook secret.
+// An empty secret is never valid, so hooks without secret must be rotated.
+func ValidSignature(payload []byte, signature, secret string) bool {
+	if secret == "" || !strings.HasPrefix(signature, signaturePrefix) {
+		return false
+	}
+	expected, err := hex.DecodeString(signature[len(signaturePrefix):])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// GetEventRepository to get the organization and repository (owning the hook) of an event payload.
+// It is required to find out the hook secret before the event payload can be trusted.
+func GetEventRepository(payload []byte) (organization, repository string, err error) {
+	var event struct {
+		Repo *struct {
+			Owner *struct {
+				Login *string `json:"login,omitempty"`
+				Name  *string `json:"name,omitempty"`
+			} `json:"owner,omitempty"`
+			Name *string `json:"name,omitempty"`
+		} `json:"repository,omitempty"`
+	}
+	if err = json.Unmarshal(payload, &event); err != nil {
+		return
+	}
+	if event.Repo == nil || event.Repo.Owner == nil || event.Repo.Name == nil {
+		err = errors.New("No repository in the event payload")
+		return
+	}
+	if event.Repo.Owner.Login != nil {
+		organization = *event.Repo.Owner.Login
+	} else if event.Repo.Owner.Name != nil {
+		organization = *event.Repo.Owner.Name
+	}
+	repository = *event.Repo.Name
+	return
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package github
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func sign(payload []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidSignature(t *testing.T) {
+	payload := []byte(`{"repository":{"name":"gocilla","owner":{"login":"gocilla"}}}`)
+	secret := "s3cr3t"
+	sha1Mac := hmac.New(sha1.New, []byte(secret))
+	sha1Mac.Write(payload)
+	tests := []struct {
+		name      string
+		payload   []byte
+		signature string
+		secret    string
+		want      bool
+	}{
+		{"valid", payload, "sha256=" + sign(payload, secret), secret, true},
+		{"wrong digest", payload, "sha256=" + sign(payload, "other"), secret, false},
+		{"modified payload", append(payload, ' '), "sha256=" + sign(payload, secret), secret, false},
+		{"truncated digest", payload, "sha256=" + sign(payload, secret)[:32], secret, false},
+		{"invalid hex", payload, "sha256=" + sign(payload, secret)[:62] + "zz", secret, false},
+		{"empty secret", payload, "sha256=" + sign(payload, ""), "", false},
+		{"missing prefix", payload, sign(payload, secret), secret, false},
+		{"sha1 prefix", payload, "sha1=" + hex.EncodeToString(sha1Mac.Sum(nil)), secret, false},
+		{"uppercase prefix", payload, "SHA256=" + sign(payload, secret), secret, false},
+		{"empty signature", payload, "", secret, false},
+	}
+	for _, test := range tests {
+		if got := ValidSignature(test.payload, test.signature, test.secret); got != test.want {
+			t.Errorf("%s: ValidSignature = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGetEventRepository(t *testing.T) {
+	tests := []struct {
+		name             string
+		payload          string
+		wantOrganization string
+		wantRepository   string
+		wantErr          bool
+	}{
+		{"login", `{"repository":{"name":"repo","owner":{"login":"org"}}}`, "org", "repo", false},
+		{"name of push owner", `{"repository":{"name":"repo","owner":{"name":"org"}}}`, "org", "repo", false},
+		{"malformed", `{"repository":`, "", "", true},
+		{"not an object", `[]`, "", "", true},
+		{"wrong types", `{"repository":{"name":1,"owner":{"login":"org"}}}`, "", "", true},
+		{"no repository", `{"action":"opened"}`, "", "", true},
+		{"no owner", `{"repository":{"name":"repo"}}`, "", "", true},
+		{"empty", ``, "", "", true},
+	}
+	for _, test := range tests {
+		organization, repository, err := GetEventRepository([]byte(test.payload))
+		if (err != nil) != test.wantErr || organization != test.wantOrganization || repository != test.wantRepository {
+			t.Errorf("%s: GetEventRepository = %q, %q, %v, want %q, %q, error %v", test.name,
+				organization, repository, err, test.wantOrganization, test.wantRepository, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodb
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Artifact type.
+// Metadata of a file produced by a job of a build. The artifacts are stored in the "artifacts" GridFS
+// until they expire.
+type Artifact struct {
+	Build   bson.ObjectId `bson:"build" json:"build"`
+	Job     string        `bson:"job" json:"job"`
+	Path    string        `bson:"path" json:"path"`
+	Expires time.Time     `bson:"expires" json:"expires"`
+}
+
+// ArtifactFile type.
+// Stored artifact, with the metadata of its GridFS file.
+type ArtifactFile struct {
+	ID         bson.ObjectId `bson:"_id" json:"id"`
+	Length     int64         `bson:"length" json:"size"`
+	MD5        string        `bson:"md5" json:"md5"`
+	UploadDate time.Time     `bson:"uploadDate" json:"uploadDate"`
+	Artifact   `bson:"metadata"`
+}
+
+// CreateArtifact to create the GridFS file of an artifact.
+func (database *Database) CreateArtifact(artifact *Artifact) (*mgo.GridFile, error) {
+	file, err := database.Session.DB("").GridFS("artifacts").Create(artifact.Path)
+	if err != nil {
+		return nil, err
+	}
+	file.SetMeta(artifact)
+	return file, nil
+}
+
+// FindArtifacts to get the artifacts of a build, sorted by path.
+func (database *Database) FindArtifacts(build bson.ObjectId) ([]ArtifactFile, error) {
+	collection := database.Session.DB("").C("artifacts.files")
+	artifacts := []ArtifactFile{}
+	err := collection.Find(bson.M{"metadata.build": build}).Sort("metadata.path").All(&artifacts)
+	return artifacts, err
+}
+
+// OpenArtifact to open the GridFS file of an artifact of a build.
+func (database *Database) OpenArtifact(build, id bson.ObjectId) (*ArtifactFile, *mgo.GridFile, error) {
+	collection := database.Session.DB("").C("artifacts.files")
+	var artifact ArtifactFile
+	if err := collection.Find(bson.M{"_id": id, "metadata.build": build}).One(&artifact); err != nil {
+		return nil, nil, err
+	}
+	file, err := database.Session.DB("").GridFS("artifacts").OpenId(id)
+	return &artifact, file, err
+}
+
+// RemoveExpiredArtifacts to remove the artifacts expired before a time. It returns the number of removed artifacts.
+func (database *Database) RemoveExpiredArtifacts(t time.Time) (int, error) {
+	collection := database.Session.DB("").C("artifacts.files")
+	var artifacts []ArtifactFile
+	if err := collection.Find(bson.M{"metadata.expires": bson.M{"$lt": t}}).Select(bson.M{"_id": 1}).All(&artifacts); err != nil {
+		return 0, err
+	}
+	gridFS := database.Session.DB("").GridFS("artifacts")
+	removed := 0
+	for _, artifact := range artifacts {
+		if err := gridFS.RemoveId(artifact.ID); err != nil && err != mgo.ErrNotFound {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
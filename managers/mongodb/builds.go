@@ -16,29 +16,80 @@ package mongodb
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
 	"time"
 
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 // Build type.
+// The builds of the matrix combinations have no number, but the ParentNumber of their matrix build.
 type Build struct {
-	ID           bson.ObjectId     `bson:"_id,omitempty" json:"id"`
-	Organization string            `bson:"organization" json:"organization"`
-	Repository   string            `bson:"repository" json:"repository"`
-	Event        string            `bson:"event" json:"event"`
-	Branch       string            `bson:"branch" json:"branch"`
-	Pipeline     string            `bson:"pipeline" json:"pipeline"`
-	Status       string            `bson:"status" json:"status"`
-	Error        string            `bson:"error,omitempty" json:"error,omitempty"`
-	Start        *time.Time        `bson:"start" json:"start"`
-	End          *time.Time        `bson:"end,omitempty" json:"end,omitempty"`
-	EnvVars      map[string]string `bson:"envVars" json:"envVars"`
-	Tasks        []*BuildTask      `bson:"tasks" json:"tasks"`
+	ID              bson.ObjectId     `bson:"_id,omitempty" json:"id"`
+	Number          int               `bson:"number,omitempty" json:"number,omitempty"`
+	QueueJob        bson.ObjectId     `bson:"queueJob,omitempty" json:"queueJob,omitempty"`
+	Organization    string            `bson:"organization" json:"organization"`
+	Repository      string            `bson:"repository" json:"repository"`
+	Event           string            `bson:"event" json:"event"`
+	Branch          string            `bson:"branch" json:"branch"`
+	Tag             string            `bson:"tag,omitempty" json:"tag,omitempty"`
+	SHA             string            `bson:"sha,omitempty" json:"sha,omitempty"`
+	CloneURL        string            `bson:"cloneUrl,omitempty" json:"cloneUrl,omitempty"`
+	User            string            `bson:"user,omitempty" json:"user,omitempty"`
+	Commit          *BuildCommit      `bson:"commit,omitempty" json:"commit,omitempty"`
+	PullNumber      int               `bson:"pullNumber,omitempty" json:"pullNumber,omitempty"`
+	PullFork        bool              `bson:"pullFork,omitempty" json:"pullFork,omitempty"`
+	Pipeline        string            `bson:"pipeline" json:"pipeline"`
+	Schedule        string            `bson:"schedule,omitempty" json:"schedule,omitempty"`
+	Status          string            `bson:"status" json:"status"`
+	Error           string            `bson:"error,omitempty" json:"error,omitempty"`
+	Start           *time.Time        `bson:"start" json:"start"`
+	End             *time.Time        `bson:"end,omitempty" json:"end,omitempty"`
+	CancelRequested *time.Time        `bson:"cancelRequested,omitempty" json:"cancelRequested,omitempty"`
+	CancelStatus    string            `bson:"cancelStatus,omitempty" json:"-"`
+	EnvVars         map[string]string `bson:"envVars" json:"envVars"`
+	Graph           []BuildNode       `bson:"graph,omitempty" json:"graph,omitempty"`
+	LogFile         bson.ObjectId     `bson:"logFile,omitempty" json:"-"`
+	Parent          bson.ObjectId     `bson:"parent,omitempty" json:"parent,omitempty"`
+	ParentNumber    int               `bson:"parentNumber,omitempty" json:"parentNumber,omitempty"`
+	Matrix          map[string]string `bson:"matrix,omitempty" json:"matrix,omitempty"`
+	Children        []BuildChild      `bson:"children,omitempty" json:"children,omitempty"`
+	Tasks           []*BuildTask      `bson:"tasks" json:"tasks"`
+}
+
+// BuildCommit type.
+// Metadata of the commit built.
+type BuildCommit struct {
+	Message    string `bson:"message" json:"message"`
+	Author     string `bson:"author" json:"author"`
+	Email      string `bson:"email" json:"email"`
+	CompareURL string `bson:"compareUrl,omitempty" json:"compareUrl,omitempty"`
+}
+
+// BuildChild type.
+// Build of a combination of a matrix build.
+type BuildChild struct {
+	ID     bson.ObjectId     `bson:"id" json:"id"`
+	Matrix map[string]string `bson:"matrix" json:"matrix"`
+	Status string            `bson:"status" json:"status"`
+}
+
+// BuildNode type.
+// Job of a pipeline executed as a dependency graph.
+type BuildNode struct {
+	Name  string   `bson:"name" json:"name"`
+	Needs []string `bson:"needs,omitempty" json:"needs,omitempty"`
+	Level int      `bson:"level" json:"level"`
 }
 
 // BuildTask type.
+// Tasks of the same stage are executed concurrently.
 type BuildTask struct {
+	ID      int        `bson:"id" json:"id"`
+	Stage   int        `bson:"stage" json:"stage"`
 	Name    string     `bson:"name" json:"name"`
 	Command string     `bson:"command" json:"command"`
 	Status  string     `bson:"status" json:"status"`
@@ -47,13 +98,59 @@ type BuildTask struct {
 	End     *time.Time `bson:"end,omitempty" json:"end,omitempty"`
 }
 
-// CreateBuild to insert a new build.
+// CreateBuild to insert a new build. The build gets the next build number of its repository,
+// unless it is the build of a matrix combination.
 func (database *Database) CreateBuild(build *Build) error {
 	collection := database.Session.DB("").C("builds")
 	build.ID = bson.NewObjectId()
+	if build.Number == 0 && build.Parent == "" {
+		number, err := database.NextBuildNumber(build.Organization, build.Repository)
+		if err != nil {
+			return err
+		}
+		build.Number = number
+	}
 	return collection.Insert(*build)
 }
 
+// NextBuildNumber to get the next build number of a repository.
+// The counter of the repository is incremented atomically, so that every build gets a different number.
+func (database *Database) NextBuildNumber(organization, repository string) (int, error) {
+	collection := database.Session.DB("").C("counters")
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"builds": 1}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	var counter struct {
+		Builds int `bson:"builds"`
+	}
+	id := organization + "/" + repository
+	_, err := collection.FindId(id).Apply(change, &counter)
+	if mgo.IsDup(err) {
+		// Concurrent upsert of the first build of the repository
+		_, err = collection.FindId(id).Apply(change, &counter)
+	}
+	return counter.Builds, err
+}
+
+// DisplayNumber gets the number of the build, or the number of its matrix build for a matrix combination.
+func (build *Build) DisplayNumber() int {
+	if build.Number > 0 {
+		return build.Number
+	}
+	return build.ParentNumber
+}
+
+// LogFileName gets the name of the GridFS file with the log of the build.
+// The builds created before the build numbers were introduced are identified by their ID.
+func (build *Build) LogFileName() string {
+	if build.Number > 0 {
+		return fmt.Sprintf("/%s/%s/%d", build.Organization, build.Repository, build.Number)
+	}
+	return fmt.Sprintf("/%s/%s/%s", build.Organization, build.Repository, build.ID.Hex())
+}
+
 // FindBuilds to list the latest 10 builds.
 func (database *Database) FindBuilds() ([]Build, error) {
 	collection := database.Session.DB("").C("builds")
@@ -62,6 +159,43 @@ func (database *Database) FindBuilds() ([]Build, error) {
 	return builds, err
 }
 
+// GetBuild to get a build of a repository.
+func (database *Database) GetBuild(organization, repository string, id bson.ObjectId) (Build, error) {
+	collection := database.Session.DB("").C("builds")
+	var build Build
+	err := collection.Find(bson.M{"_id": id, "organization": organization, "repository": repository}).One(&build)
+	return build, err
+}
+
+// GetBuildByRef to get a build of a repository either by its ID or by its number.
+func (database *Database) GetBuildByRef(organization, repository, ref string) (Build, error) {
+	if bson.IsObjectIdHex(ref) {
+		return database.GetBuild(organization, repository, bson.ObjectIdHex(ref))
+	}
+	number, err := strconv.Atoi(ref)
+	if err != nil || number <= 0 {
+		return Build{}, mgo.ErrNotFound
+	}
+	collection := database.Session.DB("").C("builds")
+	var build Build
+	err = collection.Find(bson.M{"organization": organization, "repository": repository, "number": number}).One(&build)
+	return build, err
+}
+
+// FindRepositoryBuildsBySHA to list the latest 50 builds of a repository for a SHA.
+// The SHA may be abbreviated.
+func (database *Database) FindRepositoryBuildsBySHA(organization, repository, sha string) ([]Build, error) {
+	collection := database.Session.DB("").C("builds")
+	var builds []Build
+	query := bson.M{
+		"organization": organization,
+		"repository":   repository,
+		"sha":          bson.RegEx{Pattern: "^" + regexp.QuoteMeta(sha)},
+	}
+	err := collection.Find(query).Sort("-start").Limit(50).All(&builds)
+	return builds, err
+}
+
 // FindRepositoryBuilds to list the latest 50 builds of a repository.
 func (database *Database) FindRepositoryBuilds(organization, repository string) ([]Build, error) {
 	collection := database.Session.DB("").C("builds")
@@ -79,46 +213,119 @@ func (database *Database) UpdateBuild(id bson.ObjectId, status, error string, en
 	return err
 }
 
+// UpdateBuildGraph to set the dependency graph of the jobs of a build.
+func (database *Database) UpdateBuildGraph(id bson.ObjectId, graph []BuildNode) error {
+	collection := database.Session.DB("").C("builds")
+	return collection.UpdateId(id, bson.M{"$set": bson.M{"graph": graph}})
+}
+
+// UpdateBuildLogFile to set the GridFS file with the log of a build.
+func (database *Database) UpdateBuildLogFile(id, logFile bson.ObjectId) error {
+	collection := database.Session.DB("").C("builds")
+	return collection.UpdateId(id, bson.M{"$set": bson.M{"logFile": logFile}})
+}
+
+// AddBuildChild to insert a child build (of a matrix combination) in a build.
+func (database *Database) AddBuildChild(id bson.ObjectId, child *BuildChild) error {
+	collection := database.Session.DB("").C("builds")
+	return collection.UpdateId(id, bson.M{"$push": bson.M{"children": child}})
+}
+
+// UpdateBuildChild to update the status of a child build in a build.
+func (database *Database) UpdateBuildChild(id, childID bson.ObjectId, status string) error {
+	collection := database.Session.DB("").C("builds")
+	return collection.Update(
+		bson.M{"_id": id, "children.id": childID},
+		bson.M{"$set": bson.M{"children.$.status": status}})
+}
+
+// InterruptBuilds to mark as interrupted the builds, still running, launched by a queue job.
+// It is used when the server instance running the job died before completing the build.
+func (database *Database) InterruptBuilds(queueJob bson.ObjectId) error {
+	collection := database.Session.DB("").C("builds")
+	_, err := collection.UpdateAll(
+		bson.M{"queueJob": queueJob, "status": "running"},
+		bson.M{"$set": bson.M{"status": "interrupted", "end": time.Now()}})
+	return err
+}
+
+// RequestBuildCancel to request the cancellation of a running build.
+// The status is the one to be recorded when the build is cancelled (e.g. "cancelled" or "superseded").
+// The server instance running the build polls the request with GetBuildCancelStatus.
+func (database *Database) RequestBuildCancel(organization, repository string, id bson.ObjectId, status string) error {
+	collection := database.Session.DB("").C("builds")
+	return collection.Update(
+		bson.M{"_id": id, "organization": organization, "repository": repository, "status": "running"},
+		bson.M{"$set": bson.M{"cancelRequested": time.Now(), "cancelStatus": status}})
+}
+
+// GetBuildCancelStatus to get the status requested to cancel a build.
+// It is empty if the cancellation of the build was not requested.
+func (database *Database) GetBuildCancelStatus(id bson.ObjectId) (string, error) {
+	collection := database.Session.DB("").C("builds")
+	var build Build
+	err := collection.FindId(id).Select(bson.M{"cancelStatus": 1}).One(&build)
+	return build.CancelStatus, err
+}
+
+// FindSupersededBuilds to list the running builds of some pipelines of a branch (or of a pull request if pullNumber
+// is not 0) launched by queue jobs older than the queue job passed as parameter and with a different SHA.
+func (database *Database) FindSupersededBuilds(organization, repository, event, branch string, pullNumber int,
+	sha string, queueJob bson.ObjectId, pipelines []string) ([]Build, error) {
+	collection := database.Session.DB("").C("builds")
+	query := bson.M{
+		"organization": organization,
+		"repository":   repository,
+		"event":        event,
+		"pipeline":     bson.M{"$in": pipelines},
+		"status":       "running",
+		"sha":          bson.M{"$ne": sha},
+		"queueJob":     bson.M{"$lt": queueJob},
+	}
+	if pullNumber != 0 {
+		query["pullNumber"] = pullNumber
+	} else {
+		query["branch"] = branch
+	}
+	var builds []Build
+	err := collection.Find(query).All(&builds)
+	return builds, err
+}
+
 // AddBuildTask to insert a task in a build.
 func (database *Database) AddBuildTask(id bson.ObjectId, buildTask *BuildTask) error {
 	collection := database.Session.DB("").C("builds")
 	err := collection.UpdateId(
 		id,
-		bson.M{"$addToSet": bson.M{"tasks": buildTask}})
+		bson.M{"$push": bson.M{"tasks": buildTask}})
 	return err
 }
 
 // UpdateBuildTask to update a task in a build.
-func (database *Database) UpdateBuildTask(id bson.ObjectId, counter int, status, error string, end time.Time) error {
+func (database *Database) UpdateBuildTask(id bson.ObjectId, taskID int, status, error string, end time.Time) error {
 	collection := database.Session.DB("").C("builds")
 	err := collection.Update(
-		bson.M{"_id": id, fmt.Sprintf("tasks.%d", counter): bson.M{"$exists": true}},
+		bson.M{"_id": id, "tasks.id": taskID},
 		bson.M{"$set": bson.M{"tasks.$.status": status, "tasks.$.error": error, "tasks.$.end": end}})
 	return err
 }
 
 // BuildWriter type.
+// Counter is the identifier of the next task. Tasks may be started and ended concurrently.
 type BuildWriter struct {
 	Build    *Build
 	Counter  int
 	Database *Database
+	mutex    sync.Mutex
 }
 
 // NewBuildWriter is a constructor.
-func NewBuildWriter(database *Database, organization, repository, event, branch, pipeline string,
-	envVars map[string]string) (*BuildWriter, error) {
+// It inserts the build, with "running" status, in mongodb.
+func NewBuildWriter(database *Database, build *Build) (*BuildWriter, error) {
 	now := time.Now()
-	build := &Build{
-		Organization: organization,
-		Repository:   repository,
-		Event:        event,
-		Branch:       branch,
-		Pipeline:     pipeline,
-		Status:       "running",
-		Start:        &now,
-		EnvVars:      envVars,
-		Tasks:        []*BuildTask{},
-	}
+	build.Status = "running"
+	build.Start = &now
+	build.Tasks = []*BuildTask{}
 	buildWriter := &BuildWriter{
 		Build:    build,
 		Counter:  0,
@@ -129,22 +336,54 @@ func NewBuildWriter(database *Database, organization, repository, event, branch,
 }
 
 // StartBuildTask to insert a task, with "running" status, in a build.
-func (buildWriter *BuildWriter) StartBuildTask(name, command string) error {
+// It returns the identifier of the task.
+func (buildWriter *BuildWriter) StartBuildTask(stage int, name, command string) (int, error) {
+	buildWriter.mutex.Lock()
+	taskID := buildWriter.Counter
+	buildWriter.Counter++
+	buildWriter.mutex.Unlock()
+
 	now := time.Now()
 	buildTask := &BuildTask{
+		ID:      taskID,
+		Stage:   stage,
 		Name:    name,
 		Command: command,
 		Status:  "running",
 		Start:   &now,
 	}
-	return buildWriter.Database.AddBuildTask(buildWriter.Build.ID, buildTask)
+	return taskID, buildWriter.Database.AddBuildTask(buildWriter.Build.ID, buildTask)
+}
+
+// SkipBuildTask to insert a task, with "skipped" status, in a build.
+func (buildWriter *BuildWriter) SkipBuildTask(stage int, name, command, reason string) error {
+	taskID, err := buildWriter.StartBuildTask(stage, name, command)
+	if err != nil {
+		return err
+	}
+	return buildWriter.EndBuildTask(taskID, "skipped", reason)
+}
+
+// SetGraph to set the dependency graph of the jobs of the build.
+func (buildWriter *BuildWriter) SetGraph(graph []BuildNode) error {
+	buildWriter.Build.Graph = graph
+	return buildWriter.Database.UpdateBuildGraph(buildWriter.Build.ID, graph)
+}
+
+// AddChild to insert a child build, with "running" status, in the build.
+func (buildWriter *BuildWriter) AddChild(childID bson.ObjectId, matrix map[string]string) error {
+	child := &BuildChild{ID: childID, Matrix: matrix, Status: "running"}
+	return buildWriter.Database.AddBuildChild(buildWriter.Build.ID, child)
+}
+
+// EndChild to update a child build, with completed status, in the build.
+func (buildWriter *BuildWriter) EndChild(childID bson.ObjectId, status string) error {
+	return buildWriter.Database.UpdateBuildChild(buildWriter.Build.ID, childID, status)
 }
 
 // EndBuildTask to update a task, with completed status, in a build.
-func (buildWriter *BuildWriter) EndBuildTask(status, error string) error {
-	err := buildWriter.Database.UpdateBuildTask(buildWriter.Build.ID, buildWriter.Counter, status, error, time.Now())
-	buildWriter.Counter++
-	return err
+func (buildWriter *BuildWriter) EndBuildTask(taskID int, status, error string) error {
+	return buildWriter.Database.UpdateBuildTask(buildWriter.Build.ID, taskID, status, error, time.Now())
 }
 
 // EndBuild to update a build with completion status.
@@ -0,0 +1,106 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodb
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Cache type.
+// Metadata of a tarball with the cache directories of the builds of a repository branch, or of a pull request
+// (Pull) to the branch. The caches are stored in the "caches" GridFS, and they are identified by their key.
+type Cache struct {
+	Organization string    `bson:"organization" json:"organization"`
+	Repository   string    `bson:"repository" json:"repository"`
+	Branch       string    `bson:"branch" json:"branch"`
+	Pull         int       `bson:"pull,omitempty" json:"pull,omitempty"`
+	Key          string    `bson:"key" json:"key"`
+	LastUsed     time.Time `bson:"lastUsed" json:"lastUsed"`
+}
+
+// CacheFile type.
+// Stored cache, with the metadata of its GridFS file.
+type CacheFile struct {
+	ID         bson.ObjectId `bson:"_id" json:"id"`
+	Length     int64         `bson:"length" json:"size"`
+	UploadDate time.Time     `bson:"uploadDate" json:"uploadDate"`
+	Cache      `bson:"metadata"`
+}
+
+// CreateCache to create the GridFS file of a cache.
+func (database *Database) CreateCache(cache *Cache) (*mgo.GridFile, error) {
+	file, err := database.Session.DB("").GridFS("caches").Create(cache.Key)
+	if err != nil {
+		return nil, err
+	}
+	file.SetMeta(cache)
+	return file, nil
+}
+
+// FindCache to get the latest cache of a repository branch with a key. The caches of a pull request are
+// only found with its number (pull), and the caches of the branch with pull 0.
+func (database *Database) FindCache(organization, repository, branch string, pull int, key string) (*CacheFile, error) {
+	collection := database.Session.DB("").C("caches.files")
+	query := bson.M{
+		"metadata.organization": organization,
+		"metadata.repository":   repository,
+		"metadata.branch":       branch,
+		"metadata.pull":         pull,
+		"metadata.key":          key,
+	}
+	if pull == 0 {
+		query["metadata.pull"] = bson.M{"$exists": false}
+	}
+	var cache CacheFile
+	err := collection.Find(query).Sort("-uploadDate").One(&cache)
+	if err != nil {
+		return nil, err
+	}
+	return &cache, nil
+}
+
+// OpenCache to open the GridFS file of a cache, and register that it is used.
+func (database *Database) OpenCache(id bson.ObjectId) (*mgo.GridFile, error) {
+	collection := database.Session.DB("").C("caches.files")
+	if err := collection.UpdateId(id, bson.M{"$set": bson.M{"metadata.lastUsed": time.Now()}}); err != nil {
+		return nil, err
+	}
+	return database.Session.DB("").GridFS("caches").OpenId(id)
+}
+
+// FindCaches to get the caches of a repository (or of all the repositories if organization is empty),
+// sorted from the least recently used.
+func (database *Database) FindCaches(organization, repository string) ([]CacheFile, error) {
+	collection := database.Session.DB("").C("caches.files")
+	query := bson.M{}
+	if organization != "" {
+		query = bson.M{"metadata.organization": organization, "metadata.repository": repository}
+	}
+	var caches []CacheFile
+	err := collection.Find(query).Sort("metadata.lastUsed").All(&caches)
+	return caches, err
+}
+
+// RemoveCache to remove a cache.
+func (database *Database) RemoveCache(id bson.ObjectId) error {
+	err := database.Session.DB("").GridFS("caches").RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -18,6 +18,7 @@ import (
 	"log"
 
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // Config type.
@@ -38,7 +39,30 @@ func NewDatabase(mongodbConfig *Config) (*Database, error) {
 		return nil, err
 	}
 	session.SetMode(mgo.Monotonic, true)
-	return &Database{session}, nil
+	database := &Database{session}
+	if err := database.EnsureIndexes(); err != nil {
+		log.Println("Error creating the indexes.", err)
+	}
+	return database, nil
+}
+
+// EnsureIndexes creates the indexes of the collections, if they do not exist yet.
+// The build numbers are unique per repository (the builds without number are not indexed), and
+// the log lines are found by build and number.
+func (database *Database) EnsureIndexes() error {
+	command := bson.D{
+		{Name: "createIndexes", Value: "builds"},
+		{Name: "indexes", Value: []bson.M{{
+			"name":                    "organization_repository_number",
+			"key":                     bson.D{{Name: "organization", Value: 1}, {Name: "repository", Value: 1}, {Name: "number", Value: 1}},
+			"unique":                  true,
+			"partialFilterExpression": bson.M{"number": bson.M{"$exists": true}},
+		}}},
+	}
+	if err := database.Session.DB("").Run(command, nil); err != nil {
+		return err
+	}
+	return database.Session.DB("").C("logs").EnsureIndex(mgo.Index{Key: []string{"build", "number"}})
 }
 
 // Close to close the mongodb session.
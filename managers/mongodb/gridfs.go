@@ -14,7 +14,17 @@
 
 package mongodb
 
-import "gopkg.in/mgo.v2"
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FileChunk type.
+// Chunk of a GridFS file.
+type FileChunk struct {
+	N    int    `bson:"n"`
+	Data []byte `bson:"data"`
+}
 
 // CreateFile to create a file in mongodb with GridFS.
 func (database *Database) CreateFile(filename string) (file *mgo.GridFile, err error) {
@@ -25,3 +35,12 @@ func (database *Database) CreateFile(filename string) (file *mgo.GridFile, err e
 func (database *Database) OpenFile(filename string) (file *mgo.GridFile, err error) {
 	return database.Session.DB("").GridFS("fs").Open(filename)
 }
+
+// FindFileChunks to get the chunks of a GridFS file, from a chunk number. The file may be still open
+// for writing: the chunks are stored once they are complete.
+func (database *Database) FindFileChunks(fileID bson.ObjectId, from int) ([]FileChunk, error) {
+	collection := database.Session.DB("").C("fs.chunks")
+	var chunks []FileChunk
+	err := collection.Find(bson.M{"files_id": fileID, "n": bson.M{"$gte": from}}).Sort("n").All(&chunks)
+	return chunks, err
+}
@@ -26,6 +26,7 @@ type Hook struct {
 	Organization string `bson:"organization"`
 	Repository   string `bson:"repository"`
 	AccessToken  string `bson:"accessToken"`
+	Secret       string `bson:"secret"`
 }
 
 // FindHooks to retrieve the list of hooks available for an organization.
@@ -37,6 +38,14 @@ func (database *Database) FindHooks(organization string) []Hook {
 	return hooks
 }
 
+// FindAllHooks to retrieve the hooks of all the organizations.
+func (database *Database) FindAllHooks() ([]Hook, error) {
+	collection := database.Session.DB("").C("hooks")
+	var hooks []Hook
+	err := collection.Find(nil).All(&hooks)
+	return hooks, err
+}
+
 // GetHook to get a hook for a repository.
 func (database *Database) GetHook(organization string, repository string) (Hook, error) {
 	collection := database.Session.DB("").C("hooks")
@@ -46,13 +55,19 @@ func (database *Database) GetHook(organization string, repository string) (Hook,
 }
 
 // CreateHook to create a hook for a repository.
-func (database *Database) CreateHook(id int, organization, repository, accessToken string) {
+func (database *Database) CreateHook(id int, organization, repository, accessToken, secret string) {
 	collection := database.Session.DB("").C("hooks")
-	doc := Hook{id, organization, repository, accessToken}
+	doc := Hook{id, organization, repository, accessToken, secret}
 	err := collection.Insert(doc)
 	log.Println(err)
 }
 
+// UpdateHookSecret to replace the secret used to sign the events delivered by a hook.
+func (database *Database) UpdateHookSecret(id int, secret string) error {
+	collection := database.Session.DB("").C("hooks")
+	return collection.UpdateId(id, bson.M{"$set": bson.M{"secret": secret}})
+}
+
 // DeleteHook to remove a hook for a repository.
 func (database *Database) DeleteHook(id int) {
 	collection := database.Session.DB("").C("hooks")
@@ -0,0 +1,99 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodb
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// LogLine type.
+// Line of the log of a build. The lines are numbered in order for every build, and they are segmented by
+// task (e.g. "image", "clone" or a job name). The stream is "stdout", "stderr" or "system" for the lines
+// written by gocilla.
+type LogLine struct {
+	ID     bson.ObjectId `bson:"_id,omitempty" json:"-"`
+	Build  bson.ObjectId `bson:"build" json:"-"`
+	Number int           `bson:"number" json:"number"`
+	Task   string        `bson:"task" json:"task"`
+	Stream string        `bson:"stream" json:"stream"`
+	Time   time.Time     `bson:"time" json:"time"`
+	Text   string        `bson:"text" json:"text"`
+}
+
+// DefaultLogLinesLimit is the number of log lines found when the query has no limit.
+const DefaultLogLinesLimit = 1000
+
+// MaxLogLinesLimit is the maximum number of log lines found by a query.
+const MaxLogLinesLimit = 10000
+
+// LogLineQuery type.
+// Filter of the lines of the log of a build. Zero values are not applied, but for Limit, that is
+// DefaultLogLinesLimit by default and MaxLogLinesLimit at most.
+// From and To are the first and last line numbers, and Since selects the lines written after a time.
+type LogLineQuery struct {
+	Task   string
+	Stream string
+	From   int
+	To     int
+	Since  time.Time
+	Limit  int
+}
+
+// InsertLogLines to store lines of the log of a build.
+func (database *Database) InsertLogLines(lines []LogLine) error {
+	collection := database.Session.DB("").C("logs")
+	docs := make([]interface{}, len(lines))
+	for i := range lines {
+		lines[i].ID = bson.NewObjectId()
+		docs[i] = lines[i]
+	}
+	return collection.Insert(docs...)
+}
+
+// FindLogLines to get the lines of the log of a build, sorted by number.
+func (database *Database) FindLogLines(build bson.ObjectId, query LogLineQuery) ([]LogLine, error) {
+	collection := database.Session.DB("").C("logs")
+	filter := bson.M{"build": build}
+	if query.Task != "" {
+		filter["task"] = query.Task
+	}
+	if query.Stream != "" {
+		filter["stream"] = query.Stream
+	}
+	number := bson.M{}
+	if query.From > 0 {
+		number["$gte"] = query.From
+	}
+	if query.To > 0 {
+		number["$lte"] = query.To
+	}
+	if len(number) > 0 {
+		filter["number"] = number
+	}
+	if !query.Since.IsZero() {
+		filter["time"] = bson.M{"$gt": query.Since}
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultLogLinesLimit
+	} else if limit > MaxLogLinesLimit {
+		limit = MaxLogLinesLimit
+	}
+	lines := []LogLine{}
+	err := collection.Find(filter).Sort("number").Limit(limit).All(&lines)
+	return lines, err
+}
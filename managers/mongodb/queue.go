@@ -0,0 +1,160 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodb
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// QueueJob type.
+// A build request waiting in the queue (status "queued") or claimed by a worker (status "running").
+// The worker holds a lease on the job that must be renewed while the build is in progress.
+type QueueJob struct {
+	ID           bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	Organization string        `bson:"organization" json:"organization"`
+	Repository   string        `bson:"repository" json:"repository"`
+	Event        string        `bson:"event" json:"event"`
+	Branch       string        `bson:"branch" json:"branch"`
+	SHA          string        `bson:"sha" json:"sha"`
+	PullNumber   int           `bson:"pullNumber,omitempty" json:"pullNumber,omitempty"`
+	Payload      bson.Raw      `bson:"payload" json:"-"`
+	Status       string        `bson:"status" json:"status"`
+	Instance     string        `bson:"instance,omitempty" json:"instance,omitempty"`
+	Worker       string        `bson:"worker,omitempty" json:"worker,omitempty"`
+	Attempts     int           `bson:"attempts" json:"attempts"`
+	Created      *time.Time    `bson:"created" json:"created"`
+	Started      *time.Time    `bson:"started,omitempty" json:"started,omitempty"`
+	LeaseExpiry  *time.Time    `bson:"leaseExpiry,omitempty" json:"leaseExpiry,omitempty"`
+}
+
+// EnqueueJob to insert a new job, with "queued" status, in the queue.
+func (database *Database) EnqueueJob(job *QueueJob) error {
+	collection := database.Session.DB("").C("queue")
+	now := time.Now()
+	job.ID = bson.NewObjectId()
+	job.Status = "queued"
+	job.Created = &now
+	return collection.Insert(*job)
+}
+
+// ClaimQueueJob to take the oldest queued job on behalf of a worker.
+// The job is updated atomically so that it is never claimed by two workers. It returns nil if the queue is empty.
+func (database *Database) ClaimQueueJob(instance, worker string, lease time.Duration) (*QueueJob, error) {
+	collection := database.Session.DB("").C("queue")
+	now := time.Now()
+	change := mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{"status": "running", "instance": instance, "worker": worker, "started": now, "leaseExpiry": now.Add(lease)},
+			"$inc": bson.M{"attempts": 1},
+		},
+		ReturnNew: true,
+	}
+	var job QueueJob
+	_, err := collection.Find(bson.M{"status": "queued"}).Sort("created").Apply(change, &job)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// RenewQueueJobLease to extend the lease of a job while the worker is still running it.
+func (database *Database) RenewQueueJobLease(id bson.ObjectId, instance, worker string, lease time.Duration) error {
+	collection := database.Session.DB("").C("queue")
+	return collection.Update(
+		bson.M{"_id": id, "instance": instance, "worker": worker, "status": "running"},
+		bson.M{"$set": bson.M{"leaseExpiry": time.Now().Add(lease)}})
+}
+
+// RemoveQueueJob to remove a running job from the queue, only if it is still claimed by the worker of the
+// server instance. It returns mgo.ErrNotFound if the worker lost the job (e.g. its lease expired and the job
+// was requeued and claimed by another instance).
+func (database *Database) RemoveQueueJob(id bson.ObjectId, instance, worker string) error {
+	collection := database.Session.DB("").C("queue")
+	return collection.Remove(bson.M{"_id": id, "instance": instance, "worker": worker, "status": "running"})
+}
+
+// SupersedeQueueJobs to remove from the queue the jobs of a branch (or of a pull request if pullNumber is not 0)
+// created before the job passed as parameter and with a different SHA. It returns the removed jobs.
+// Jobs already claimed by a worker are not removed.
+func (database *Database) SupersedeQueueJobs(job *QueueJob) ([]QueueJob, error) {
+	collection := database.Session.DB("").C("queue")
+	query := bson.M{
+		"organization": job.Organization,
+		"repository":   job.Repository,
+		"event":        job.Event,
+		"status":       "queued",
+		"sha":          bson.M{"$ne": job.SHA},
+		"_id":          bson.M{"$lt": job.ID},
+	}
+	if job.PullNumber != 0 {
+		query["pullNumber"] = job.PullNumber
+	} else {
+		query["branch"] = job.Branch
+	}
+	var jobs, superseded []QueueJob
+	if err := collection.Find(query).All(&jobs); err != nil {
+		return nil, err
+	}
+	for _, queuedJob := range jobs {
+		err := collection.Remove(bson.M{"_id": queuedJob.ID, "status": "queued"})
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return superseded, err
+		}
+		superseded = append(superseded, queuedJob)
+	}
+	return superseded, nil
+}
+
+// RequeueJob to release a running job so that it is claimed again by a worker, only if it is still
+// claimed by the worker of the server instance. It returns mgo.ErrNotFound otherwise.
+func (database *Database) RequeueJob(id bson.ObjectId, instance, worker string) error {
+	collection := database.Session.DB("").C("queue")
+	return collection.Update(
+		bson.M{"_id": id, "instance": instance, "worker": worker, "status": "running"},
+		bson.M{"$set": bson.M{"status": "queued"}, "$unset": bson.M{"instance": "", "worker": "", "leaseExpiry": ""}})
+}
+
+// FindInstanceJobs to list the running jobs claimed by the workers of a server instance.
+func (database *Database) FindInstanceJobs(instance string) ([]QueueJob, error) {
+	collection := database.Session.DB("").C("queue")
+	var jobs []QueueJob
+	err := collection.Find(bson.M{"status": "running", "instance": instance}).All(&jobs)
+	return jobs, err
+}
+
+// FindExpiredJobs to list the running jobs whose lease has expired (e.g. the server instance died).
+func (database *Database) FindExpiredJobs() ([]QueueJob, error) {
+	collection := database.Session.DB("").C("queue")
+	var jobs []QueueJob
+	err := collection.Find(bson.M{"status": "running", "leaseExpiry": bson.M{"$lt": time.Now()}}).All(&jobs)
+	return jobs, err
+}
+
+// FindQueueJobs to list all the jobs in the queue, sorted by creation time.
+func (database *Database) FindQueueJobs() ([]QueueJob, error) {
+	collection := database.Session.DB("").C("queue")
+	var jobs []QueueJob
+	err := collection.Find(bson.M{}).Sort("created").All(&jobs)
+	return jobs, err
+}
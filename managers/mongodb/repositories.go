@@ -14,19 +14,37 @@
 
 package mongodb
 
-import "fmt"
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
 
 // Repository type.
+// Docker is the access of the build containers to a docker daemon: none (empty), "socket" or "dind".
+// The pull requests from forks are only built if BuildForks is set.
 type Repository struct {
-	OrgID   string           `bson:"organization" json:"orgId"`
-	RepoID  string           `bson:"repository" json:"repoId"`
-	EnvVars []PipelineEnvVar `bson:"envVars" json:"envVars"`
+	OrgID      string           `bson:"organization" json:"orgId"`
+	RepoID     string           `bson:"repository" json:"repoId"`
+	EnvVars    []PipelineEnvVar `bson:"envVars" json:"envVars"`
+	Docker     string           `bson:"docker,omitempty" json:"docker"`
+	BuildForks bool             `bson:"buildForks,omitempty" json:"buildForks"`
 }
 
 // PipelineEnvVar type.
+// The value of a secret variable is not stored as Value, but encrypted with the key KeyID.
+// The variable is only set in the builds of the Branches (patterns, any branch if empty). A secret or
+// branch-restricted variable is only set in the builds of pull requests if PullRequests is set, and
+// no variable is set in the builds of pull requests from forks unless Forks is set.
 type PipelineEnvVar struct {
-	Name  string `bson:"name" json:"name"`
-	Value string `bson:"value" json:"value"`
+	Name         string   `bson:"name" json:"name"`
+	Value        string   `bson:"value" json:"value"`
+	Secret       bool     `bson:"secret" json:"secret"`
+	Branches     []string `bson:"branches,omitempty" json:"branches,omitempty"`
+	PullRequests bool     `bson:"pullRequests,omitempty" json:"pullRequests,omitempty"`
+	Forks        bool     `bson:"forks,omitempty" json:"forks,omitempty"`
+	Encrypted    string   `bson:"encrypted,omitempty" json:"-"`
+	KeyID        string   `bson:"keyId,omitempty" json:"-"`
 }
 
 // GetRepository to get a repository (settings).
@@ -48,3 +66,33 @@ func (database *Database) UpdateRepository(repository *Repository) error {
 	_, err := collection.UpsertId(ID, repository)
 	return err
 }
+
+// UpdateEncryptedEnvVar to update the encrypted value of a secret variable of a repository, only if the stored
+// variable is still the previous one (e.g. the settings were not updated meanwhile). Otherwise, it returns
+// mgo.ErrNotFound.
+func (database *Database) UpdateEncryptedEnvVar(repository *Repository, previous, envVar *PipelineEnvVar) error {
+	ID := fmt.Sprintf("%s/%s", repository.OrgID, repository.RepoID)
+	collection := database.Session.DB("").C("repositories")
+	match := bson.M{"name": previous.Name, "secret": true}
+	if previous.Encrypted != "" {
+		match["encrypted"] = previous.Encrypted
+	} else {
+		match["encrypted"] = bson.M{"$exists": false}
+		match["value"] = previous.Value
+	}
+	return collection.Update(
+		bson.M{"_id": ID, "envVars": bson.M{"$elemMatch": match}},
+		bson.M{"$set": bson.M{
+			"envVars.$.value":     envVar.Value,
+			"envVars.$.encrypted": envVar.Encrypted,
+			"envVars.$.keyId":     envVar.KeyID,
+		}})
+}
+
+// FindAllRepositories to get the settings of all the repositories.
+func (database *Database) FindAllRepositories() ([]Repository, error) {
+	collection := database.Session.DB("").C("repositories")
+	var repositories []Repository
+	err := collection.Find(nil).All(&repositories)
+	return repositories, err
+}
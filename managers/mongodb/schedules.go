@@ -0,0 +1,72 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodb
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ScheduleRun type.
+// Execution of a scheduled trigger at a given minute. Its identifier is unique for the repository,
+// trigger and minute, so that the execution is claimed by a single server instance.
+type ScheduleRun struct {
+	ID           string    `bson:"_id" json:"id"`
+	Organization string    `bson:"organization" json:"organization"`
+	Repository   string    `bson:"repository" json:"repository"`
+	Trigger      string    `bson:"trigger" json:"trigger"`
+	Time         time.Time `bson:"time" json:"time"`
+}
+
+// ClaimScheduleRun to register the execution of a scheduled trigger at a given time.
+// It returns false if the execution was already registered (e.g. by another server instance).
+func (database *Database) ClaimScheduleRun(organization, repository, trigger string, t time.Time) (bool, error) {
+	collection := database.Session.DB("").C("schedules")
+	t = t.UTC().Truncate(time.Minute)
+	run := ScheduleRun{
+		ID:           scheduleRunID(organization, repository, trigger, t),
+		Organization: organization,
+		Repository:   repository,
+		Trigger:      trigger,
+		Time:         t,
+	}
+	err := collection.Insert(run)
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseScheduleRun to remove the execution of a scheduled trigger at a given time, so that it can be claimed again
+// (e.g. when it could not be enqueued).
+func (database *Database) ReleaseScheduleRun(organization, repository, trigger string, t time.Time) error {
+	collection := database.Session.DB("").C("schedules")
+	return collection.RemoveId(scheduleRunID(organization, repository, trigger, t.UTC().Truncate(time.Minute)))
+}
+
+// scheduleRunID gets the identifier of the execution of a scheduled trigger at a given minute.
+func scheduleRunID(organization, repository, trigger string, t time.Time) string {
+	return fmt.Sprintf("%s/%s/%s/%s", organization, repository, trigger, t.Format(time.RFC3339))
+}
+
+// RemoveScheduleRuns to remove the executions of scheduled triggers older than a given time.
+func (database *Database) RemoveScheduleRuns(before time.Time) error {
+	collection := database.Session.DB("").C("schedules")
+	_, err := collection.RemoveAll(bson.M{"time": bson.M{"$lt": before}})
+	return err
+}
@@ -0,0 +1,222 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/gocilla/gocilla/managers/build"
+	"github.com/gocilla/gocilla/managers/github"
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+// pollInterval is the time a worker waits before looking for new jobs when the queue is empty.
+const pollInterval = 5 * time.Second
+
+// Config type.
+type Config struct {
+	Instance     string
+	Workers      int
+	LeaseSeconds int `json:"leaseSeconds"`
+	MaxAttempts  int `json:"maxAttempts"`
+}
+
+// Manager type.
+// Manager to queue the builds in mongodb and to execute them with a pool of workers.
+// Every job claimed by a worker is leased to the server instance. If the instance dies,
+// the lease expires and the job is requeued (or discarded after MaxAttempts) by another instance.
+type Manager struct {
+	Config       *Config
+	Database     *mongodb.Database
+	BuildManager *build.Manager
+	wakeup       chan struct{}
+}
+
+// NewManager is the constructor of Manager.
+func NewManager(config *Config, database *mongodb.Database, buildManager *build.Manager) *Manager {
+	if config == nil {
+		config = &Config{}
+	}
+	if config.Instance == "" {
+		config.Instance, _ = os.Hostname()
+	}
+	if config.Workers <= 0 {
+		config.Workers = 2
+	}
+	if config.LeaseSeconds <= 0 {
+		config.LeaseSeconds = 60
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 2
+	}
+	return &Manager{config, database, buildManager, make(chan struct{}, 1)}
+}
+
+// Start recovers the jobs interrupted by a previous execution of this server instance and
+// launches the pool of workers.
+func (queueManager *Manager) Start() {
+	jobs, err := queueManager.Database.FindInstanceJobs(queueManager.Config.Instance)
+	if err != nil {
+		log.Printf("Error finding the interrupted jobs of instance '%s'. %s", queueManager.Config.Instance, err)
+	}
+	for _, job := range jobs {
+		queueManager.release(&job)
+	}
+	for i := 1; i <= queueManager.Config.Workers; i++ {
+		go queueManager.work(fmt.Sprintf("worker-%d", i))
+	}
+	go queueManager.reap()
+	log.Printf("Started %d queue workers for instance '%s'", queueManager.Config.Workers, queueManager.Config.Instance)
+}
+
+// Enqueue a GitHub event to be built by the first available worker.
+func (queueManager *Manager) Enqueue(event *github.Event) error {
+	payload, err := bson.Marshal(event)
+	if err != nil {
+		return err
+	}
+	job := &mongodb.QueueJob{
+		Organization: event.Organization,
+		Repository:   event.Repository,
+		Event:        event.Type,
+		Branch:       event.Branch,
+		SHA:          event.CommitSHA(),
+		Payload:      bson.Raw{Kind: 0x03, Data: payload},
+	}
+	if event.Pull != nil {
+		job.PullNumber = event.Pull.Number
+	}
+	if err := queueManager.Database.EnqueueJob(job); err != nil {
+		return err
+	}
+	log.Printf("Enqueued job '%s' for event '%s' on %s/%s", job.ID.Hex(), event.Type, event.Organization, event.Repository)
+	select {
+	case queueManager.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (queueManager *Manager) lease() time.Duration {
+	return time.Duration(queueManager.Config.LeaseSeconds) * time.Second
+}
+
+// work is the loop of a worker: it claims the oldest queued job and builds it.
+func (queueManager *Manager) work(worker string) {
+	for {
+		job, err := queueManager.Database.ClaimQueueJob(queueManager.Config.Instance, worker, queueManager.lease())
+		if err != nil {
+			log.Printf("Error claiming a job by %s. %s", worker, err)
+		}
+		if job == nil {
+			select {
+			case <-queueManager.wakeup:
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+		queueManager.process(worker, job)
+	}
+}
+
+// process builds the event of a job and removes it from the queue when the build is completed.
+// The job is not removed if the worker lost its lease, as it may be running in another instance.
+func (queueManager *Manager) process(worker string, job *mongodb.QueueJob) {
+	log.Printf("Job '%s' claimed by %s (attempt %d)", job.ID.Hex(), worker, job.Attempts)
+	var event github.Event
+	if err := job.Payload.Unmarshal(&event); err != nil {
+		log.Printf("Error decoding the event of job '%s'. %s", job.ID.Hex(), err)
+	} else {
+		done := make(chan struct{})
+		go queueManager.renewLease(worker, job, done)
+		if err := queueManager.BuildManager.Build(&event, job); err != nil {
+			log.Println("Error in build", err)
+		}
+		close(done)
+	}
+	err := queueManager.Database.RemoveQueueJob(job.ID, queueManager.Config.Instance, worker)
+	if err == mgo.ErrNotFound {
+		log.Printf("Job '%s' not removed from the queue as %s lost its lease", job.ID.Hex(), worker)
+	} else if err != nil {
+		log.Printf("Error removing job '%s' from the queue. %s", job.ID.Hex(), err)
+	}
+}
+
+// renewLease keeps the lease of a job alive until the done channel is closed.
+// If the lease is lost (the job is no longer claimed by the worker, or the lease expired without being renewed),
+// the builds of the job are cancelled, as the job may be requeued and built by another instance.
+func (queueManager *Manager) renewLease(worker string, job *mongodb.QueueJob, done chan struct{}) {
+	ticker := time.NewTicker(queueManager.lease() / 3)
+	defer ticker.Stop()
+	expiry := time.Now().Add(queueManager.lease())
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			err := queueManager.Database.RenewQueueJobLease(job.ID, queueManager.Config.Instance, worker, queueManager.lease())
+			if err == nil {
+				expiry = now.Add(queueManager.lease())
+				continue
+			}
+			log.Printf("Error renewing the lease of job '%s'. %s", job.ID.Hex(), err)
+			if err == mgo.ErrNotFound || now.After(expiry) {
+				log.Printf("Lease of job '%s' lost by %s", job.ID.Hex(), worker)
+				queueManager.BuildManager.CancelQueueJob(job.ID, "interrupted")
+				return
+			}
+		}
+	}
+}
+
+// reap releases periodically the jobs whose lease expired because their server instance died.
+func (queueManager *Manager) reap() {
+	for range time.Tick(queueManager.lease()) {
+		jobs, err := queueManager.Database.FindExpiredJobs()
+		if err != nil {
+			log.Printf("Error finding the expired jobs. %s", err)
+			continue
+		}
+		for _, job := range jobs {
+			queueManager.release(&job)
+		}
+	}
+}
+
+// release a job whose worker died. The build in progress is marked as interrupted, and
+// the job is requeued unless it already reached the maximum number of attempts.
+func (queueManager *Manager) release(job *mongodb.QueueJob) {
+	if err := queueManager.Database.InterruptBuilds(job.ID); err != nil {
+		log.Printf("Error interrupting the builds of job '%s'. %s", job.ID.Hex(), err)
+	}
+	if job.Attempts >= queueManager.Config.MaxAttempts {
+		log.Printf("Discarding job '%s' after %d attempts", job.ID.Hex(), job.Attempts)
+		if err := queueManager.Database.RemoveQueueJob(job.ID, job.Instance, job.Worker); err != nil {
+			log.Printf("Error discarding job '%s'. %s", job.ID.Hex(), err)
+		}
+		return
+	}
+	log.Printf("Requeuing interrupted job '%s'", job.ID.Hex())
+	if err := queueManager.Database.RequeueJob(job.ID, job.Instance, job.Worker); err != nil {
+		log.Printf("Error requeuing job '%s'. %s", job.ID.Hex(), err)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gocilla/gocilla/managers/build"
+	"github.com/gocilla/gocilla/managers/cron"
+	"github.com/gocilla/gocilla/managers/github"
+	"github.com/gocilla/gocilla/managers/mongodb"
+	"github.com/gocilla/gocilla/managers/oauth2"
+	"github.com/gocilla/gocilla/managers/queue"
+)
+
+// scheduleRunsRetention is the time the executions of scheduled triggers are kept in mongodb.
+const scheduleRunsRetention = 24 * time.Hour
+
+// maxCatchUp is the maximum delay of the evaluation of a minute. Older minutes not evaluated yet
+// (e.g. after the server was suspended) are skipped.
+const maxCatchUp = time.Hour
+
+// evaluateConcurrency is the maximum number of repositories whose schedules are evaluated concurrently.
+const evaluateConcurrency = 8
+
+// Config type.
+type Config struct {
+	Disabled           bool
+	SpecRefreshMinutes int `json:"specRefreshMinutes"`
+}
+
+// Manager type.
+// Manager to launch the builds of the scheduled triggers (event "schedule") of the hooked repositories.
+// Every minute, the schedules of the build spec (.gocilla.yml) in the default branch of every repository
+// are evaluated. The build spec is cached for SpecRefreshMinutes. Every execution of a scheduled trigger
+// is claimed in mongodb, so that it is enqueued exactly once when several server instances are running.
+// The build loads the build spec of the branch built: if it has no trigger with the schedule name, a skipped build
+// is registered.
+type Manager struct {
+	Config        *Config
+	Database      *mongodb.Database
+	OAuth2Manager *oauth2.Manager
+	GitHubManager *github.Manager
+	BuildManager  *build.Manager
+	QueueManager  *queue.Manager
+	specs         map[string]*cachedSpec
+	mutex         sync.Mutex
+}
+
+// cachedSpec type.
+// Build spec of a repository, nil if it could not be read.
+type cachedSpec struct {
+	spec   *build.Spec
+	loaded time.Time
+}
+
+// NewManager is the constructor of Manager.
+func NewManager(config *Config, database *mongodb.Database, oauth2Manager *oauth2.Manager, githubManager *github.Manager,
+	buildManager *build.Manager, queueManager *queue.Manager) *Manager {
+	if config == nil {
+		config = &Config{}
+	}
+	if config.SpecRefreshMinutes <= 0 {
+		config.SpecRefreshMinutes = 15
+	}
+	return &Manager{
+		Config:        config,
+		Database:      database,
+		OAuth2Manager: oauth2Manager,
+		GitHubManager: githubManager,
+		BuildManager:  buildManager,
+		QueueManager:  queueManager,
+		specs:         make(map[string]*cachedSpec),
+	}
+}
+
+// Start launches the evaluation of the schedules at the beginning of every minute.
+// If an evaluation takes longer than a minute, the minutes missed are evaluated afterwards (up to maxCatchUp).
+func (schedulerManager *Manager) Start() {
+	if schedulerManager.Config.Disabled {
+		log.Println("Scheduler disabled")
+		return
+	}
+	go func() {
+		last := time.Now().Truncate(time.Minute)
+		for {
+			next := last.Add(time.Minute)
+			now := time.Now()
+			if now.Before(next) {
+				time.Sleep(next.Sub(now))
+			} else if now.Sub(next) > maxCatchUp {
+				log.Printf("Skipping the schedules from %s to %s", next.Format(time.RFC3339), now.Truncate(time.Minute).Add(-time.Minute).Format(time.RFC3339))
+				next = now.Truncate(time.Minute)
+			}
+			schedulerManager.Evaluate(next)
+			last = next
+		}
+	}()
+}
+
+// Evaluate the schedules of all the hooked repositories at a given minute.
+// Up to evaluateConcurrency repositories are evaluated concurrently.
+func (schedulerManager *Manager) Evaluate(t time.Time) {
+	hooks, err := schedulerManager.Database.FindAllHooks()
+	if err != nil {
+		log.Printf("Error getting the hooks to evaluate the schedules. %s", err)
+		return
+	}
+	semaphore := make(chan struct{}, evaluateConcurrency)
+	var wg sync.WaitGroup
+	for _, hook := range hooks {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(hook mongodb.Hook) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			schedulerManager.evaluateHook(hook, t)
+		}(hook)
+	}
+	wg.Wait()
+	if t.Minute() == 0 {
+		if err := schedulerManager.Database.RemoveScheduleRuns(t.Add(-scheduleRunsRetention)); err != nil {
+			log.Printf("Error removing old schedule runs. %s", err)
+		}
+	}
+}
+
+// evaluateHook evaluates the schedules of a repository and enqueues the builds of the scheduled triggers.
+func (schedulerManager *Manager) evaluateHook(hook mongodb.Hook, t time.Time) {
+	githubClient := schedulerManager.GitHubManager.NewClient(schedulerManager.OAuth2Manager.GetClientFromAccessToken(hook.AccessToken))
+	buildSpec := schedulerManager.getSpec(githubClient, hook, t)
+	if buildSpec == nil {
+		return
+	}
+	for _, trigger := range buildSpec.Triggers {
+		if trigger.Event != github.EventTypeSchedule {
+			continue
+		}
+		if err := trigger.Validate(); err != nil {
+			log.Printf("Invalid trigger in %s/%s. %s", hook.Organization, hook.Repository, err)
+			continue
+		}
+		schedule, err := cron.Parse(trigger.Schedule)
+		if err != nil {
+			log.Printf("Invalid schedule of trigger '%s' in %s/%s. %s", trigger.Name, hook.Organization, hook.Repository, err)
+			continue
+		}
+		if !schedule.Match(t.UTC()) {
+			continue
+		}
+		claimed, err := schedulerManager.Database.ClaimScheduleRun(hook.Organization, hook.Repository, trigger.Name, t)
+		if err != nil {
+			log.Printf("Error claiming the schedule of trigger '%s' in %s/%s. %s", trigger.Name, hook.Organization, hook.Repository, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		if err := schedulerManager.enqueue(githubClient, hook, &trigger); err != nil {
+			log.Printf("Error enqueuing the schedule of trigger '%s' in %s/%s. %s", trigger.Name, hook.Organization, hook.Repository, err)
+			// Release the claim, so that the schedule is not lost if another server instance evaluates it later
+			if err := schedulerManager.Database.ReleaseScheduleRun(hook.Organization, hook.Repository, trigger.Name, t); err != nil {
+				log.Printf("Error releasing the schedule of trigger '%s' in %s/%s. %s", trigger.Name, hook.Organization, hook.Repository, err)
+			}
+		}
+	}
+}
+
+// enqueue resolves the head of the branch of a scheduled trigger and enqueues a schedule event to build it.
+func (schedulerManager *Manager) enqueue(githubClient *github.Client, hook mongodb.Hook, trigger *build.TriggerSpec) error {
+	repository, err := githubClient.GetRepository(hook.Organization, hook.Repository)
+	if err != nil {
+		return err
+	}
+	branch := trigger.GetScheduleBranch()
+	if branch == "" && repository.DefaultBranch != nil {
+		branch = *repository.DefaultBranch
+	}
+	sha, err := githubClient.GetBranchSHA(hook.Organization, hook.Repository, branch)
+	if err != nil {
+		return err
+	}
+	event := &github.Event{
+		Type:         github.EventTypeSchedule,
+		Branch:       branch,
+		Schedule:     trigger.Name,
+		Organization: hook.Organization,
+		Repository:   hook.Repository,
+		SHA:          sha,
+	}
+	if repository.CloneURL != nil {
+		event.CloneURL = *repository.CloneURL
+	}
+	if repository.SSHURL != nil {
+		event.SSHURL = *repository.SSHURL
+	}
+	log.Printf("Scheduled trigger '%s' of %s/%s for branch '%s' and SHA '%s'", trigger.Name, hook.Organization, hook.Repository, branch, sha)
+	return schedulerManager.QueueManager.Enqueue(event)
+}
+
+// getSpec gets the build spec in the default branch of a repository, refreshing the cached one when it is too old.
+func (schedulerManager *Manager) getSpec(githubClient *github.Client, hook mongodb.Hook, t time.Time) *build.Spec {
+	key := hook.Organization + "/" + hook.Repository
+	refresh := time.Duration(schedulerManager.Config.SpecRefreshMinutes) * time.Minute
+	schedulerManager.mutex.Lock()
+	cached, ok := schedulerManager.specs[key]
+	schedulerManager.mutex.Unlock()
+	if ok && t.Sub(cached.loaded) < refresh {
+		return cached.spec
+	}
+
+	event := &github.Event{Organization: hook.Organization, Repository: hook.Repository}
+	buildSpec, err := schedulerManager.BuildManager.GetSpec(githubClient, event)
+	if err != nil {
+		log.Printf("Error getting the build spec of %s/%s to evaluate the schedules. %s", hook.Organization, hook.Repository, err)
+		buildSpec = nil
+	}
+	schedulerManager.mutex.Lock()
+	schedulerManager.specs[key] = &cachedSpec{spec: buildSpec, loaded: t}
+	schedulerManager.mutex.Unlock()
+	return buildSpec
+}
@@ -0,0 +1,254 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"gopkg.in/mgo.v2"
+
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+// Placeholder is returned by the API instead of the value of a secret variable.
+// Updating a secret variable with the placeholder keeps its stored value.
+const Placeholder = "********"
+
+// ErrNoKey is returned when a secret is encrypted without any key configured.
+var ErrNoKey = errors.New("No encryption key configured for the secrets")
+
+// sampleKey is the example key of the documentation (and of previous default configurations). As it is
+// public, the server does not start with it.
+const sampleKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+// Config type.
+// Keys to encrypt the secret variables with AES-GCM. Every key is the base64 encoding of 16, 24 or 32 bytes
+// (AES-128, AES-192 or AES-256), and it is identified by its ID. The secrets are encrypted with the ActiveKey
+// (the first key if empty), and decrypted with the key they were encrypted with. Without keys, no secret
+// variable can be stored.
+// To rotate the key, a new key is added and made active: the secrets encrypted with the old keys are
+// re-encrypted with the active key when the server starts, and then the old keys may be removed.
+type Config struct {
+	Keys      []KeyConfig
+	ActiveKey string `json:"activeKey"`
+}
+
+// KeyConfig type.
+type KeyConfig struct {
+	ID  string
+	Key string
+}
+
+// Manager type.
+// Manager to encrypt the secret variables of the repository settings. The secret values are stored
+// encrypted in mongodb, and they are only decrypted to be injected in the build containers.
+type Manager struct {
+	Config    *Config
+	Database  *mongodb.Database
+	ciphers   map[string]cipher.AEAD
+	activeKey string
+}
+
+// NewManager is the constructor of Manager.
+func NewManager(config *Config, database *mongodb.Database) (*Manager, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	secretsManager := &Manager{Config: config, Database: database, ciphers: make(map[string]cipher.AEAD)}
+	for _, keyConfig := range config.Keys {
+		if keyConfig.Key == sampleKey {
+			return nil, fmt.Errorf("Invalid secrets key '%s'. The sample key must be replaced (e.g. openssl rand -base64 32)", keyConfig.ID)
+		}
+		key, err := base64.StdEncoding.DecodeString(keyConfig.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid secrets key '%s'. %s", keyConfig.ID, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid secrets key '%s'. %s", keyConfig.ID, err)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid secrets key '%s'. %s", keyConfig.ID, err)
+		}
+		secretsManager.ciphers[keyConfig.ID] = gcm
+	}
+	secretsManager.activeKey = config.ActiveKey
+	if secretsManager.activeKey == "" && len(config.Keys) > 0 {
+		secretsManager.activeKey = config.Keys[0].ID
+	}
+	if _, ok := secretsManager.ciphers[secretsManager.activeKey]; !ok && secretsManager.activeKey != "" {
+		return nil, fmt.Errorf("Unknown active secrets key '%s'", secretsManager.activeKey)
+	}
+	return secretsManager, nil
+}
+
+// secretContext is the additional data authenticated with a secret, so that an encrypted value
+// cannot be moved to another variable or repository.
+func secretContext(repository *mongodb.Repository, name string) []byte {
+	return []byte(repository.OrgID + "/" + repository.RepoID + "/" + name)
+}
+
+// Encrypt a secret variable of a repository with the active key.
+func (secretsManager *Manager) Encrypt(repository *mongodb.Repository, envVar *mongodb.PipelineEnvVar, value string) error {
+	gcm, ok := secretsManager.ciphers[secretsManager.activeKey]
+	if !ok {
+		return ErrNoKey
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), secretContext(repository, envVar.Name))
+	envVar.Value = ""
+	envVar.Encrypted = base64.StdEncoding.EncodeToString(sealed)
+	envVar.KeyID = secretsManager.activeKey
+	return nil
+}
+
+// Decrypt a secret variable of a repository.
+func (secretsManager *Manager) Decrypt(repository *mongodb.Repository, envVar *mongodb.PipelineEnvVar) (string, error) {
+	if envVar.Encrypted == "" {
+		return envVar.Value, nil
+	}
+	gcm, ok := secretsManager.ciphers[envVar.KeyID]
+	if !ok {
+		return "", fmt.Errorf("Unknown secrets key '%s' for variable '%s'", envVar.KeyID, envVar.Name)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(envVar.Encrypted)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("Invalid encrypted value of variable '%s'", envVar.Name)
+	}
+	value, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], secretContext(repository, envVar.Name))
+	if err != nil {
+		return "", fmt.Errorf("Error decrypting variable '%s'. %s", envVar.Name, err)
+	}
+	return string(value), nil
+}
+
+// Seal encrypts the values of the secret variables of a repository to be stored. The variables whose value
+// is the placeholder keep the value stored in the current settings of the repository.
+func (secretsManager *Manager) Seal(repository, current *mongodb.Repository) error {
+	stored := make(map[string]mongodb.PipelineEnvVar)
+	for _, envVar := range current.EnvVars {
+		stored[envVar.Name] = envVar
+	}
+	for i := range repository.EnvVars {
+		envVar := &repository.EnvVars[i]
+		envVar.Encrypted = ""
+		envVar.KeyID = ""
+		if envVar.Value != Placeholder {
+			if envVar.Secret {
+				if err := secretsManager.Encrypt(repository, envVar, envVar.Value); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		storedVar, ok := stored[envVar.Name]
+		if !ok || !storedVar.Secret {
+			return fmt.Errorf("Missing value of variable '%s'", envVar.Name)
+		}
+		if envVar.Secret {
+			envVar.Value = storedVar.Value
+			envVar.Encrypted = storedVar.Encrypted
+			envVar.KeyID = storedVar.KeyID
+			continue
+		}
+		// The variable is not secret anymore
+		value, err := secretsManager.Decrypt(current, &storedVar)
+		if err != nil {
+			return err
+		}
+		envVar.Value = value
+	}
+	return nil
+}
+
+// Hide replaces the values of the secret variables of a repository with the placeholder.
+func Hide(repository *mongodb.Repository) {
+	for i := range repository.EnvVars {
+		envVar := &repository.EnvVars[i]
+		if envVar.Secret {
+			envVar.Value = Placeholder
+		}
+		envVar.Encrypted = ""
+		envVar.KeyID = ""
+	}
+}
+
+// Rotate re-encrypts with the active key the secret variables encrypted with other keys, or not encrypted yet.
+// It must run before serving the API, but every variable is only updated if it was not updated meanwhile
+// (e.g. by another server instance).
+func (secretsManager *Manager) Rotate() error {
+	if secretsManager.activeKey == "" {
+		return nil
+	}
+	repositories, err := secretsManager.Database.FindAllRepositories()
+	if err != nil {
+		return err
+	}
+	for i := range repositories {
+		repository := &repositories[i]
+		rotated := 0
+		for j := range repository.EnvVars {
+			envVar := &repository.EnvVars[j]
+			if !secretsManager.needsRotation(envVar) {
+				continue
+			}
+			previous := *envVar
+			if err := secretsManager.rotateEnvVar(repository, envVar); err != nil {
+				log.Printf("Error rotating the key of repository '%s/%s'. %s", repository.OrgID, repository.RepoID, err)
+				continue
+			}
+			err = secretsManager.Database.UpdateEncryptedEnvVar(repository, &previous, envVar)
+			if err == mgo.ErrNotFound {
+				log.Printf("Not rotated the key of variable '%s' of repository '%s/%s', as it was updated meanwhile",
+					envVar.Name, repository.OrgID, repository.RepoID)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			rotated++
+		}
+		if rotated == 0 {
+			continue
+		}
+		log.Printf("Rotated the key of %d secrets of repository '%s/%s'", rotated, repository.OrgID, repository.RepoID)
+	}
+	return nil
+}
+
+// needsRotation checks if a variable is secret, but not encrypted with the active key.
+func (secretsManager *Manager) needsRotation(envVar *mongodb.PipelineEnvVar) bool {
+	return envVar.Secret && (envVar.Encrypted == "" || envVar.KeyID != secretsManager.activeKey)
+}
+
+// rotateEnvVar re-encrypts a secret variable of a repository with the active key.
+func (secretsManager *Manager) rotateEnvVar(repository *mongodb.Repository, envVar *mongodb.PipelineEnvVar) error {
+	value, err := secretsManager.Decrypt(repository, envVar)
+	if err != nil {
+		return err
+	}
+	return secretsManager.Encrypt(repository, envVar, value)
+}
@@ -0,0 +1,198 @@
+// Copyright 2016 Telefónica Investigación y Desarrollo, S.A.U
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secrets
+
+import (
+	"testing"
+
+	"github.com/gocilla/gocilla/managers/mongodb"
+)
+
+const (
+	testKey1 = "YWJjZGVmMDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODk="
+	testKey2 = "MDEyMzQ1Njc4OWFiY2RlZmdoaWprbG1ub3BxcnN0dXY="
+)
+
+func newTestManager(t *testing.T, activeKey string) *Manager {
+	secretsManager, err := NewManager(&Config{
+		Keys:      []KeyConfig{{ID: "key-1", Key: testKey1}, {ID: "key-2", Key: testKey2}},
+		ActiveKey: activeKey,
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewManager: %s", err)
+	}
+	return secretsManager
+}
+
+func TestNewManager(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *Config
+		wantErr bool
+	}{
+		{"no config", nil, false},
+		{"no keys", &Config{}, false},
+		{"first key active", &Config{Keys: []KeyConfig{{ID: "key-1", Key: testKey1}}}, false},
+		{"sample key", &Config{Keys: []KeyConfig{{ID: "key-1", Key: sampleKey}}}, true},
+		{"inactive sample key", &Config{Keys: []KeyConfig{{ID: "key-1", Key: testKey1}, {ID: "old", Key: sampleKey}}, ActiveKey: "key-1"}, true},
+		{"invalid base64", &Config{Keys: []KeyConfig{{ID: "key-1", Key: "not base64!"}}}, true},
+		{"invalid key size", &Config{Keys: []KeyConfig{{ID: "key-1", Key: "c2hvcnQ="}}}, true},
+		{"unknown active key", &Config{Keys: []KeyConfig{{ID: "key-1", Key: testKey1}}, ActiveKey: "key-2"}, true},
+	}
+	for _, test := range tests {
+		if _, err := NewManager(test.config, nil); (err != nil) != test.wantErr {
+			t.Errorf("%s: NewManager = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	secretsManager := newTestManager(t, "key-1")
+	repository := &mongodb.Repository{OrgID: "org", RepoID: "repo"}
+	envVar := &mongodb.PipelineEnvVar{Name: "TOKEN", Secret: true}
+	if err := secretsManager.Encrypt(repository, envVar, "s3cr3t"); err != nil {
+		t.Fatalf("Encrypt: %s", err)
+	}
+	if envVar.Value != "" || envVar.Encrypted == "" || envVar.KeyID != "key-1" {
+		t.Fatalf("Encrypt = %+v", envVar)
+	}
+	if value, err := secretsManager.Decrypt(repository, envVar); err != nil || value != "s3cr3t" {
+		t.Errorf("Decrypt = %q, %v, want %q", value, err, "s3cr3t")
+	}
+
+	// The encrypted value is authenticated with the organization, repository and name of the variable
+	tests := []struct {
+		name       string
+		repository *mongodb.Repository
+		envVar     mongodb.PipelineEnvVar
+	}{
+		{"other organization", &mongodb.Repository{OrgID: "other", RepoID: "repo"}, *envVar},
+		{"other repository", &mongodb.Repository{OrgID: "org", RepoID: "other"}, *envVar},
+		{"other name", repository, mongodb.PipelineEnvVar{Name: "OTHER", Secret: true, Encrypted: envVar.Encrypted, KeyID: envVar.KeyID}},
+		{"other key", repository, mongodb.PipelineEnvVar{Name: "TOKEN", Secret: true, Encrypted: envVar.Encrypted, KeyID: "key-2"}},
+		{"unknown key", repository, mongodb.PipelineEnvVar{Name: "TOKEN", Secret: true, Encrypted: envVar.Encrypted, KeyID: "key-3"}},
+		{"invalid base64", repository, mongodb.PipelineEnvVar{Name: "TOKEN", Secret: true, Encrypted: "!", KeyID: "key-1"}},
+		{"short", repository, mongodb.PipelineEnvVar{Name: "TOKEN", Secret: true, Encrypted: "YQ==", KeyID: "key-1"}},
+	}
+	for _, test := range tests {
+		if value, err := secretsManager.Decrypt(test.repository, &test.envVar); err == nil {
+			t.Errorf("%s: Decrypt = %q, want error", test.name, value)
+		}
+	}
+}
+
+func TestEncryptWithoutKey(t *testing.T) {
+	secretsManager, err := NewManager(nil, nil)
+	if err != nil {
+		t.Fatalf("NewManager: %s", err)
+	}
+	envVar := &mongodb.PipelineEnvVar{Name: "TOKEN", Secret: true}
+	if err := secretsManager.Encrypt(&mongodb.Repository{}, envVar, "s3cr3t"); err != ErrNoKey {
+		t.Errorf("Encrypt = %v, want %v", err, ErrNoKey)
+	}
+}
+
+func TestSeal(t *testing.T) {
+	secretsManager := newTestManager(t, "key-1")
+	current := &mongodb.Repository{OrgID: "org", RepoID: "repo", EnvVars: []mongodb.PipelineEnvVar{
+		{Name: "PLAIN", Value: "value"},
+		{Name: "TOKEN", Value: "s3cr3t", Secret: true},
+		{Name: "UNSECRET", Value: "was secret", Secret: true},
+	}}
+	if err := secretsManager.Seal(current, &mongodb.Repository{}); err != nil {
+		t.Fatalf("Seal: %s", err)
+	}
+	if current.EnvVars[0].Value != "value" || current.EnvVars[0].Encrypted != "" {
+		t.Errorf("Seal of a plain variable = %+v", current.EnvVars[0])
+	}
+	stored := current.EnvVars[1]
+	if stored.Value != "" || stored.Encrypted == "" {
+		t.Fatalf("Seal of a secret variable = %+v", stored)
+	}
+
+	updated := &mongodb.Repository{OrgID: "org", RepoID: "repo", EnvVars: []mongodb.PipelineEnvVar{
+		{Name: "TOKEN", Value: Placeholder, Secret: true},
+		{Name: "UNSECRET", Value: Placeholder},
+	}}
+	if err := secretsManager.Seal(updated, current); err != nil {
+		t.Fatalf("Seal: %s", err)
+	}
+	if got := updated.EnvVars[0]; got.Encrypted != stored.Encrypted || got.KeyID != stored.KeyID || got.Value != "" {
+		t.Errorf("Seal with the placeholder = %+v, want the stored %+v", got, stored)
+	}
+	if got := updated.EnvVars[1]; got.Value != "was secret" || got.Encrypted != "" {
+		t.Errorf("Seal of a variable not secret anymore = %+v", got)
+	}
+
+	missing := &mongodb.Repository{OrgID: "org", RepoID: "repo", EnvVars: []mongodb.PipelineEnvVar{
+		{Name: "NEW", Value: Placeholder, Secret: true},
+	}}
+	if err := secretsManager.Seal(missing, current); err == nil {
+		t.Errorf("Seal with the placeholder of a new variable = nil, want error")
+	}
+}
+
+func TestHide(t *testing.T) {
+	repository := &mongodb.Repository{EnvVars: []mongodb.PipelineEnvVar{
+		{Name: "PLAIN", Value: "value"},
+		{Name: "TOKEN", Secret: true, Encrypted: "encrypted", KeyID: "key-1"},
+	}}
+	Hide(repository)
+	want := []mongodb.PipelineEnvVar{
+		{Name: "PLAIN", Value: "value"},
+		{Name: "TOKEN", Value: Placeholder, Secret: true},
+	}
+	for i := range want {
+		if got := repository.EnvVars[i]; got.Name != want[i].Name || got.Value != want[i].Value ||
+			got.Encrypted != "" || got.KeyID != "" {
+			t.Errorf("Hide = %+v, want %+v", got, want[i])
+		}
+	}
+}
+
+func TestRotateEnvVar(t *testing.T) {
+	oldManager := newTestManager(t, "key-1")
+	newManager := newTestManager(t, "key-2")
+	repository := &mongodb.Repository{OrgID: "org", RepoID: "repo"}
+	envVar := &mongodb.PipelineEnvVar{Name: "TOKEN", Secret: true}
+	if err := oldManager.Encrypt(repository, envVar, "s3cr3t"); err != nil {
+		t.Fatalf("Encrypt: %s", err)
+	}
+	if oldManager.needsRotation(envVar) {
+		t.Errorf("needsRotation with the active key = true")
+	}
+	if !newManager.needsRotation(envVar) {
+		t.Fatalf("needsRotation with another key = false")
+	}
+	previous := *envVar
+	if err := newManager.rotateEnvVar(repository, envVar); err != nil {
+		t.Fatalf("rotateEnvVar: %s", err)
+	}
+	if envVar.KeyID != "key-2" || envVar.Encrypted == previous.Encrypted || newManager.needsRotation(envVar) {
+		t.Errorf("rotateEnvVar = %+v", envVar)
+	}
+	if value, err := newManager.Decrypt(repository, envVar); err != nil || value != "s3cr3t" {
+		t.Errorf("Decrypt after rotation = %q, %v", value, err)
+	}
+
+	// The secrets not encrypted yet are encrypted, and the plain variables are not rotated
+	plain := &mongodb.PipelineEnvVar{Name: "LEGACY", Value: "legacy", Secret: true}
+	if !newManager.needsRotation(plain) || newManager.needsRotation(&mongodb.PipelineEnvVar{Name: "PLAIN", Value: "value"}) {
+		t.Errorf("needsRotation of a legacy secret or plain variable")
+	}
+	if err := newManager.rotateEnvVar(repository, plain); err != nil || plain.Value != "" || plain.KeyID != "key-2" {
+		t.Errorf("rotateEnvVar of a legacy secret = %+v, %v", plain, err)
+	}
+}
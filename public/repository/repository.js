@@ -40,16 +40,165 @@ function RepositoryBuildController($scope, $routeParams, $cacheFactory, $http, R
   RepositoryController($scope, $routeParams, $cacheFactory, RepositoryBuildsService);
 
   $scope.buildId = $routeParams.buildId;
+  $scope.cancelBuild = cancelBuild;
+  $scope.restartBuild = restartBuild;
+  $scope.isBuild = isBuild;
+  $scope.toggleLogSection = toggleLogSection;
+  $scope.spanClass = spanClass;
+  $scope.spanStyle = spanStyle;
+  $scope.logSections = [];
+  $scope.buildLogsDownloadUrl = '/api/organizations/' + $scope.orgId + '/repositories/' + $scope.repoId + '/builds/'
+      + $scope.buildId + '/logs?download=true';
+
+  loadArtifacts();
+  if (window.EventSource) {
+    streamLogs();
+  } else {
+    updateLogs();
+  }
+
+  // The build is identified either by its ID or by its number
+  function isBuild(build) {
+    return build.id === $scope.buildId || String(build.number) === $scope.buildId;
+  }
+
+  function cancelBuild() {
+    var cancelBuildUrl = '/api/organizations/' + $scope.orgId + '/repositories/' + $scope.repoId + '/builds/'
+        + $scope.buildId + '/cancel';
+    $http({method: 'POST', url: cancelBuildUrl}).then(function() {
+      var repositoryBuildsUrl = '/api/organizations/' + $scope.orgId + '/repositories/' + $scope.repoId + '/builds';
+      $cacheFactory.get('repositoryBuildsCache').remove(repositoryBuildsUrl);
+    }, function onError() {
+      console.log('Error');
+    });
+  }
+
+  function restartBuild() {
+    var restartBuildUrl = '/api/organizations/' + $scope.orgId + '/repositories/' + $scope.repoId + '/builds/'
+        + $scope.buildId + '/restart';
+    $http({method: 'POST', url: restartBuildUrl}).then(function() {
+      var repositoryBuildsUrl = '/api/organizations/' + $scope.orgId + '/repositories/' + $scope.repoId + '/builds';
+      $cacheFactory.get('repositoryBuildsCache').remove(repositoryBuildsUrl);
+    }, function onError() {
+      console.log('Error');
+    });
+  }
 
-  updateLogs();
+  // The log is streamed until the build ends. On reconnection, it is resumed from the last event received.
+  function streamLogs() {
+    var buildLogsStreamUrl = '/api/organizations/' + $scope.orgId + '/repositories/' + $scope.repoId + '/builds/'
+        + $scope.buildId + '/logs/stream';
+    var source = new EventSource(buildLogsStreamUrl);
+    $scope.buildLogs = '';
+    source.addEventListener('log', function(event) {
+      var message = JSON.parse(event.data);
+      $scope.$apply(function() {
+        $scope.buildLogs += message.text;
+      });
+    });
+    source.addEventListener('end', function() {
+      source.close();
+      loadArtifacts();
+      loadRenderedLogs();
+      loadLogSections();
+      var repositoryBuildsUrl = '/api/organizations/' + $scope.orgId + '/repositories/' + $scope.repoId + '/builds';
+      $cacheFactory.get('repositoryBuildsCache').remove(repositoryBuildsUrl);
+    });
+    $scope.$on('$destroy', function() {
+      source.close();
+    });
+  }
 
   function updateLogs() {
+    loadRenderedLogs();
+    loadLogSections();
+  }
+
+  function loadArtifacts() {
+    $scope.buildArtifactsUrl = '/api/organizations/' + $scope.orgId + '/repositories/' + $scope.repoId + '/builds/'
+        + $scope.buildId + '/artifacts';
+    $http({method: 'GET', url: $scope.buildArtifactsUrl}).then(function(response) {
+      $scope.artifacts = response.data;
+    });
+  }
+
+  // The log rendered by the server, with the ANSI colors and the carriage return updates interpreted
+  function loadRenderedLogs() {
     var buildLogsUrl = '/api/organizations/' + $scope.orgId + '/repositories/' + $scope.repoId + '/builds/'
-        + $scope.buildId + '/logs';
+        + $scope.buildId + '/logs?format=json';
     $http({method: 'GET', url: buildLogsUrl}).then(function(response) {
-      $scope.buildLogs = response.data;
+      $scope.renderedLogs = response.data;
     });
   }
+
+  // The lines of the log are grouped in a section for every consecutive run of lines of the same task.
+  // The sections of the tasks that failed are expanded. The lines are loaded in pages of logLinesPage lines.
+  var logLinesPage = 10000;
+
+  function loadLogSections() {
+    var sections = [];
+    var section = null;
+    $scope.logSections = sections;
+    loadLogLines(1);
+
+    function loadLogLines(from) {
+      var buildLogLinesUrl = '/api/organizations/' + $scope.orgId + '/repositories/' + $scope.repoId + '/builds/'
+          + $scope.buildId + '/logs/lines?render=true&limit=' + logLinesPage + '&from=' + from;
+      $http({method: 'GET', url: buildLogLinesUrl}).then(function(response) {
+        response.data.forEach(addLine);
+        if (response.data.length === logLinesPage) {
+          loadLogLines(response.data[response.data.length - 1].number + 1);
+        }
+      });
+    }
+
+    function addLine(line) {
+      if (section === null || section.task !== line.task) {
+        section = {task: line.task, lines: [], collapsed: true};
+        sections.push(section);
+      }
+      if (line.stream === 'system' && /^Ended task .* with status '(?!success')/.test(line.text)) {
+        section.collapsed = false;
+      }
+      section.lines.push(line);
+    }
+  }
+
+  function toggleLogSection(section) {
+    section.collapsed = !section.collapsed;
+  }
+
+  // Named colors are styled with CSS classes, and RGB colors with inline styles
+  function spanClass(span) {
+    var classes = [];
+    if (span.bold) {
+      classes.push('ansi-bold');
+    }
+    if (span.italic) {
+      classes.push('ansi-italic');
+    }
+    if (span.underline) {
+      classes.push('ansi-underline');
+    }
+    if (span.fg && span.fg.charAt(0) !== '#') {
+      classes.push('ansi-' + span.fg);
+    }
+    if (span.bg && span.bg.charAt(0) !== '#') {
+      classes.push('ansi-bg-' + span.bg);
+    }
+    return classes;
+  }
+
+  function spanStyle(span) {
+    var style = {};
+    if (span.fg && span.fg.charAt(0) === '#') {
+      style.color = span.fg;
+    }
+    if (span.bg && span.bg.charAt(0) === '#') {
+      style['background-color'] = span.bg;
+    }
+    return style;
+  }
 }
 
 RepositorySettingsController.$inject = ['$scope', '$routeParams', '$cacheFactory', 'RepositoryService', 'RepositoryBuildsService'];